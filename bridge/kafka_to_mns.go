@@ -0,0 +1,360 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Shopify/sarama"
+	"gopkg.in/tomb.v1"
+
+	"github.com/wangping886/mns_consumer/kafka"
+	"github.com/wangping886/mns_consumer/logger"
+	"github.com/wangping886/mns_consumer/mns.aliyun"
+	"github.com/wangping886/mns_consumer/util"
+)
+
+const (
+	maxBatchSize          = 16       // BatchSendMessage 一次最多发送 16 条消息
+	maxMessageSize        = 64 << 10 // MNS 消息体最大 64KB, BatchSendMessage 一次发送的消息体总大小也不能超过 64KB
+	defaultLinger         = 100 * time.Millisecond
+	defaultRetryBackoff   = time.Second
+	defaultCommitInterval = time.Second
+)
+
+var (
+	errRevoked         = errors.New("partition revoked")
+	errMessageTooLarge = fmt.Errorf("message body exceeds the MNS limit of %d bytes", maxMessageSize)
+	errTagTooLong      = fmt.Errorf("MessageTag exceeds %d characters", mns.MaxMessageTagLength)
+)
+
+// permanent 判断是不是重试也不会成功的错误, 比如消息体超过 MNS 的大小限制或者参数不合法.
+func permanent(err error) bool {
+	if errors.Is(err, errMessageTooLarge) || errors.Is(err, errTagTooLong) {
+		return true
+	}
+	apiErr, ok := err.(*mns.ApiError)
+	return ok && (apiErr.Code == "InvalidArgument" || apiErr.Code == "MessageBodyTooLong")
+}
+
+// KafkaToMNS 把 kafka topic 的消息转发到 MNS 队列或者主题.
+// 每个 partition 的消息按顺序攒成一批, 转发到队列时用 BatchSendMessage2 一次发送,
+// 转发到主题时逐条 PublishMessage2; 一批消息全部发送成功(或者进入死信 topic)之后才标记 offset.
+// 发送失败的消息按 WithRetry 重试, 重试用完后发送到 WithDeadLetterTopic 设置的死信 topic,
+// 没有设置死信 topic 时一直重试, 直到成功或者 partition 被回收.
+// 重试也不会成功的消息(比如转换后的消息体超过 MNS 的 64KB 限制)不重试, 直接发送到死信 topic,
+// 没有设置死信 topic 时记录错误日志并跳过, 避免一条消息卡住整个 partition.
+type KafkaToMNS struct {
+	group        sarama.ConsumerGroup
+	topics       []string
+	queue        *mns.QueueClient
+	topic        *mns.TopicClient
+	batchSize    int
+	linger       time.Duration
+	maxRetry     int
+	retryBackoff time.Duration
+	commitEvery  time.Duration
+	deadLetter   *kafka.Producer
+	deadTopic    string
+	logger       logger.Logger
+	t            tomb.Tomb
+	w            util.WaitGroupWrapper
+}
+
+type option func(b *KafkaToMNS)
+
+// NewKafkaToQueue 把 group 消费的 topics 转发到 MNS 队列. group 由调用方创建和关闭,
+// 推荐使用 kafka.NewConsumerGroup 创建, 它关闭了自动提交(offset 由 KafkaToMNS 在消息发送成功后提交), 并应用 TLS 和 SASL 配置.
+func NewKafkaToQueue(group sarama.ConsumerGroup, topics []string, clt *mns.QueueClient, options ...option) *KafkaToMNS {
+	b := newKafkaToMNS(group, topics, options...)
+	b.queue = clt
+	return b
+}
+
+// NewKafkaToTopic 把 group 消费的 topics 发布到 MNS 主题, kafka 消息的 HeaderTag 用作 MessageTag.
+func NewKafkaToTopic(group sarama.ConsumerGroup, topics []string, clt *mns.TopicClient, options ...option) *KafkaToMNS {
+	b := newKafkaToMNS(group, topics, options...)
+	b.topic = clt
+	return b
+}
+
+func newKafkaToMNS(group sarama.ConsumerGroup, topics []string, options ...option) *KafkaToMNS {
+	b := &KafkaToMNS{
+		group:        group,
+		topics:       topics,
+		batchSize:    maxBatchSize,
+		linger:       defaultLinger,
+		retryBackoff: defaultRetryBackoff,
+		commitEvery:  defaultCommitInterval,
+		logger:       logger.Std,
+	}
+	for _, o := range options {
+		o(b)
+	}
+	if b.batchSize < 1 || b.batchSize > maxBatchSize {
+		b.batchSize = maxBatchSize
+	}
+	return b
+}
+
+// WithBatch 设置一批消息的最大条数(不超过 16)和凑批等待的最长时间, 默认 16 条, 100ms.
+func WithBatch(size int, linger time.Duration) option {
+	return func(b *KafkaToMNS) {
+		b.batchSize = size
+		b.linger = linger
+	}
+}
+
+// WithRetry 设置发送失败后的重试次数和重试间隔, 默认不重试, 间隔 1 秒.
+func WithRetry(retry int, backoff time.Duration) option {
+	return func(b *KafkaToMNS) {
+		b.maxRetry = retry
+		b.retryBackoff = backoff
+	}
+}
+
+// WithCommitInterval 设置提交 offset 的最小间隔, 默认 1 秒.
+func WithCommitInterval(d time.Duration) option {
+	return func(b *KafkaToMNS) {
+		b.commitEvery = d
+	}
+}
+
+// WithDeadLetterTopic 设置死信 topic, 重试用完仍然发送失败的消息由 producer 发送到 topic,
+// 消息格式见 kafka.DeadLetterMessage.
+func WithDeadLetterTopic(producer *kafka.Producer, topic string) option {
+	return func(b *KafkaToMNS) {
+		b.deadLetter = producer
+		b.deadTopic = topic
+	}
+}
+
+func WithLogger(l logger.Logger) option {
+	return func(b *KafkaToMNS) {
+		b.logger = l
+	}
+}
+
+func (b *KafkaToMNS) Start() {
+	b.w.Wrap(b.serve)
+
+	go func() {
+		b.w.Wait()
+		b.t.Done()
+	}()
+}
+
+// Stop 等待正在发送的批次结束之后返回, 没有发送的消息不提交 offset.
+func (b *KafkaToMNS) Stop() {
+	b.t.Kill(nil)
+	b.t.Wait()
+	b.logger.Info("bridge stopped", logger.F("topics", b.topics))
+}
+
+func (b *KafkaToMNS) serve() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-b.t.Dying()
+		cancel()
+	}()
+
+	for {
+		err := b.group.Consume(ctx, b.topics, b)
+		if ctx.Err() != nil || errors.Is(err, sarama.ErrClosedConsumerGroup) {
+			break
+		}
+		if err != nil {
+			b.logger.Error("consume failed", logger.F("topics", b.topics), logger.Err(err))
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+func (b *KafkaToMNS) Setup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// Cleanup 在所有 ConsumeClaim 返回之后调用, 提交最后标记的 offset.
+func (b *KafkaToMNS) Cleanup(sess sarama.ConsumerGroupSession) error {
+	sess.Commit()
+	return nil
+}
+
+func (b *KafkaToMNS) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	var (
+		batch      = make([]*sarama.ConsumerMessage, 0, b.batchSize)
+		linger     <-chan time.Time
+		lastCommit = time.Now()
+	)
+	for {
+		select {
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			batch = append(batch, msg)
+			if len(batch) == 1 {
+				linger = time.After(b.linger)
+			}
+			if len(batch) < b.batchSize {
+				continue
+			}
+		case <-linger:
+		case <-sess.Context().Done():
+			// 没有发送的消息不标记, 由下一个 owner 重新消费
+			return nil
+		}
+
+		if err := b.forward(sess.Context(), batch); err != nil {
+			return nil
+		}
+		sess.MarkMessage(batch[len(batch)-1], "")
+		if time.Since(lastCommit) >= b.commitEvery {
+			sess.Commit()
+			lastCommit = time.Now()
+		}
+		batch = batch[:0]
+		linger = nil
+	}
+}
+
+// forward 发送一批消息, 直到全部发送成功或者进入死信 topic; partition 被回收(ctx 取消)时返回 errRevoked.
+func (b *KafkaToMNS) forward(ctx context.Context, batch []*sarama.ConsumerMessage) error {
+	pending := batch
+	for attempt := 0; ; attempt++ {
+		errs := b.send(pending)
+
+		var (
+			failed       []*sarama.ConsumerMessage
+			failedErrs   []error
+			rejected     []*sarama.ConsumerMessage
+			rejectedErrs []error
+		)
+		for i, err := range errs {
+			switch {
+			case err == nil:
+			case permanent(err):
+				rejected = append(rejected, pending[i])
+				rejectedErrs = append(rejectedErrs, err)
+			default:
+				b.logger.Warn("forward message failed", msgFields(pending[i], logger.F("attempt", attempt+1), logger.Err(err))...)
+				failed = append(failed, pending[i])
+				failedErrs = append(failedErrs, err)
+			}
+		}
+		if len(failed) > 0 && attempt >= b.maxRetry && b.deadLetter != nil {
+			failed = b.sendDeadLetter(ctx, failed, failedErrs)
+		}
+		if len(rejected) > 0 {
+			failed = append(failed, b.reject(ctx, rejected, rejectedErrs)...)
+		}
+		if len(failed) == 0 {
+			return nil
+		}
+		pending = failed
+
+		select {
+		case <-time.After(b.retryBackoff):
+		case <-ctx.Done():
+			return errRevoked
+		}
+	}
+}
+
+// reject 处理重试也不会成功的消息: 设置了死信 topic 时发送到死信 topic, 返回发送失败的消息; 否则跳过.
+func (b *KafkaToMNS) reject(ctx context.Context, msgs []*sarama.ConsumerMessage, errs []error) (failed []*sarama.ConsumerMessage) {
+	if b.deadLetter != nil {
+		return b.sendDeadLetter(ctx, msgs, errs)
+	}
+	for i, msg := range msgs {
+		b.logger.Error("message can't be forwarded, skipped", msgFields(msg, logger.Err(errs[i]))...)
+	}
+	return nil
+}
+
+// send 发送消息, 返回每条消息的发送结果.
+func (b *KafkaToMNS) send(batch []*sarama.ConsumerMessage) []error {
+	errs := make([]error, len(batch))
+	if b.topic != nil {
+		for i, msg := range batch {
+			body, tag := toMNS(msg)
+			switch {
+			case len(body) > maxMessageSize:
+				errs[i] = errMessageTooLarge
+			case utf8.RuneCountInString(tag) > mns.MaxMessageTagLength:
+				errs[i] = errTagTooLong
+			default:
+				_, _, errs[i] = b.topic.PublishMessage2(&mns.MessageToPublish{
+					MessageBody: body,
+					MessageTag:  tag,
+				}, false)
+			}
+		}
+		return errs
+	}
+
+	// 按条数和消息体总大小分成多次 BatchSendMessage2
+	var (
+		msgs  []mns.MessageToSend
+		index []int // msgs[i] 对应 batch[index[i]]
+		size  int
+	)
+	flush := func() {
+		if len(msgs) == 0 {
+			return
+		}
+		// 信封是 JSON 格式的可打印字符串, 不需要 base64 编码
+		_, resp, err := b.queue.BatchSendMessage2(msgs, false)
+		for i, j := range index {
+			switch {
+			case err != nil:
+				errs[j] = err
+			case resp[i].ErrorCode != "":
+				errs[j] = &mns.ApiError{Code: resp[i].ErrorCode, Message: resp[i].ErrorMessage}
+			}
+		}
+		msgs, index, size = nil, nil, 0
+	}
+	for i, msg := range batch {
+		body, _ := toMNS(msg)
+		if len(body) > maxMessageSize {
+			errs[i] = errMessageTooLarge
+			continue
+		}
+		if size+len(body) > maxMessageSize {
+			flush()
+		}
+		msgs = append(msgs, mns.MessageToSend{MessageBody: body})
+		index = append(index, i)
+		size += len(body)
+	}
+	flush()
+	return errs
+}
+
+// sendDeadLetter 把消息发送到死信 topic, 返回发送失败的消息.
+func (b *KafkaToMNS) sendDeadLetter(ctx context.Context, msgs []*sarama.ConsumerMessage, errs []error) (failed []*sarama.ConsumerMessage) {
+	for i, msg := range msgs {
+		if err := b.deadLetter.SendSync(ctx, kafka.DeadLetterMessage(b.deadTopic, msg, errs[i])); err != nil {
+			b.logger.Error("send message to dead letter topic failed", msgFields(msg, logger.Err(err))...)
+			failed = append(failed, msg)
+			continue
+		}
+		b.logger.Warn("message moved to dead letter topic", msgFields(msg, logger.F("dead_letter_topic", b.deadTopic), logger.Err(errs[i]))...)
+	}
+	return
+}
+
+func msgFields(msg *sarama.ConsumerMessage, fields ...logger.Field) []logger.Field {
+	return append([]logger.Field{
+		logger.F("topic", msg.Topic),
+		logger.F("partition", msg.Partition),
+		logger.F("offset", msg.Offset),
+	}, fields...)
+}
@@ -0,0 +1,192 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+
+	"github.com/wangping886/mns_consumer/kafka"
+	"github.com/wangping886/mns_consumer/logger"
+	"github.com/wangping886/mns_consumer/mns.aliyun"
+)
+
+// fakeQueue 模拟 BatchSendMessage, 记录每次请求的消息,
+// 消息体包含 "invalid" 的消息返回 InvalidArgument, 包含 "busy" 的返回可以重试的 InternalError.
+type fakeQueue struct {
+	mu      sync.Mutex
+	batches [][]mns.MessageToSend
+}
+
+func (q *fakeQueue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		XMLName  struct{}            `xml:"Messages"`
+		Messages []mns.MessageToSend `xml:"Message"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q.mu.Lock()
+	q.batches = append(q.batches, req.Messages)
+	q.mu.Unlock()
+
+	var resp struct {
+		XMLName  struct{}                           `xml:"Messages"`
+		Messages []mns.BatchSendMessageResponseItem `xml:"Message"`
+	}
+	status := http.StatusCreated
+	for _, m := range req.Messages {
+		var item mns.BatchSendMessageResponseItem
+		switch {
+		case bytes.Contains(m.MessageBody, []byte("invalid")):
+			item.ErrorCode, item.ErrorMessage, status = "InvalidArgument", "invalid message", http.StatusInternalServerError
+		case bytes.Contains(m.MessageBody, []byte("busy")):
+			item.ErrorCode, item.ErrorMessage, status = "InternalError", "try again", http.StatusInternalServerError
+		default:
+			sum := md5.Sum(m.MessageBody)
+			item.MessageId = "id"
+			item.MessageBodyMD5 = strings.ToUpper(hex.EncodeToString(sum[:]))
+		}
+		resp.Messages = append(resp.Messages, item)
+	}
+	b, _ := xml.Marshal(resp)
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+func (q *fakeQueue) sent() [][]mns.MessageToSend {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([][]mns.MessageToSend(nil), q.batches...)
+}
+
+func newTestKafkaToQueue(t *testing.T, options ...option) (*KafkaToMNS, *fakeQueue) {
+	q := &fakeQueue{}
+	srv := httptest.NewServer(q)
+	t.Cleanup(srv.Close)
+	clt := &mns.QueueClient{QueueURL: srv.URL + "/queues/test"}
+	options = append([]option{WithLogger(logger.Nop), WithRetry(0, 10*time.Millisecond)}, options...)
+	return NewKafkaToQueue(nil, []string{"orders"}, clt, options...), q
+}
+
+func consumerMessage(offset int64, value string) *sarama.ConsumerMessage {
+	return &sarama.ConsumerMessage{Topic: "orders", Partition: 0, Offset: offset, Value: []byte(value)}
+}
+
+func TestKafkaToMNSSplitsBatchBySize(t *testing.T) {
+	b, q := newTestKafkaToQueue(t)
+
+	// 每条约 30KB, 两条一批不超过 64KB, 三条就超过了
+	value := strings.Repeat("x", 30<<10)
+	var batch []*sarama.ConsumerMessage
+	for i := 0; i < 5; i++ {
+		batch = append(batch, consumerMessage(int64(i), value))
+	}
+	if err := b.forward(context.Background(), batch); err != nil {
+		t.Fatalf("forward: %v", err)
+	}
+
+	sent := q.sent()
+	if len(sent) != 3 {
+		t.Fatalf("BatchSendMessage calls = %d, want 3", len(sent))
+	}
+	total := 0
+	for i, msgs := range sent {
+		size := 0
+		for _, m := range msgs {
+			size += len(m.MessageBody)
+		}
+		if size > maxMessageSize {
+			t.Errorf("batch %d is %d bytes, over the %d limit", i, size, maxMessageSize)
+		}
+		total += len(msgs)
+	}
+	if total != len(batch) {
+		t.Fatalf("messages sent = %d, want %d", total, len(batch))
+	}
+}
+
+func TestKafkaToMNSPermanentErrors(t *testing.T) {
+	tooLarge := strings.Repeat("x", maxMessageSize+1)
+
+	t.Run("skipped without dead letter topic", func(t *testing.T) {
+		b, q := newTestKafkaToQueue(t)
+		batch := []*sarama.ConsumerMessage{
+			consumerMessage(0, "ok"),
+			consumerMessage(1, tooLarge),
+			consumerMessage(2, "invalid"),
+		}
+		done := make(chan error, 1)
+		go func() { done <- b.forward(context.Background(), batch) }()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("forward: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("forward retried a permanently failing message")
+		}
+		// 超过大小的消息不会发送, InvalidArgument 的消息不重试
+		if sent := q.sent(); len(sent) != 1 || len(sent[0]) != 2 {
+			t.Fatalf("sent batches = %d, want one batch of 2 messages", len(sent))
+		}
+	})
+
+	t.Run("dead lettered", func(t *testing.T) {
+		mp := mocks.NewAsyncProducer(t, kafka.NewProducerConfig())
+		producer := kafka.NewProducerFromAsync(mp, kafka.WithProducerLogger(logger.Nop))
+		defer producer.Close()
+		var dead []string
+		var mu sync.Mutex
+		for i := 0; i < 2; i++ {
+			mp.ExpectInputWithCheckerFunctionAndSucceed(func(val []byte) error {
+				mu.Lock()
+				dead = append(dead, string(val))
+				mu.Unlock()
+				return nil
+			})
+		}
+
+		b, q := newTestKafkaToQueue(t, WithDeadLetterTopic(producer, "orders.dlq"))
+		batch := []*sarama.ConsumerMessage{
+			consumerMessage(0, tooLarge),
+			consumerMessage(1, "ok"),
+			consumerMessage(2, "invalid"),
+		}
+		if err := b.forward(context.Background(), batch); err != nil {
+			t.Fatalf("forward: %v", err)
+		}
+		if sent := q.sent(); len(sent) != 1 || len(sent[0]) != 2 {
+			t.Fatalf("sent batches = %v, want one batch of 2 messages", len(sent))
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		// 死信消息的 value 和原始消息一致
+		if len(dead) != 2 || dead[0] != tooLarge || dead[1] != "invalid" {
+			t.Fatalf("dead lettered %d messages, want the too large and the invalid one", len(dead))
+		}
+	})
+
+	t.Run("retriable errors are retried", func(t *testing.T) {
+		b, q := newTestKafkaToQueue(t)
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		if err := b.forward(ctx, []*sarama.ConsumerMessage{consumerMessage(0, "busy")}); err != errRevoked {
+			t.Fatalf("forward = %v, want errRevoked after the partition is revoked", err)
+		}
+		if sent := q.sent(); len(sent) < 2 {
+			t.Fatalf("BatchSendMessage calls = %d, want retries", len(sent))
+		}
+	})
+}
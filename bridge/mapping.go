@@ -0,0 +1,65 @@
+// Package bridge 在 kafka topic 和 MNS 队列/主题之间转发消息, 两个方向都保证 at-least-once:
+// 只有下游确认收到之后才提交 kafka offset 或者删除 MNS 消息.
+//
+// MNS 消息没有 key 和 headers, 转发到 MNS 时把 kafka 的 key 和 headers 放进 tracing 的信封里,
+// 反方向转发时再还原出来, 所以消息可以在两边来回转发而不丢失 key, headers 和 trace 上下文.
+package bridge
+
+import (
+	"github.com/Shopify/sarama"
+
+	"github.com/wangping886/mns_consumer/mns.aliyun"
+	"github.com/wangping886/mns_consumer/source"
+	"github.com/wangping886/mns_consumer/tracing"
+)
+
+const (
+	// HeaderKey 是信封里保存 kafka 消息 key 的 header.
+	HeaderKey = source.HeaderKey
+	// HeaderTag 是和 MNS 主题消息 MessageTag 对应的 kafka header:
+	// 转发到 MNS 主题时用作 MessageTag, 从主题订阅的队列转发到 kafka 时写入 MessageTag.
+	HeaderTag = "mns-tag"
+	// HeaderMessageId 是从 MNS 转发到 kafka 的消息的 MNS MessageId.
+	HeaderMessageId = "mns-message-id"
+)
+
+// toMNS 把 kafka 消息打包成 MNS 消息体: headers 和 key 放进信封, 返回消息体和 MessageTag.
+// 消息体本身已经是信封时(比如发送者用 tracing.Wrap 带上了 trace 上下文)合并两边的 headers.
+func toMNS(msg *sarama.ConsumerMessage) (body []byte, tag string) {
+	headers, value, _ := tracing.Open(msg.Value)
+	if headers == nil {
+		headers = make(map[string]string, len(msg.Headers)+1)
+	}
+	for _, h := range msg.Headers {
+		headers[string(h.Key)] = string(h.Value)
+	}
+	if msg.Key != nil {
+		headers[HeaderKey] = string(msg.Key)
+	}
+	tag = headers[HeaderTag]
+	delete(headers, HeaderTag)
+	return tracing.Seal(headers, value), tag
+}
+
+// toSource 把 MNS 消息还原成发送到 kafka 的 source.Message, headers 是信封里的 headers,
+// n 是主题推送的 Notification(可以为 nil). key 由 kafka.Producer 的 KeyFunc 提取, 默认是信封里的 HeaderKey.
+func toSource(msg mns.Message, headers map[string]string, n *mns.Notification) *source.Message {
+	m := &source.Message{
+		ID:      msg.MessageId,
+		Body:    msg.MessageBody,
+		Headers: make(map[string]string, len(headers)+2),
+	}
+	for k, v := range headers {
+		if k == HeaderKey {
+			m.Key = []byte(v)
+		}
+		m.Headers[k] = v
+	}
+	if n != nil && n.MessageTag != "" {
+		m.Headers[HeaderTag] = n.MessageTag
+	}
+	if msg.MessageId != "" {
+		m.Headers[HeaderMessageId] = msg.MessageId
+	}
+	return m
+}
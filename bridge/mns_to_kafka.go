@@ -0,0 +1,37 @@
+package bridge
+
+import (
+	"context"
+
+	"github.com/wangping886/mns_consumer/consumer"
+	"github.com/wangping886/mns_consumer/kafka"
+	"github.com/wangping886/mns_consumer/mns.aliyun"
+)
+
+// MNSToKafka 把 MNS 队列的消息转发到 kafka topic, Handle 是 consumer.HandlerFunc:
+// kafka 确认写入后 consumer 才删除消息, 写入失败的消息等可见时间过后重新投递,
+// 超过最大投递次数由 consumer.WithDeadLetterQueue 转移到死信队列.
+//
+//	b := bridge.NewMNSToKafka(producer, "topic")
+//	c := consumer.NewConsumerFunc("queue", b.Handle, consumer.WithDeadLetterQueue(dlq, 5))
+//
+// 转发主题订阅到队列的消息时使用 consumer.WithNotification, MessageTag 会写入 HeaderTag.
+// 消息通过 kafka.Producer 异步批量写入, consumer 并发处理的消息会被合并到同一批;
+// key 默认是信封里的 HeaderKey, 可以用 kafka.WithKeyFunc 从消息体或者 headers 提取.
+type MNSToKafka struct {
+	producer *kafka.Producer
+	topic    string
+}
+
+func NewMNSToKafka(producer *kafka.Producer, topic string) *MNSToKafka {
+	return &MNSToKafka{
+		producer: producer,
+		topic:    topic,
+	}
+}
+
+func (b *MNSToKafka) Handle(ctx context.Context, msg mns.Message) error {
+	headers, _ := consumer.HeadersFromContext(ctx)
+	n, _ := consumer.NotificationFromContext(ctx)
+	return b.producer.ProduceSync(ctx, b.topic, toSource(msg, headers, n))
+}
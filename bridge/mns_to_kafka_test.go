@@ -0,0 +1,75 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama/mocks"
+
+	"github.com/wangping886/mns_consumer/consumer"
+	"github.com/wangping886/mns_consumer/internal/mnsfake"
+	"github.com/wangping886/mns_consumer/kafka"
+	"github.com/wangping886/mns_consumer/logger"
+	"github.com/wangping886/mns_consumer/mns.aliyun"
+)
+
+func TestMNSToKafkaDeletesAfterProduce(t *testing.T) {
+	fake := mnsfake.NewServer(200 * time.Millisecond)
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	clt := &mns.QueueClient{QueueURL: srv.URL + "/queues/orders"}
+	if _, _, err := clt.SendMessage2(&mns.MessageToSend{MessageBody: []byte("hello")}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	mp := mocks.NewAsyncProducer(t, kafka.NewProducerConfig())
+	producer := kafka.NewProducerFromAsync(mp, kafka.WithProducerLogger(logger.Nop))
+	defer producer.Close()
+	mp.ExpectInputAndFail(errors.New("broker unavailable"))
+	mp.ExpectInputWithCheckerFunctionAndSucceed(func(val []byte) error {
+		if string(val) != "hello" {
+			t.Errorf("value = %q, want hello", val)
+		}
+		return nil
+	})
+
+	b := NewMNSToKafka(producer, "orders")
+	results := make(chan error, 2)
+	c := consumer.NewConsumerFunc("orders", func(ctx context.Context, msg mns.Message) error {
+		err := b.Handle(ctx, msg)
+		results <- err
+		return err
+	}, consumer.WithQueueClient(clt), consumer.WithLimitSize(1), consumer.WithTimeoutRetry(1), consumer.WithLogger(logger.Nop))
+	c.Start()
+	defer c.Stop()
+
+	if err := <-results; err == nil {
+		t.Fatal("first ProduceSync: want error")
+	}
+	if n := fake.Calls("DeleteMessage"); n != 0 {
+		t.Fatalf("DeleteMessage calls after a failed produce = %d, want 0", n)
+	}
+	if n := fake.Len("orders"); n != 1 {
+		t.Fatalf("queue length after a failed produce = %d, want 1", n)
+	}
+
+	// 可见时间过后重新投递, 这次写入成功
+	select {
+	case err := <-results:
+		if err != nil {
+			t.Fatalf("second ProduceSync: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not redelivered")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for fake.Len("orders") != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("message not deleted after a successful produce")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/wangping886/mns_consumer/kafka"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+var (
+	broker        = flag.String("broker", "kafka.bj.baidubce.com:9091", "The broker address can be found in https://cloud.baidu.com/doc/Kafka/QuickGuide.html")
+	topic         = flag.String("topic", "", "Required, the topic to consume from.  You can create a topic from console.")
+	enableTLS     = flag.Bool("enableTLS", true, "TLS is  to access Baidu Kafka service.")
+	clientPemPath = flag.String("client_pem", "client.pem", "File path to client.pem provided in kafka-key.zip from console.")
+	clientKeyPath = flag.String("client_key", "client.key", "File path to client.key provided in kafka-key.zip from console.")
+	caPemPath     = flag.String("ca_pem", "ca.pem", "File path to ca.pem provided in kafka-key.zip from console.")
+	serverName    = flag.String("server_name", "", "Server name to verify the broker certificate against, defaults to the broker host.")
+	saslMechanism = flag.String("sasl_mechanism", "", "SASL mechanism: PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512. Username and password are read from KAFKA_USERNAME and KAFKA_PASSWORD.")
+	offsetFile    = flag.String("offset_file", "offsets.json", "File to persist the next offset of each partition, consuming resumes from it after restart.")
+	start         = flag.String("start", "", "Where to start when no offset is persisted: oldest, newest, timestamp or offset. When set explicitly, the persisted offset is ignored.")
+	startTime     = flag.String("start_time", "", "RFC3339 time to start from, used with -start=timestamp.")
+	startOffset   = flag.Int64("start_offset", 0, "Offset to start from, used with -start=offset.")
+	saveInterval  = flag.Duration("save_interval", time.Second, "Interval to persist processed offsets.")
+)
+
+func main() {
+	if len(os.Args[1:]) == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	flag.Parse()
+
+	if *topic == "" {
+		panic("Argument topic is required.")
+	}
+
+	sarama.Logger = log.New(os.Stderr, "[sarama]", log.LstdFlags)
+
+	config := sarama.NewConfig()
+	config.Version = sarama.V0_10_1_0
+	if err := security().Apply(config); err != nil {
+		log.Fatalln(err)
+	}
+
+	store, err := kafka.NewFileOffsetStore(*offsetFile)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	client, err := sarama.NewClient([]string{*broker}, config)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer client.Close()
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	defer func() {
+		if err := consumer.Close(); err != nil {
+			log.Panic(err)
+		}
+	}()
+
+	partitions, err := consumer.Partitions(*topic)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(partitions))
+	//目前消费者没有负载均衡到patition
+	for _, partition := range partitions {
+		log.Println("consume partition:", partition)
+
+		shutdown := make(chan os.Signal, 1)
+		signal.Notify(shutdown, os.Interrupt)
+
+		go func(partition int32) {
+			offset, persisted, err := startingOffset(client, store, partition)
+			if err != nil {
+				log.Fatalln(err)
+				return
+			}
+			partitionConsumer, err := consumer.ConsumePartition(*topic, partition, offset)
+			if err == sarama.ErrOffsetOutOfRange {
+				if !persisted {
+					// 显式指定的 -start_offset 不存在, 不能悄悄换成别的位置
+					log.Fatalln("-start_offset", offset, "out of range for partition", partition)
+					return
+				}
+				// 保存的 offset 对应的消息已经过期删除
+				log.Println("offset", offset, "out of range, consume partition", partition, "from oldest")
+				partitionConsumer, err = consumer.ConsumePartition(*topic, partition, sarama.OffsetOldest)
+			}
+			if err != nil {
+				log.Fatalln(err)
+				return
+			}
+
+			// next 是下一条要消费的 offset, 按 saveInterval 保存, 退出前再保存一次
+			next, saved := int64(-1), int64(-1)
+			save := func() {
+				if next < 0 || next == saved {
+					return
+				}
+				if err := store.Save(*topic, partition, next); err != nil {
+					log.Println("save offset failed:", err)
+					return
+				}
+				saved = next
+			}
+			tick := time.NewTicker(*saveInterval)
+
+			defer func() {
+				wg.Done()
+				tick.Stop()
+				save()
+				if err := partitionConsumer.Close(); err != nil {
+					log.Fatalln(err)
+				}
+			}()
+
+		ConsumerLoop:
+			for {
+				select {
+				case err := <-partitionConsumer.Errors():
+					if err != nil {
+						log.Fatalln("error:", err)
+					}
+				case msg := <-partitionConsumer.Messages():
+					//消息处理可以加上重试，失败记log
+					//todo flush?
+					if msg != nil {
+						log.Println("topic:", msg.Topic, "partition:", msg.Partition, "offset:", msg.Offset, "message:", string(msg.Value))
+						next = msg.Offset + 1
+					}
+				case <-tick.C:
+					save()
+				case <-shutdown:
+					log.Println("stop consuming partition:", partition)
+					break ConsumerLoop
+				}
+			}
+		}(partition)
+	}
+
+	wg.Wait()
+}
+
+// startingOffset 决定 partition 从哪里开始消费: 没有显式指定 -start 时优先使用保存的 offset,
+// 都没有时从最新的消息开始. persisted 表示 offset 是不是来自保存的进度.
+func startingOffset(client sarama.Client, store kafka.OffsetStore, partition int32) (offset int64, persisted bool, err error) {
+	if *start == "" {
+		offset, ok, err := store.Load(*topic, partition)
+		if err != nil || ok {
+			return offset, ok, err
+		}
+	}
+
+	switch *start {
+	case "", "newest":
+		return sarama.OffsetNewest, false, nil
+	case "oldest":
+		return sarama.OffsetOldest, false, nil
+	case "offset":
+		return *startOffset, false, nil
+	case "timestamp":
+		t, err := time.Parse(time.RFC3339, *startTime)
+		if err != nil {
+			return 0, false, err
+		}
+		// 返回时间戳不早于 t 的第一条消息的 offset, 没有这样的消息时返回 OffsetNewest
+		offset, err = client.GetOffset(*topic, partition, t.UnixNano()/int64(time.Millisecond))
+		return offset, false, err
+	default:
+		return 0, false, fmt.Errorf("unknown -start %q, want oldest, newest, timestamp or offset", *start)
+	}
+}
+
+// security 读取 KAFKA_ 开头的环境变量, 再用命令行参数覆盖.
+func security() *kafka.Security {
+	sec, err := kafka.SecurityFromEnv("KAFKA_")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if *enableTLS {
+		sec.TLS = true
+		sec.CAFile = *caPemPath
+		sec.CertFile = *clientPemPath
+		sec.KeyFile = *clientKeyPath
+	}
+	if *serverName != "" {
+		sec.ServerName = *serverName
+	}
+	if *saslMechanism != "" {
+		sec.SASLMechanism = *saslMechanism
+	}
+	return sec
+}
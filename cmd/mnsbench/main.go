@@ -0,0 +1,195 @@
+// mnsbench 用 BatchSendMessage2 按目标速率向队列写入消息, 同时用 consumer.Consumer 消费,
+// 最后输出吞吐, 端到端延迟分位数(基于 EnqueueTime), 重复投递和 api 错误数.
+//
+// 连接真实的 MNS:
+//
+//	mnsbench -endpoint http://$AccountId.mns.cn-hangzhou.aliyuncs.com -queue bench -rate 500 -limit 20 -chan 32
+//
+// 使用进程内的 fake 服务:
+//
+//	mnsbench -fake -rate 2000 -duration 30s -limit 50 -chan 64
+//
+// 注意 EnqueueTime 是服务端时间, 连接真实 MNS 时延迟包含本机和服务端的时钟偏差.
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/wangping886/mns_consumer/consumer"
+	"github.com/wangping886/mns_consumer/internal/mnsfake"
+	"github.com/wangping886/mns_consumer/mns.aliyun"
+)
+
+var (
+	endpoint       = flag.String("endpoint", os.Getenv("MNS_ENDPOINT"), "MNS endpoint, e.g. http://$AccountId.mns.cn-hangzhou.aliyuncs.com")
+	accessKeyId    = flag.String("ak", os.Getenv("MNS_ACCESS_KEY_ID"), "AccessKeyId")
+	accessKey      = flag.String("sk", os.Getenv("MNS_ACCESS_KEY_SECRET"), "AccessKeySecret")
+	queueName      = flag.String("queue", "mnsbench", "queue name")
+	fake           = flag.Bool("fake", false, "start an in-process fake MNS and ignore -endpoint")
+	fakeVisibility = flag.Duration("fake_visibility", 30*time.Second, "visibility timeout of the fake MNS")
+
+	rate     = flag.Int("rate", 100, "target messages per second to produce")
+	batch    = flag.Int("batch", 16, "messages per BatchSendMessage2 call, 1-16")
+	size     = flag.Int("size", 256, "message body size in bytes")
+	duration = flag.Duration("duration", 10*time.Second, "how long to produce")
+	drain    = flag.Duration("drain", 30*time.Second, "how long to wait for consumers to catch up after producing")
+
+	limitSize = flag.Int("limit", 20, "consumer.WithLimitSize")
+	chanSize  = flag.Int("chan", 32, "consumer.WithChanSize")
+	retry     = flag.Int("retry", 5, "consumer.WithTimeoutRetry")
+	work      = flag.Duration("work", 0, "simulated handler processing time")
+	verbose   = flag.Bool("v", false, "keep the consumer's log output")
+)
+
+func main() {
+	flag.Parse()
+
+	if *batch < 1 || *batch > 16 {
+		log.Fatalln("-batch must be in [1, 16]")
+	}
+	if *rate < 1 {
+		log.Fatalln("-rate must be positive")
+	}
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	if *fake {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		go http.Serve(ln, mnsfake.NewServer(*fakeVisibility))
+		*endpoint = "http://" + ln.Addr().String()
+	}
+	if *endpoint == "" {
+		fmt.Fprintln(os.Stderr, "-endpoint or -fake is required")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	st := newStats()
+	queueURL := *endpoint + "/queues/" + *queueName
+	producer := &mns.QueueClient{
+		QueueURL:        queueURL,
+		AccessKeyId:     *accessKeyId,
+		AccessKeySecret: *accessKey,
+		HttpClient:      newHttpClient(st, 5*time.Second),
+	}
+	client := &mns.QueueClient{
+		QueueURL:        queueURL,
+		AccessKeyId:     *accessKeyId,
+		AccessKeySecret: *accessKey,
+		HttpClient:      newHttpClient(st, 25*time.Second),
+	}
+
+	c := consumer.NewConsumer(*queueName, handler(st),
+		consumer.WithQueueClient(client),
+		consumer.WithLimitSize(*limitSize),
+		consumer.WithChanSize(*chanSize),
+		consumer.WithTimeoutRetry(*retry),
+	)
+	c.Start()
+
+	begin := time.Now()
+	produce(producer, st)
+	produceElapsed := time.Since(begin)
+
+	deadline := time.Now().Add(*drain)
+	for st.uniqueReceived() < st.sentCount() && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.Stop()
+
+	fmt.Printf("limit=%d chan=%d rate=%d batch=%d size=%d work=%s\n", *limitSize, *chanSize, *rate, *batch, *size, *work)
+	st.report(os.Stdout, produceElapsed)
+}
+
+func newHttpClient(st *stats, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: &countingTransport{
+			base: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				MaxIdleConns:        100,
+				MaxIdleConnsPerHost: 100,
+				IdleConnTimeout:     90 * time.Second,
+			},
+			stats: st,
+		},
+		Timeout: timeout,
+	}
+}
+
+// produce 以 *rate 的速率发送消息, 持续 *duration.
+// 消息体以 "序号 " 开头, 消费端用序号识别重复投递.
+func produce(clt *mns.QueueClient, st *stats) {
+	interval := time.Duration(int64(time.Second) * int64(*batch) / int64(*rate))
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	padding := bytes.Repeat([]byte("x"), *size)
+	end := time.Now().Add(*duration)
+	seq := 0
+	for now := range tick.C {
+		if now.After(end) {
+			return
+		}
+
+		msgs := make([]mns.MessageToSend, *batch)
+		for i := range msgs {
+			seq++
+			body := strconv.AppendInt(nil, int64(seq), 10)
+			body = append(body, ' ')
+			if n := *size - len(body); n > 0 {
+				body = append(body, padding[:n]...)
+			}
+			msgs[i].MessageBody = body
+		}
+
+		_, resp, err := clt.BatchSendMessage2(msgs, false)
+		if err != nil {
+			st.addSent(0, len(msgs))
+			continue
+		}
+		ok := 0
+		for i := range resp {
+			if resp[i].ErrorCode != "" {
+				st.addApiError("Send", resp[i].ErrorCode)
+				continue
+			}
+			ok++
+		}
+		st.addSent(ok, len(msgs)-ok)
+	}
+}
+
+func handler(st *stats) consumer.Handler {
+	return func(c *consumer.Consumer, msg mns.Message) {
+		defer func() {
+			<-c.LimitChan
+		}()
+
+		now := time.Now()
+		key := msg.MessageBody
+		if i := bytes.IndexByte(key, ' '); i >= 0 {
+			key = key[:i]
+		}
+		st.addReceived(string(key), msg.EnqueueTime, now)
+
+		if *work > 0 {
+			time.Sleep(*work)
+		}
+		c.Delete(context.Background(), msg)
+	}
+}
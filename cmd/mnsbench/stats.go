@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wangping886/mns_consumer/mns.aliyun"
+)
+
+// stats 汇总一次压测的结果, 所有方法都是并发安全的.
+type stats struct {
+	mu         sync.Mutex
+	sent       int
+	sendFailed int
+	received   int
+	duplicates int
+	seen       map[string]struct{}
+	latencies  []time.Duration
+	apiErrors  map[string]int // "operation code" -> count
+	emptyPolls int
+	firstRecv  time.Time
+	lastRecv   time.Time
+}
+
+func newStats() *stats {
+	return &stats{
+		seen:      make(map[string]struct{}),
+		apiErrors: make(map[string]int),
+	}
+}
+
+func (s *stats) addSent(ok, failed int) {
+	s.mu.Lock()
+	s.sent += ok
+	s.sendFailed += failed
+	s.mu.Unlock()
+}
+
+// addReceived 记录一条被 handler 处理的消息, key 是压测生成的消息序号,
+// 同一个 key 第二次出现即为重复投递, 重复投递不计入延迟统计.
+func (s *stats) addReceived(key string, enqueueTime int64, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.firstRecv.IsZero() {
+		s.firstRecv = now
+	}
+	s.lastRecv = now
+
+	if _, ok := s.seen[key]; ok {
+		s.duplicates++
+		return
+	}
+	s.seen[key] = struct{}{}
+	s.received++
+	s.latencies = append(s.latencies, now.Sub(time.Unix(0, enqueueTime*int64(time.Millisecond))))
+}
+
+func (s *stats) addApiError(operation, code string) {
+	s.mu.Lock()
+	s.apiErrors[operation+" "+code]++
+	s.mu.Unlock()
+}
+
+func (s *stats) addEmptyPoll() {
+	s.mu.Lock()
+	s.emptyPolls++
+	s.mu.Unlock()
+}
+
+func (s *stats) uniqueReceived() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.received
+}
+
+func (s *stats) sentCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sent
+}
+
+func (s *stats) report(w io.Writer, produceElapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fmt.Fprintf(w, "sent:          %d (failed %d) in %s, %.1f msg/s\n", s.sent, s.sendFailed, produceElapsed, float64(s.sent)/produceElapsed.Seconds())
+	consumeElapsed := s.lastRecv.Sub(s.firstRecv)
+	if consumeElapsed > 0 {
+		fmt.Fprintf(w, "received:      %d in %s, %.1f msg/s\n", s.received, consumeElapsed, float64(s.received)/consumeElapsed.Seconds())
+	} else {
+		fmt.Fprintf(w, "received:      %d\n", s.received)
+	}
+	fmt.Fprintf(w, "unconsumed:    %d\n", s.sent-s.received)
+	fmt.Fprintf(w, "duplicates:    %d\n", s.duplicates)
+	fmt.Fprintf(w, "empty polls:   %d\n", s.emptyPolls)
+
+	if len(s.latencies) > 0 {
+		sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+		fmt.Fprintf(w, "latency:       p50=%s p90=%s p99=%s max=%s\n",
+			percentile(s.latencies, 0.50), percentile(s.latencies, 0.90), percentile(s.latencies, 0.99), s.latencies[len(s.latencies)-1])
+	}
+
+	if len(s.apiErrors) == 0 {
+		fmt.Fprintln(w, "api errors:    0")
+		return
+	}
+	keys := make([]string, 0, len(s.apiErrors))
+	for k := range s.apiErrors {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Fprintln(w, "api errors:")
+	for _, k := range keys {
+		fmt.Fprintf(w, "  %-40s %d\n", k, s.apiErrors[k])
+	}
+}
+
+// percentile 要求 sorted 已经升序排列并且非空.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(float64(len(sorted))*p+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// countingTransport 统计经过它的 MNS api 调用错误, 按操作和 ApiError.Code 分类.
+// 接收消息时队列为空返回的 MessageNotExist 单独记为 empty poll.
+type countingTransport struct {
+	base  http.RoundTripper
+	stats *stats
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	operation := apiOperation(req)
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		if req.Context().Err() == nil {
+			t.stats.addApiError(operation, "TransportError")
+		}
+		return resp, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.stats.addApiError(operation, "TransportError")
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var apiErr mns.ApiError
+	if xml.Unmarshal(body, &apiErr) != nil || apiErr.Code == "" {
+		apiErr.Code = http.StatusText(resp.StatusCode)
+	}
+	if operation == "Receive" && apiErr.Code == "MessageNotExist" {
+		t.stats.addEmptyPoll()
+		return resp, nil
+	}
+	t.stats.addApiError(operation, apiErr.Code)
+	return resp, nil
+}
+
+func apiOperation(req *http.Request) string {
+	switch req.Method {
+	case http.MethodPost:
+		return "Send"
+	case http.MethodGet:
+		if strings.Contains(req.URL.RawQuery, "peekonly") {
+			return "Peek"
+		}
+		return "Receive"
+	case http.MethodDelete:
+		return "Delete"
+	case http.MethodPut:
+		return "ChangeVisibility"
+	default:
+		return req.Method
+	}
+}
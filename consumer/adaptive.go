@@ -0,0 +1,225 @@
+package consumer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/wangping886/mns_consumer/logger"
+)
+
+const (
+	defaultAdaptiveInterval     = time.Second
+	defaultAdaptiveBackoff      = 0.75
+	defaultAdaptiveMaxErrorRate = 0.1
+)
+
+// AdaptiveLimit 是自适应并发数的配置, 按 AIMD 调整: 每个 Interval 统计一次 handler 的平均处理时间和错误率,
+// 超过阈值时并发数乘以 Backoff, 否则在并发数用满的情况下加 1, 始终保持在 [Min, Max] 之间.
+type AdaptiveLimit struct {
+	Min           int           // 最小并发数, 默认 1
+	Max           int           // 最大并发数, 必须设置
+	TargetLatency time.Duration // 平均处理时间超过它时减小并发数, 为 0 时使用观察到的基准处理时间的 2 倍
+	MaxErrorRate  float64       // 错误率超过它时减小并发数, 默认 0.1
+	Interval      time.Duration // 调整间隔, 默认 1 秒
+	Backoff       float64       // 减小时乘以的系数, 默认 0.75
+}
+
+// WithAdaptiveLimit 打开自适应并发数, WithLimitSize 的值作为初始并发数(默认是 Min).
+// 当前的并发数见 Consumer.Concurrency 和 Health.Concurrency.
+// 只能用于 NewConsumerFunc 和 NewConsumerBatch: Handler 自己释放 LimitChan, 它的返回时间和结果不反映消息的处理情况.
+func WithAdaptiveLimit(cfg AdaptiveLimit) option {
+	return func(c *Consumer) {
+		if cfg.Min < 1 {
+			cfg.Min = 1
+		}
+		if cfg.Max < cfg.Min {
+			cfg.Max = cfg.Min
+		}
+		if cfg.MaxErrorRate <= 0 {
+			cfg.MaxErrorRate = defaultAdaptiveMaxErrorRate
+		}
+		if cfg.Interval <= 0 {
+			cfg.Interval = defaultAdaptiveInterval
+		}
+		if cfg.Backoff <= 0 || cfg.Backoff >= 1 {
+			cfg.Backoff = defaultAdaptiveBackoff
+		}
+		c.adaptive = &adaptiveLimiter{cfg: cfg}
+	}
+}
+
+// adaptiveLimiter 通过在 LimitChan(容量为 Max)里占住 Max-limit 个位置来限制并发数,
+// 获取和释放 LimitChan 的代码不需要任何修改.
+type adaptiveLimiter struct {
+	cfg AdaptiveLimit
+	c   *Consumer
+
+	mu        sync.Mutex
+	limit     int
+	reserved  int  // 已经在 LimitChan 里占住的位置
+	owed      int  // 还需要占住的位置, 等 handler 释放
+	shrinking bool // 是否有 goroutine 正在等待占住位置
+
+	// 当前统计窗口
+	count    int
+	errors   int
+	total    time.Duration
+	peak     int           // 窗口内同时执行的 handler 数的最大值
+	baseline time.Duration // 基准处理时间, 取平均处理时间的最小值并缓慢跟随变化
+}
+
+// init 在 NewConsumer 中调用, 此时 LimitChan 是空的.
+func (a *adaptiveLimiter) init(c *Consumer) {
+	a.c = c
+	a.limit = c.limitSize
+	if a.limit < a.cfg.Min {
+		a.limit = a.cfg.Min
+	}
+	if a.limit > a.cfg.Max {
+		a.limit = a.cfg.Max
+	}
+	for a.reserved < a.cfg.Max-a.limit {
+		c.LimitChan <- true
+		a.reserved++
+	}
+}
+
+func (a *adaptiveLimiter) concurrency() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.limit
+}
+
+// observe 记录一次 handler 的执行结果.
+func (a *adaptiveLimiter) observe(d time.Duration, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.count++
+	a.total += d
+	if err != nil {
+		a.errors++
+	}
+	// 刚结束的 handler 还没有从 inFlight 中减去, 也算在内
+	a.c.health.mu.Lock()
+	if a.c.health.inFlight > a.peak {
+		a.peak = a.c.health.inFlight
+	}
+	a.c.health.mu.Unlock()
+}
+
+func (a *adaptiveLimiter) run() {
+	tick := time.NewTicker(a.cfg.Interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			a.adjust()
+		case <-a.c.t.Dying():
+			return
+		}
+	}
+}
+
+func (a *adaptiveLimiter) adjust() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.count == 0 {
+		return
+	}
+	avg := a.total / time.Duration(a.count)
+	errRate := float64(a.errors) / float64(a.count)
+	if a.baseline == 0 || avg < a.baseline {
+		a.baseline = avg
+	} else {
+		a.baseline += (avg - a.baseline) / 10
+	}
+	target := a.cfg.TargetLatency
+	if target <= 0 {
+		target = 2 * a.baseline
+	}
+
+	limit := a.limit
+	switch {
+	case errRate > a.cfg.MaxErrorRate || avg > target:
+		limit = int(float64(limit) * a.cfg.Backoff)
+		if limit < a.cfg.Min {
+			limit = a.cfg.Min
+		}
+	case a.peak >= a.limit && limit < a.cfg.Max:
+		limit++
+	}
+	if limit != a.limit {
+		a.c.logger.Debug("concurrency adjusted", logger.F("queue", a.c.queName), logger.F("from", a.limit), logger.F("to", limit),
+			logger.F("avg_latency", avg.String()), logger.F("error_rate", errRate))
+		a.setLimit(limit)
+	}
+
+	a.count, a.errors, a.total, a.peak = 0, 0, 0, 0
+}
+
+// setLimit 调整占住的位置数, 需要持有 mu.
+func (a *adaptiveLimiter) setLimit(limit int) {
+	for ; a.limit < limit; a.limit++ {
+		if a.owed > 0 {
+			a.owed--
+			continue
+		}
+		<-a.c.LimitChan
+		a.reserved--
+	}
+	for ; a.limit > limit; a.limit-- {
+		select {
+		case a.c.LimitChan <- true:
+			a.reserved++
+		default:
+			a.owed++
+		}
+	}
+	if a.owed > 0 && !a.shrinking {
+		a.shrinking = true
+		go a.shrink()
+	}
+}
+
+// shrink 等待 handler 释放位置, 占住 owed 个位置之后退出.
+func (a *adaptiveLimiter) shrink() {
+	for {
+		a.mu.Lock()
+		if a.owed == 0 {
+			a.shrinking = false
+			a.mu.Unlock()
+			return
+		}
+		a.mu.Unlock()
+
+		select {
+		case a.c.LimitChan <- true:
+		case <-a.c.t.Dying():
+			a.mu.Lock()
+			a.shrinking = false
+			a.mu.Unlock()
+			return
+		}
+
+		a.mu.Lock()
+		if a.owed > 0 {
+			a.owed--
+			a.reserved++
+		} else {
+			// 等待期间并发数又增加了, 不再需要这个位置
+			<-a.c.LimitChan
+		}
+		a.mu.Unlock()
+	}
+}
+
+// Concurrency 返回当前的并发数上限, 没有打开 WithAdaptiveLimit 时就是 WithLimitSize 的值.
+func (c *Consumer) Concurrency() int {
+	if c.adaptive == nil {
+		return c.limitSize
+	}
+	return c.adaptive.concurrency()
+}
@@ -0,0 +1,142 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/wangping886/mns_consumer/logger"
+	"github.com/wangping886/mns_consumer/mns.aliyun"
+)
+
+func newAdaptiveConsumer(t *testing.T, cfg AdaptiveLimit, options ...option) *Consumer {
+	_, clt := newFakeQueue(t, "adaptive", 30*time.Second)
+	options = append([]option{WithQueueClient(clt), WithLogger(logger.Nop), WithAdaptiveLimit(cfg)}, options...)
+	return NewConsumerFunc("adaptive", func(ctx context.Context, msg mns.Message) error { return nil }, options...)
+}
+
+// free 返回 LimitChan 里还能获取的位置数.
+func free(c *Consumer) int {
+	return cap(c.LimitChan) - len(c.LimitChan)
+}
+
+func TestAdaptiveInitReservesAboveLimit(t *testing.T) {
+	c := newAdaptiveConsumer(t, AdaptiveLimit{Min: 2, Max: 10}, WithLimitSize(4))
+	if got := c.Concurrency(); got != 4 {
+		t.Errorf("Concurrency() = %d, want the WithLimitSize value 4", got)
+	}
+	if cap(c.LimitChan) != 10 || free(c) != 4 {
+		t.Errorf("LimitChan cap %d free %d, want cap 10 free 4", cap(c.LimitChan), free(c))
+	}
+
+	c = newAdaptiveConsumer(t, AdaptiveLimit{Min: 2, Max: 10})
+	if got := c.Concurrency(); got != 2 {
+		t.Errorf("Concurrency() = %d, want Min 2 without WithLimitSize", got)
+	}
+}
+
+func TestAdaptiveSetLimit(t *testing.T) {
+	a := newAdaptiveConsumer(t, AdaptiveLimit{Min: 1, Max: 8}, WithLimitSize(4)).adaptive
+	c := a.c
+
+	a.mu.Lock()
+	a.setLimit(6)
+	a.mu.Unlock()
+	if free(c) != 6 || a.reserved != 2 {
+		t.Fatalf("after growing to 6: free %d reserved %d, want 6 and 2", free(c), a.reserved)
+	}
+
+	a.mu.Lock()
+	a.setLimit(3)
+	a.mu.Unlock()
+	if free(c) != 3 || a.reserved != 5 || a.owed != 0 {
+		t.Fatalf("after shrinking to 3: free %d reserved %d owed %d, want 3, 5 and 0", free(c), a.reserved, a.owed)
+	}
+}
+
+// TestAdaptiveShrinkWaitsForHandlers 检查并发数用满时缩小, 等 handler 释放位置之后再占住.
+func TestAdaptiveShrinkWaitsForHandlers(t *testing.T) {
+	a := newAdaptiveConsumer(t, AdaptiveLimit{Min: 1, Max: 4}, WithLimitSize(4)).adaptive
+	c := a.c
+	for i := 0; i < 4; i++ {
+		c.LimitChan <- true // 4 个正在执行的 handler
+	}
+
+	a.mu.Lock()
+	a.setLimit(2)
+	owed := a.owed
+	a.mu.Unlock()
+	if owed != 2 {
+		t.Fatalf("owed = %d, want 2 while all slots are in use", owed)
+	}
+
+	<-c.LimitChan // 一个 handler 结束, 位置被 shrink 占住
+	waitFor(t, "one slot reserved", func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return a.owed == 1 && a.reserved == 1
+	})
+
+	// 等待期间并发数恢复, 不再需要占住位置
+	a.mu.Lock()
+	a.setLimit(3)
+	a.mu.Unlock()
+	<-c.LimitChan
+	waitFor(t, "shrink done", func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return !a.shrinking
+	})
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.owed != 0 || a.reserved != 1 || free(c) != 1 {
+		t.Errorf("owed %d reserved %d free %d, want 0, 1 and 1 with 2 handlers running", a.owed, a.reserved, free(c))
+	}
+}
+
+func TestAdaptiveAdjust(t *testing.T) {
+	tests := []struct {
+		name   string
+		peak   int
+		errors int
+		want   int
+	}{
+		{name: "saturated increases by one", peak: 4, want: 5},
+		{name: "not saturated keeps the limit", peak: 2, want: 4},
+		{name: "errors back off", peak: 4, errors: 5, want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAdaptiveConsumer(t, AdaptiveLimit{Min: 1, Max: 8, TargetLatency: time.Second}, WithLimitSize(4)).adaptive
+
+			a.c.health.mu.Lock()
+			a.c.health.inFlight = tt.peak
+			a.c.health.mu.Unlock()
+			for i := 0; i < 10; i++ {
+				var err error
+				if i < tt.errors {
+					err = errors.New("failed")
+				}
+				a.observe(10*time.Millisecond, err)
+			}
+			a.adjust()
+
+			if got := a.concurrency(); got != tt.want {
+				t.Errorf("concurrency = %d, want %d", got, tt.want)
+			}
+			if free(a.c) != tt.want {
+				t.Errorf("LimitChan free %d, want %d", free(a.c), tt.want)
+			}
+		})
+	}
+}
+
+func TestAdaptiveAdjustSlowBacksOffToMin(t *testing.T) {
+	a := newAdaptiveConsumer(t, AdaptiveLimit{Min: 2, Max: 8, TargetLatency: 10 * time.Millisecond}, WithLimitSize(3)).adaptive
+	a.observe(time.Second, nil)
+	a.adjust()
+	if got := a.concurrency(); got != 2 {
+		t.Errorf("concurrency = %d, want Min 2 after a slow window", got)
+	}
+}
@@ -0,0 +1,258 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/wangping886/mns_consumer/logger"
+	"github.com/wangping886/mns_consumer/mns.aliyun"
+	"github.com/wangping886/mns_consumer/tracing"
+)
+
+const (
+	defaultBatchSize   = 16
+	defaultBatchLinger = time.Second
+)
+
+// BatchHandler 一次处理多条消息, 比如在一个数据库事务里写入, 返回和 msgs 一一对应的错误.
+// 返回 nil 的消息由 consumer 用 BatchDeleteMessage 删除, 失败的消息再逐条(每次只传一条)重试一次,
+// 仍然失败的消息不删除, 等可见时间过后由 MNS 重新投递.
+type BatchHandler func(ctx context.Context, msgs []mns.Message) []error
+
+// NewConsumerBatch 创建批量处理的 consumer, 每攒够 WithBatch 的条数或者等待时间到了就调用一次 handler.
+// 并发数(WithLimitSize, 默认 16)按消息条数计算, 小于批量条数时 panic.
+// WithNotification 解开的 Notification 通过 Consumer.Notification 获取, 信封的 headers 在批量模式下不可用.
+func NewConsumerBatch(queName string, handler BatchHandler, options ...option) *Consumer {
+	c := newConsumer(queName, append([]option{WithLimitSize(defaultBatchSize)}, options...))
+	c.batchHandler = handler
+	if c.batchSize <= 0 {
+		c.batchSize = defaultBatchSize
+	}
+	if c.batchLinger <= 0 {
+		c.batchLinger = defaultBatchLinger
+	}
+	c.mustValidate()
+	return c
+}
+
+// WithBatch 设置 BatchHandler 一次最多处理的消息数和凑批最长等待时间, 默认 16 条, 1 秒.
+func WithBatch(size int, linger time.Duration) option {
+	return func(c *Consumer) {
+		c.batchSize = size
+		c.batchLinger = linger
+	}
+}
+
+// startBatchWorker 把收到的消息攒成批交给 handleBatch.
+func (c *Consumer) startBatchWorker() {
+	go func() {
+		<-c.serveDone
+		close(c.queMsgChan)
+	}()
+
+	var (
+		batch  []queueMsg
+		linger <-chan time.Time
+	)
+	ctx, cancel := c.dyingContext()
+	defer cancel()
+
+	flush := func() {
+		if err := c.rateLimiter.Wait(ctx); err != nil {
+			// consumer 正在停止, 不再等待令牌, 这批消息等可见时间过后重新投递
+			c.logger.Info("serve canceled", logger.F("queue", c.queName), logger.F("messages", len(batch)), logger.Err(err))
+			for _, qm := range batch {
+				c.breakerSkipped(qm.probe)
+			}
+			c.release(len(batch))
+			batch = nil
+			linger = nil
+			return
+		}
+		msgs := batch
+		c.handlers.Wrap(func() { c.handleBatch(msgs) })
+		batch = nil
+		linger = nil
+	}
+	for {
+		select {
+		case msg, ok := <-c.queMsgChan:
+			if !ok {
+				if len(batch) > 0 {
+					flush()
+				}
+				c.logger.Info("worker done", logger.F("queue", c.queName))
+				return
+			}
+			batch = append(batch, msg)
+			if len(batch) == 1 {
+				linger = time.After(c.batchLinger)
+			}
+			if len(batch) >= c.batchSize {
+				flush()
+			}
+		case <-linger:
+			flush()
+		}
+	}
+}
+
+// handleBatch 处理一批消息, 结束时释放每条消息占用的并发额度.
+func (c *Consumer) handleBatch(batch []queueMsg) {
+	n := len(batch)
+	c.metrics.InFlight(c.queName, n)
+	id := c.health.handleStart(n)
+	defer func() {
+		c.metrics.InFlight(c.queName, -n)
+		c.health.handleDone(id, n)
+		c.release(n)
+	}()
+
+	var (
+		msgs       = make([]mns.Message, 0, n)
+		requestIds = make([]string, 0, n)
+		probe      bool
+	)
+	for _, qm := range batch {
+		msg := qm.mnsMsg
+		if msg.EnqueueTime > 0 {
+			c.metrics.MessageLag(c.queName, time.Since(time.Unix(0, msg.EnqueueTime*int64(time.Millisecond))))
+		}
+		if !qm.probe && !c.breakerAllow() {
+			c.logger.Debug("circuit open, message left invisible", c.msgFields(msg, qm.requestId)...)
+			continue
+		}
+		probe = probe || qm.probe
+		if c.deadLetter != nil && c.maxDequeueCount > 0 && msg.DequeueCount > c.maxDequeueCount {
+			c.moveToDeadLetter(msg, qm.requestId)
+			continue
+		}
+		if c.unwrapNotification {
+			var err error
+			if _, msg, err = c.unwrap(context.Background(), msg, qm.requestId); err != nil {
+				continue
+			}
+			defer c.forgetNotification(msg)
+		}
+		_, msg.MessageBody, _ = tracing.Open(msg.MessageBody)
+		msgs = append(msgs, msg)
+		requestIds = append(requestIds, qm.requestId)
+	}
+	if len(msgs) == 0 {
+		c.breakerSkipped(probe)
+		return
+	}
+
+	ctx, endSpan := c.tracer.StartSpan(context.Background(), "mns.consume_batch "+c.queName, nil)
+	errs := c.callBatch(ctx, msgs)
+
+	var (
+		succeeded []mns.Message
+		failed    []int
+		batchErr  error
+	)
+	for i, err := range errs {
+		if err == nil {
+			succeeded = append(succeeded, msgs[i])
+			continue
+		}
+		failed = append(failed, i)
+		if batchErr == nil {
+			batchErr = err
+		}
+	}
+	if len(succeeded) > 0 {
+		// 只要有消息处理成功, 就不算下游故障
+		c.breakerResult(probe, nil)
+	} else {
+		c.breakerResult(probe, batchErr)
+	}
+	endSpan(batchErr)
+	c.deleteBatch(ctx, succeeded)
+
+	// 失败的消息逐条重试一次, 本来就只有一条时不再重试
+	for _, i := range failed {
+		msg := msgs[i]
+		if len(msgs) == 1 {
+			c.logger.Warn("handle message failed", c.msgFields(msg, requestIds[i], logger.F("dequeue_count", msg.DequeueCount), logger.Err(errs[i]))...)
+			continue
+		}
+		c.logger.Warn("handle message in batch failed, retry alone", c.msgFields(msg, requestIds[i], logger.F("dequeue_count", msg.DequeueCount), logger.Err(errs[i]))...)
+		if err := c.callBatch(ctx, []mns.Message{msg})[0]; err != nil {
+			c.logger.Warn("handle message failed", c.msgFields(msg, requestIds[i], logger.F("dequeue_count", msg.DequeueCount), logger.Err(err))...)
+			continue
+		}
+		c.Delete(ctx, msg)
+	}
+}
+
+// callBatch 调用 BatchHandler 并上报每条消息的结果, 返回的错误数和消息数不一致时所有消息都算失败.
+func (c *Consumer) callBatch(ctx context.Context, msgs []mns.Message) []error {
+	begin := time.Now()
+	errs := c.batchHandler(ctx, msgs)
+	d := time.Since(begin)
+	if len(errs) != len(msgs) {
+		err := fmt.Errorf("batch handler returned %d errors for %d messages", len(errs), len(msgs))
+		errs = make([]error, len(msgs))
+		for i := range errs {
+			errs[i] = err
+		}
+	}
+	for _, err := range errs {
+		c.observe(d, err)
+	}
+	return errs
+}
+
+// deleteBatch 用 BatchDeleteMessage 删除消息, 每次最多 16 条.
+func (c *Consumer) deleteBatch(ctx context.Context, msgs []mns.Message) {
+	for len(msgs) > 0 {
+		n := len(msgs)
+		if n > 16 {
+			n = 16
+		}
+		c.deleteChunk(msgs[:n])
+		msgs = msgs[n:]
+	}
+}
+
+func (c *Consumer) deleteChunk(msgs []mns.Message) {
+	receiptHandles := make([]string, len(msgs))
+	byHandle := make(map[string]mns.Message, len(msgs))
+	for i, msg := range msgs {
+		receiptHandles[i] = msg.ReceiptHandle
+		byHandle[msg.ReceiptHandle] = msg
+	}
+
+	var (
+		requestId string
+		errItems  []mns.BatchDeleteMessageErrorItem
+		err       error
+	)
+	for i := 0; i < c.timeoutMaxRetry; i++ {
+		requestId, errItems, err = c.client.BatchDeleteMessage(receiptHandles)
+		if err == nil || !timeoutErr(err) {
+			break
+		}
+	}
+	if err != nil {
+		c.logger.Error("batch delete message failed", logger.F("queue", c.queName), logger.F("request_id", errRequestId(err, requestId)),
+			logger.F("count", len(msgs)), logger.Err(err))
+		return
+	}
+
+	for _, item := range errItems {
+		msg := byHandle[item.ReceiptHandle]
+		delete(byHandle, item.ReceiptHandle)
+		c.logger.Error("delete message failed", c.msgFields(msg, requestId,
+			logger.F("receipt_handle", item.ReceiptHandle),
+			logger.F("dequeue_count", msg.DequeueCount),
+			logger.F("error_code", item.ErrorCode),
+			logger.F("error_message", item.ErrorMessage))...)
+	}
+	for _, msg := range byHandle {
+		c.logger.Debug("message deleted", c.msgFields(msg, requestId)...)
+		c.metrics.MessageDeleted(c.queName)
+	}
+}
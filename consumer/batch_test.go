@@ -0,0 +1,125 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wangping886/mns_consumer/logger"
+	"github.com/wangping886/mns_consumer/mns.aliyun"
+)
+
+// batchCalls 记录每次调用 BatchHandler 传入的消息体.
+type batchCalls struct {
+	mu    sync.Mutex
+	calls [][]string
+}
+
+func (b *batchCalls) record(msgs []mns.Message) {
+	bodies := make([]string, len(msgs))
+	for i, msg := range msgs {
+		bodies[i] = string(msg.MessageBody)
+	}
+	b.mu.Lock()
+	b.calls = append(b.calls, bodies)
+	b.mu.Unlock()
+}
+
+func (b *batchCalls) get() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	calls := make([]string, len(b.calls))
+	for i, bodies := range b.calls {
+		calls[i] = strings.Join(bodies, ",")
+	}
+	return calls
+}
+
+// TestBatchPartialFailure 检查批量处理部分失败时, 成功的消息批量删除, 失败的消息逐条重试一次.
+func TestBatchPartialFailure(t *testing.T) {
+	fake, clt := newFakeQueue(t, "batch", 30*time.Second)
+	sendMessages(t, clt, "ok-1", "fail-2", "retry-3", "ok-4")
+
+	var calls batchCalls
+	handler := func(ctx context.Context, msgs []mns.Message) []error {
+		calls.record(msgs)
+		errs := make([]error, len(msgs))
+		for i, msg := range msgs {
+			body := string(msg.MessageBody)
+			// retry 开头的消息只在批量处理时失败, 单独重试时成功
+			if strings.HasPrefix(body, "fail") || strings.HasPrefix(body, "retry") && len(msgs) > 1 {
+				errs[i] = errors.New("failed")
+			}
+		}
+		return errs
+	}
+	c := NewConsumerBatch("batch", handler, WithQueueClient(clt), WithBatch(4, time.Second), WithLimitSize(4), WithLogger(logger.Nop))
+	c.Start()
+	defer c.Stop()
+
+	waitFor(t, "retried messages handled", func() bool { return len(calls.get()) == 3 })
+	waitFor(t, "succeeded messages deleted", func() bool { return fake.Len("batch") == 1 })
+
+	want := []string{"ok-1,fail-2,retry-3,ok-4", "fail-2", "retry-3"}
+	if got := calls.get(); strings.Join(got, " | ") != strings.Join(want, " | ") {
+		t.Errorf("handler calls %q, want %q", got, want)
+	}
+	if n := fake.Calls("BatchDeleteMessage"); n != 1 {
+		t.Errorf("BatchDeleteMessage called %d times, want 1 for the batch", n)
+	}
+	if n := fake.Calls("DeleteMessage"); n != 1 {
+		t.Errorf("DeleteMessage called %d times, want 1 for the retried message", n)
+	}
+}
+
+func TestBatchSingleMessageNotRetried(t *testing.T) {
+	fake, clt := newFakeQueue(t, "batch", 30*time.Second)
+	sendMessages(t, clt, "fail-1")
+
+	var calls batchCalls
+	c := NewConsumerBatch("batch", func(ctx context.Context, msgs []mns.Message) []error {
+		calls.record(msgs)
+		return []error{errors.New("failed")}
+	}, WithQueueClient(clt), WithBatch(4, 50*time.Millisecond), WithLimitSize(4), WithLogger(logger.Nop))
+	c.Start()
+
+	waitFor(t, "batch handled", func() bool { return len(calls.get()) > 0 })
+	time.Sleep(100 * time.Millisecond)
+	c.Stop()
+	if got := calls.get(); len(got) != 1 {
+		t.Errorf("handler calls %q, want the single message not retried", got)
+	}
+	if n := fake.Len("batch"); n != 1 {
+		t.Errorf("%d messages left, want the failed message kept", n)
+	}
+}
+
+// TestBatchDeleteChunks 检查一批超过 16 条的消息分多次 BatchDeleteMessage 删除.
+func TestBatchDeleteChunks(t *testing.T) {
+	fake, clt := newFakeQueue(t, "batch", 30*time.Second)
+	bodies := make([]string, 40)
+	for i := range bodies {
+		bodies[i] = strconv.Itoa(i)
+	}
+	sendMessages(t, clt, bodies...)
+
+	var calls batchCalls
+	c := NewConsumerBatch("batch", func(ctx context.Context, msgs []mns.Message) []error {
+		calls.record(msgs)
+		return make([]error, len(msgs))
+	}, WithQueueClient(clt), WithBatch(40, 5*time.Second), WithLimitSize(40), WithLogger(logger.Nop))
+	c.Start()
+	defer c.Stop()
+
+	waitFor(t, "all messages deleted", func() bool { return fake.Len("batch") == 0 })
+	if got := calls.get(); len(got) != 1 {
+		t.Errorf("handler called %d times, want one batch of 40", len(got))
+	}
+	if n := fake.Calls("BatchDeleteMessage"); n != 3 {
+		t.Errorf("BatchDeleteMessage called %d times, want 3 chunks of at most 16", n)
+	}
+}
@@ -0,0 +1,149 @@
+package consumer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/wangping886/mns_consumer/logger"
+)
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker 在 handler 连续失败 threshold 次之后打开, 停止拉取消息;
+// cooldown 之后半开, 只拉取一条消息试探, 成功则关闭, 失败则重新打开.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	probing  bool // 半开状态下试探的消息已经取到, 正在等待结果
+}
+
+// WithCircuitBreaker 设置熔断: HandlerFunc 连续失败 failures 次之后停止拉取消息,
+// 已经收到还没有开始处理的消息不再交给 handler, 等可见时间过后重新投递, 避免白白消耗 DequeueCount;
+// cooldown 之后只拉取一条消息交给 handler 试探, 成功后恢复拉取, 失败则再等 cooldown;
+// 试探消息没有交给 handler(比如进入死信队列)时没有结论, 重新拉取一条试探.
+// 熔断期间 Health 的 PauseReason 为 PauseCircuitOpen.
+// 只能用于 NewConsumerFunc 和 NewConsumerBatch, Handler 没有返回处理结果; failures 和 cooldown 不大于 0 时 panic.
+func WithCircuitBreaker(failures int, cooldown time.Duration) option {
+	return func(c *Consumer) {
+		c.breaker = &circuitBreaker{
+			threshold: failures,
+			cooldown:  cooldown,
+		}
+	}
+}
+
+// receiveSize 返回一次最多拉取的消息数, 半开状态下只拉取一条.
+func (c *Consumer) receiveSize() int {
+	if c.breaker == nil {
+		return 16
+	}
+	c.breaker.mu.Lock()
+	defer c.breaker.mu.Unlock()
+
+	if c.breaker.state == breakerHalfOpen {
+		return 1
+	}
+	return 16
+}
+
+// breakerReceived 在收到消息之后调用, 半开状态下收到的消息是试探消息,
+// 返回 true 并暂停拉取, 直到试探有结果.
+func (c *Consumer) breakerReceived() (probe bool) {
+	if c.breaker == nil {
+		return false
+	}
+	c.breaker.mu.Lock()
+	defer c.breaker.mu.Unlock()
+
+	if c.breaker.state != breakerHalfOpen || c.breaker.probing {
+		return false
+	}
+	c.breaker.probing = true
+	c.pause.set(func(p *pauseState) { p.breaker = true })
+	return true
+}
+
+// breakerAllow 判断非试探消息是否可以交给 handler.
+func (c *Consumer) breakerAllow() bool {
+	if c.breaker == nil {
+		return true
+	}
+	c.breaker.mu.Lock()
+	defer c.breaker.mu.Unlock()
+
+	return c.breaker.state == breakerClosed
+}
+
+// breakerResult 记录 handler 的结果, 熔断打开或者半开时只有试探消息的结果有效.
+func (c *Consumer) breakerResult(probe bool, err error) {
+	if c.breaker == nil {
+		return
+	}
+	b := c.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case b.state == breakerClosed && err == nil:
+		b.failures = 0
+	case b.state == breakerClosed:
+		b.failures++
+		if b.failures >= b.threshold {
+			c.openBreaker(err)
+		}
+	case b.state == breakerHalfOpen && probe && err == nil:
+		b.state = breakerClosed
+		b.failures = 0
+		b.probing = false
+		c.pause.set(func(p *pauseState) { p.breaker = false })
+		c.logger.Info("circuit closed", logger.F("queue", c.queName))
+	case b.state == breakerHalfOpen && probe:
+		c.openBreaker(err)
+	}
+}
+
+// breakerSkipped 在试探消息没有交给 handler 时调用, 没有结论, 保持半开并恢复拉取下一条试探消息.
+func (c *Consumer) breakerSkipped(probe bool) {
+	if c.breaker == nil || !probe {
+		return
+	}
+	b := c.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != breakerHalfOpen || !b.probing {
+		return
+	}
+	b.probing = false
+	c.pause.set(func(p *pauseState) { p.breaker = false })
+	c.logger.Debug("probe message not handled, probing again", logger.F("queue", c.queName))
+}
+
+// openBreaker 打开熔断, cooldown 之后进入半开状态, 需要持有 breaker.mu.
+func (c *Consumer) openBreaker(err error) {
+	b := c.breaker
+	b.state = breakerOpen
+	b.probing = false
+	c.pause.set(func(p *pauseState) { p.breaker = true })
+	c.logger.Warn("circuit opened", logger.F("queue", c.queName), logger.F("failures", b.failures), logger.F("cooldown", b.cooldown.String()), logger.Err(err))
+
+	time.AfterFunc(b.cooldown, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if b.state != breakerOpen {
+			return
+		}
+		b.state = breakerHalfOpen
+		c.pause.set(func(p *pauseState) { p.breaker = false })
+		c.logger.Info("circuit half-open, probing with one message", logger.F("queue", c.queName))
+	})
+}
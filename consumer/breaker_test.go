@@ -0,0 +1,142 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wangping886/mns_consumer/logger"
+	"github.com/wangping886/mns_consumer/mns.aliyun"
+)
+
+func breakerState(c *Consumer) int {
+	c.breaker.mu.Lock()
+	defer c.breaker.mu.Unlock()
+	return c.breaker.state
+}
+
+func TestCircuitBreakerStates(t *testing.T) {
+	_, clt := newFakeQueue(t, "breaker", 30*time.Second)
+	c := NewConsumerFunc("breaker", func(ctx context.Context, msg mns.Message) error { return nil },
+		WithQueueClient(clt), WithLogger(logger.Nop), WithCircuitBreaker(2, 50*time.Millisecond))
+	failed := errors.New("failed")
+
+	c.breakerResult(false, failed)
+	if breakerState(c) != breakerClosed || c.Paused() {
+		t.Fatal("breaker opened before reaching the failure threshold")
+	}
+	c.breakerResult(false, failed)
+	if breakerState(c) != breakerOpen || !c.Paused() || c.Health().PauseReason != PauseCircuitOpen {
+		t.Fatal("breaker not open after 2 consecutive failures")
+	}
+	if c.breakerAllow() {
+		t.Error("breakerAllow() = true while open")
+	}
+
+	waitFor(t, "half-open", func() bool { return breakerState(c) == breakerHalfOpen })
+	if c.Paused() || c.receiveSize() != 1 {
+		t.Fatalf("half-open: Paused() = %v, receiveSize() = %d, want receiving one probe message", c.Paused(), c.receiveSize())
+	}
+	if !c.breakerReceived() || c.breakerReceived() {
+		t.Fatal("want exactly one probe message while half-open")
+	}
+	if !c.Paused() {
+		t.Error("not paused while waiting for the probe result")
+	}
+
+	// 试探失败重新打开
+	c.breakerResult(true, failed)
+	if breakerState(c) != breakerOpen {
+		t.Fatal("breaker not reopened after the probe failed")
+	}
+	waitFor(t, "half-open again", func() bool { return breakerState(c) == breakerHalfOpen })
+
+	// 试探消息没有交给 handler, 重新拉取一条试探
+	if !c.breakerReceived() {
+		t.Fatal("no probe after reopening")
+	}
+	c.breakerSkipped(true)
+	if c.Paused() || breakerState(c) != breakerHalfOpen {
+		t.Fatal("skipped probe must keep the breaker half-open and resume receiving")
+	}
+
+	if !c.breakerReceived() {
+		t.Fatal("no probe after a skipped probe")
+	}
+	c.breakerResult(true, nil)
+	if breakerState(c) != breakerClosed || c.Paused() || c.receiveSize() != 16 {
+		t.Error("breaker not closed after the probe succeeded")
+	}
+}
+
+// TestCircuitBreakerPausesReceiving 检查熔断打开期间不拉取消息, cooldown 之后用一条消息试探并恢复.
+func TestCircuitBreakerPausesReceiving(t *testing.T) {
+	const cooldown = 300 * time.Millisecond
+	fake, clt := newFakeQueue(t, "breaker", 50*time.Millisecond)
+	sendMessages(t, clt, "1")
+
+	var (
+		mu    sync.Mutex
+		calls []time.Time
+	)
+	c := NewConsumerFunc("breaker", func(ctx context.Context, msg mns.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, time.Now())
+		if len(calls) <= 2 {
+			return errors.New("downstream failed")
+		}
+		return nil
+	}, WithQueueClient(clt), WithLimitSize(1), WithLogger(logger.Nop), WithCircuitBreaker(2, cooldown))
+	c.Start()
+	defer c.Stop()
+
+	waitFor(t, "message deleted", func() bool { return fake.Len("breaker") == 0 })
+	mu.Lock()
+	defer mu.Unlock()
+	if len(calls) != 3 {
+		t.Fatalf("handler called %d times, want 2 failures and 1 probe", len(calls))
+	}
+	if gap := calls[2].Sub(calls[1]); gap < cooldown {
+		t.Errorf("probe %s after the breaker opened, want at least the cooldown %s", gap, cooldown)
+	}
+}
+
+func TestCircuitBreakerValidation(t *testing.T) {
+	handlerFunc := func(ctx context.Context, msg mns.Message) error { return nil }
+	tests := []struct {
+		name string
+		new  func()
+		want string
+	}{
+		{
+			name: "zero failures",
+			new:  func() { NewConsumerFunc("q", handlerFunc, WithCircuitBreaker(0, time.Second)) },
+			want: "failures 0 must be positive",
+		},
+		{
+			name: "negative cooldown",
+			new:  func() { NewConsumerFunc("q", handlerFunc, WithCircuitBreaker(3, -time.Second)) },
+			want: "cooldown -1s must be positive",
+		},
+		{
+			name: "Handler",
+			new:  func() { NewConsumer("q", func(*Consumer, mns.Message) {}, WithCircuitBreaker(3, time.Second)) },
+			want: "WithCircuitBreaker requires NewConsumerFunc or NewConsumerBatch",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				r := recover()
+				if msg, _ := r.(string); !strings.Contains(msg, tt.want) {
+					t.Errorf("panic %v, want it to contain %q", r, tt.want)
+				}
+			}()
+			tt.new()
+		})
+	}
+}
@@ -2,15 +2,22 @@ package consumer
 
 import (
 	"context"
-	"encoding/xml"
+	"errors"
+	"fmt"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/tomb.v1"
 
+	"github.com/wangping886/mns_consumer/logger"
 	"github.com/wangping886/mns_consumer/mns.aliyun"
-	"log"
 
+	"github.com/wangping886/mns_consumer/metrics"
+	"github.com/wangping886/mns_consumer/ratelimit"
+	"github.com/wangping886/mns_consumer/tracing"
 	"github.com/wangping886/mns_consumer/util"
 )
 
@@ -18,43 +25,145 @@ const defaultTimeoutMaxRetry = 5
 
 type Handler func(*Consumer, mns.Message)
 
+// HandlerFunc 处理一条消息. 返回 nil 时 consumer 负责删除消息并释放并发额度;
+// 返回错误时消息不会被删除, 等可见时间过后由 MNS 重新投递.
+type HandlerFunc func(ctx context.Context, msg mns.Message) error
+
 type queueMsg struct {
-	c      *Consumer
-	mnsMsg mns.Message
+	c         *Consumer
+	mnsMsg    mns.Message
+	requestId string // 接收到这条消息的 BatchReceiveMessage 请求的 RequestId
+	probe     bool   // 熔断半开时的试探消息
 }
 
 type Consumer struct {
+	queName         string
 	client          *mns.QueueClient
 	hanlder         Handler
+	handlerFunc     HandlerFunc
 	t               tomb.Tomb
 	timeoutMaxRetry int
 	queSize         int
 	limitSize       int
 	queMsgChan      chan queueMsg
 	LimitChan       chan bool // 并发数
+	globalLimit     chan bool // Manager 的全局并发数, 所有队列共享
 	w               util.WaitGroupWrapper
+	handlers        util.WaitGroupWrapper // 正在执行的 handler goroutine, Manager.Stop 等待它们结束
 	serveDone       chan struct{}
+	metrics         metrics.Metrics
+	deadLetter      *mns.QueueClient
+	maxDequeueCount int
+	health          healthState
+	logger          logger.Logger
+	redactBody      func(body []byte) string
+	tracer          tracing.Tracer
+	pause           pauseState
+	downstreamCheck func(ctx context.Context) error
+	checkInterval   time.Duration
+	firstCheck      chan struct{} // 第一次下游检查完成时关闭, serve 在此之前不拉取
+	adaptive        *adaptiveLimiter
+	rateLimiter     *ratelimit.Limiter
+	breaker         *circuitBreaker
+	batchHandler    BatchHandler
+	batchSize       int
+	batchLinger     time.Duration
+	ordered         *orderedQueue
+
+	unwrapNotification       bool
+	notifications            sync.Map // ReceiptHandle -> *mns.Notification, 见 Consumer.Notification
+	notificationBase64Decode bool
 }
 
 type option func(c *Consumer)
 
+// NewConsumer 创建使用 Handler 的 consumer, handler 自己负责删除消息和释放 LimitChan.
+// 选项和 Handler 的组合不受支持时(比如 WithAdaptiveLimit) panic.
 func NewConsumer(queName string, handler Handler, options ...option) *Consumer {
+	c := newConsumer(queName, options)
+	c.hanlder = handler
+	c.mustValidate()
+	return c
+}
+
+func newConsumer(queName string, options []option) *Consumer {
 	c := &Consumer{
+		queName:         queName,
 		client:          SetQueue(queName),
-		hanlder:         handler,
 		timeoutMaxRetry: defaultTimeoutMaxRetry,
 		serveDone:       make(chan struct{}),
+		metrics:         metrics.Nop,
+		logger:          logger.Std,
+		redactBody:      RedactBody,
+		tracer:          tracing.Nop,
 	}
 
 	for _, o := range options {
 		o(c)
 	}
 
+	if c.metrics != metrics.Nop && c.client.Observer == nil {
+		c.client.Observer = c.metrics
+	}
 	c.queMsgChan = make(chan queueMsg, c.queSize)
-	c.LimitChan = make(chan bool, c.limitSize)
+	if c.adaptive != nil {
+		c.LimitChan = make(chan bool, c.adaptive.cfg.Max)
+		c.adaptive.init(c)
+	} else {
+		c.LimitChan = make(chan bool, c.limitSize)
+	}
+	return c
+}
+
+// NewConsumerFunc 和 NewConsumer 一样, 区别是 handler 不需要自己删除消息和释放 LimitChan,
+// consumer 根据 handler 的返回值决定是否删除消息.
+func NewConsumerFunc(queName string, handler HandlerFunc, options ...option) *Consumer {
+	c := newConsumer(queName, options)
+	c.handlerFunc = handler
+	c.mustValidate()
 	return c
 }
 
+// mustValidate 检查 handler 和选项的组合, 不支持的组合在创建 consumer 时 panic, 而不是运行时才表现为难以排查的问题.
+func (c *Consumer) mustValidate() {
+	var problems []string
+	if c.handlerFunc == nil && c.batchHandler == nil {
+		// Handler 自己释放 LimitChan, consumer 不知道消息什么时候处理完, 也拿不到处理结果
+		if c.adaptive != nil {
+			problems = append(problems, "WithAdaptiveLimit requires NewConsumerFunc or NewConsumerBatch")
+		}
+		if c.breaker != nil {
+			problems = append(problems, "WithCircuitBreaker requires NewConsumerFunc or NewConsumerBatch")
+		}
+	}
+	if c.breaker != nil {
+		if c.breaker.threshold <= 0 {
+			problems = append(problems, fmt.Sprintf("WithCircuitBreaker failures %d must be positive", c.breaker.threshold))
+		}
+		if c.breaker.cooldown <= 0 {
+			problems = append(problems, fmt.Sprintf("WithCircuitBreaker cooldown %s must be positive", c.breaker.cooldown))
+		}
+	}
+	if c.batchHandler != nil {
+		// 并发额度按消息条数计算, 额度小于批量条数时每一批都凑不满
+		limit, name := c.limitSize, "WithLimitSize"
+		if c.adaptive != nil {
+			limit, name = c.adaptive.cfg.Min, "AdaptiveLimit.Min"
+		}
+		if limit < c.batchSize {
+			problems = append(problems, fmt.Sprintf("%s %d is less than the batch size %d", name, limit, c.batchSize))
+		}
+		if c.ordered != nil {
+			problems = append(problems, "WithOrderedKey can't be used with NewConsumerBatch")
+		}
+	} else if c.batchSize != 0 || c.batchLinger != 0 {
+		problems = append(problems, "WithBatch requires NewConsumerBatch")
+	}
+	if len(problems) > 0 {
+		panic("consumer " + c.queName + ": " + strings.Join(problems, "; "))
+	}
+}
+
 func WithTimeoutRetry(retry int) option {
 	return func(c *Consumer) {
 		c.timeoutMaxRetry = retry
@@ -73,9 +182,89 @@ func WithLimitSize(size int) option {
 	}
 }
 
+// WithQueueClient 使用调用方提供的 QueueClient 代替 SetQueue 生成的默认 client,
+// 可以指向任意 endpoint(包括本地的 fake 服务).
+func WithQueueClient(clt *mns.QueueClient) option {
+	return func(c *Consumer) {
+		c.client = clt
+	}
+}
+
+// WithMetrics 设置指标收集器, 如果 QueueClient 没有设置 Observer, api 调用的指标也会上报到 m.
+func WithMetrics(m metrics.Metrics) option {
+	return func(c *Consumer) {
+		c.metrics = m
+	}
+}
+
+// WithDeadLetterQueue 设置死信队列, DequeueCount 超过 maxDequeueCount 的消息不再交给 handler,
+// 而是原样发送到 clt 并从当前队列删除.
+func WithDeadLetterQueue(clt *mns.QueueClient, maxDequeueCount int) option {
+	return func(c *Consumer) {
+		c.deadLetter = clt
+		c.maxDequeueCount = maxDequeueCount
+	}
+}
+
+// WithLogger 设置日志输出, 默认是 logger.Std.
+func WithLogger(l logger.Logger) option {
+	return func(c *Consumer) {
+		c.logger = l
+	}
+}
+
+// WithBodyRedactor 设置消息体写入日志之前的脱敏函数, 默认是 RedactBody, 只记录消息体长度.
+func WithBodyRedactor(redact func(body []byte) string) option {
+	return func(c *Consumer) {
+		c.redactBody = redact
+	}
+}
+
+// RedactBody 隐藏消息体的内容, 只保留长度.
+func RedactBody(body []byte) string {
+	return "[redacted " + strconv.Itoa(len(body)) + " bytes]"
+}
+
+// WithTracer 设置 tracer, consumer 会以消息信封里的 trace 上下文为 parent 开始一个 span 包住 handler.
+// 无论是否设置, 信封格式的消息都会先拆开, handler 收到的是原始消息体.
+func WithTracer(t tracing.Tracer) option {
+	return func(c *Consumer) {
+		c.tracer = t
+	}
+}
+
+// WithRateLimit 限制每秒开始执行的 handler 数, l 可以在多个 consumer 之间共享.
+// handler 返回包装了 ratelimit.ErrThrottled 的错误时, 说明下游限流, l 的速率会降低.
+// 限制 api 调用频率使用 QueueClient.Limiter.
+func WithRateLimit(l *ratelimit.Limiter) option {
+	return func(c *Consumer) {
+		c.rateLimiter = l
+	}
+}
+
+type headersKey struct{}
+
+// HeadersFromContext 返回消息信封里的 headers, 比如从 kafka 桥接过来的消息的 key 和 headers, 只对 HandlerFunc 有效.
+func HeadersFromContext(ctx context.Context) (map[string]string, bool) {
+	headers, ok := ctx.Value(headersKey{}).(map[string]string)
+	return headers, ok
+}
+
 func (c *Consumer) Start() {
-	c.w.Wrap(c.startQueueWorker)
+	c.health.start()
+	if c.batchHandler != nil {
+		c.w.Wrap(c.startBatchWorker)
+	} else {
+		c.w.Wrap(c.startQueueWorker)
+	}
+	if c.downstreamCheck != nil {
+		c.firstCheck = make(chan struct{})
+		c.w.Wrap(c.checkDownstream)
+	}
 	c.w.Wrap(c.serve)
+	if c.adaptive != nil {
+		c.w.Wrap(c.adaptive.run)
+	}
 
 	go func() {
 		c.w.Wait()
@@ -85,9 +274,10 @@ func (c *Consumer) Start() {
 
 func (c *Consumer) serve() {
 	var (
-		i    int
-		msgs []mns.Message
-		err  error
+		i         int
+		msgs      []mns.Message
+		requestId string
+		err       error
 	)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -96,25 +286,52 @@ func (c *Consumer) serve() {
 		cancel()
 	}()
 
+	if c.firstCheck != nil {
+		select {
+		case <-c.firstCheck:
+		case <-ctx.Done():
+		}
+	}
 	for {
+		if !c.pause.wait(ctx) {
+			c.logger.Info("serve canceled", logger.F("queue", c.queName), logger.F("request_id", requestId), logger.Err(ctx.Err()))
+			goto DONE
+		}
+		recvCtx, cancelRecv := c.pause.receiveContext(ctx)
 		for i = 0; i < c.timeoutMaxRetry; i++ {
-			_, msgs, err = c.client.BatchReceiveMessage2Context(ctx, 16, 20, false) // 每次最多可以取 16 个消息
+			requestId, msgs, err = c.client.BatchReceiveMessage2Context(recvCtx, c.receiveSize(), 20, false) // 每次最多可以取 16 个消息
 			if err == nil {
+				c.health.receiveOK()
+				c.metrics.MessagesReceived(c.queName, len(msgs))
 				break
 			}
-			if timeoutErr(err) || mnsMsgNotFound(err) {
+			if mnsMsgNotFound(err) {
+				c.health.receiveOK()
+				c.metrics.EmptyReceive(c.queName)
+				continue
+			}
+			if recvCtx.Err() != nil {
+				break // consumer 正在停止或者暂停
+			}
+			c.health.receiveFail()
+			if timeoutErr(err) {
 				continue // 连接超时重试
 			} else {
-				log.Println("consumerServe", "receiveMessageFail", "err", err)
+				c.logger.Error("receive message failed", logger.F("queue", c.queName), logger.F("request_id", errRequestId(err, requestId)), logger.Err(err))
 				break
 			}
 		}
+		cancelRecv()
+
+		if err != nil && ctx.Err() == nil && recvCtx.Err() != nil {
+			continue // 暂停, 等待恢复
+		}
 
 		if err != nil {
 			select {
 			case <-ctx.Done():
 				//context.DeadlineExceeded, context.Canceled
-				log.Println("msg", ctx.Err(), "method", "consumer.Serve", "func", "ctx.Done")
+				c.logger.Info("serve canceled", logger.F("queue", c.queName), logger.F("request_id", errRequestId(err, requestId)), logger.Err(ctx.Err()))
 
 				goto DONE
 			default:
@@ -123,7 +340,7 @@ func (c *Consumer) serve() {
 
 		if err != nil {
 			if mnsMsgNotFound(err) {
-				log.Println("errmsg", err, "method", "consumer.Serve", "func", "getMsg")
+				c.logger.Debug("no message", logger.F("queue", c.queName), logger.F("request_id", errRequestId(err, requestId)))
 
 				continue
 			}
@@ -131,18 +348,59 @@ func (c *Consumer) serve() {
 			continue
 		}
 
+		probe := len(msgs) > 0 && c.breakerReceived()
 		for _, msg := range msgs {
-			c.LimitChan <- true
+			if !c.acquire(ctx) {
+				// 还没有交给 handler 的消息等可见时间过后重新投递
+				c.logger.Info("serve canceled", c.msgFields(msg, requestId, logger.Err(ctx.Err()))...)
+				goto DONE
+			}
 			c.queMsgChan <- queueMsg{
-				c:      c,
-				mnsMsg: msg,
+				c:         c,
+				mnsMsg:    msg,
+				requestId: requestId,
+				probe:     probe,
 			}
 		}
 	}
 DONE:
+	c.health.stop()
 	close(c.serveDone)
-	log.Println("msg", "serve.done", "method", "consumer.Serve")
+	c.logger.Info("serve done", logger.F("queue", c.queName))
+
+}
+
+// acquire 占用一个并发额度, 由 Manager 管理时还要占用一个全局额度; 额度已满时 Health.Saturated 为 true,
+// 在有 handler 结束之前不再拉取. consumer 停止时返回 false.
+func (c *Consumer) acquire(ctx context.Context) bool {
+	select {
+	case c.LimitChan <- true:
+	default:
+		c.health.setSaturated(true)
+		select {
+		case c.LimitChan <- true:
+			c.health.setSaturated(false)
+		case <-ctx.Done():
+			return false
+		}
+	}
+	if c.globalLimit == nil {
+		return true
+	}
 
+	select {
+	case c.globalLimit <- true:
+	default:
+		c.health.setSaturated(true)
+		select {
+		case c.globalLimit <- true:
+			c.health.setSaturated(false)
+		case <-ctx.Done():
+			<-c.LimitChan
+			return false
+		}
+	}
+	return true
 }
 
 func (c *Consumer) startQueueWorker() {
@@ -154,28 +412,163 @@ func (c *Consumer) startQueueWorker() {
 		close(c.queMsgChan)
 	}()
 
+	ctx, cancel := c.dyingContext()
+	defer cancel()
+
 	for msg := range c.queMsgChan {
 		<-tick.C
-		go c.hanlder(msg.c, msg.mnsMsg)
+		if err := c.rateLimiter.Wait(ctx); err != nil {
+			// consumer 正在停止, 不再等待令牌, 还没有交给 handler 的消息等可见时间过后重新投递
+			c.logger.Info("serve canceled", c.msgFields(msg.mnsMsg, msg.requestId, logger.Err(err))...)
+			c.breakerSkipped(msg.probe)
+			c.release(1)
+			continue
+		}
+		if c.ordered != nil {
+			c.ordered.dispatch(msg)
+			continue
+		}
+		msg := msg
+		c.handlers.Wrap(func() { c.handle(msg.mnsMsg, msg.requestId, msg.probe) })
+	}
+	c.logger.Info("worker done", logger.F("queue", c.queName))
+
+}
+
+// dyingContext 返回 consumer 停止时取消的 ctx.
+func (c *Consumer) dyingContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-c.t.Dying():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// release 释放 n 个 acquire 占用的并发额度.
+func (c *Consumer) release(n int) {
+	for i := 0; i < n; i++ {
+		<-c.LimitChan
+		if c.globalLimit != nil {
+			<-c.globalLimit
+		}
+	}
+}
+
+// handle 执行一条消息的处理逻辑并上报指标, probe 表示熔断半开时的试探消息.
+func (c *Consumer) handle(msg mns.Message, requestId string, probe bool) {
+	c.metrics.InFlight(c.queName, 1)
+	id := c.health.handleStart(1)
+	defer func() {
+		c.metrics.InFlight(c.queName, -1)
+		c.health.handleDone(id, 1)
+		// Handler 自己释放 LimitChan, 全局额度在 handler 返回时释放
+		if c.globalLimit != nil {
+			<-c.globalLimit
+		}
+	}()
+
+	if msg.EnqueueTime > 0 {
+		c.metrics.MessageLag(c.queName, time.Since(time.Unix(0, msg.EnqueueTime*int64(time.Millisecond))))
+	}
+
+	if !probe && !c.breakerAllow() {
+		// 熔断期间不处理, 等可见时间过后重新投递
+		c.logger.Debug("circuit open, message left invisible", c.msgFields(msg, requestId)...)
+		<-c.LimitChan
+		return
+	}
+
+	if c.deadLetter != nil && c.maxDequeueCount > 0 && msg.DequeueCount > c.maxDequeueCount {
+		c.moveToDeadLetter(msg, requestId)
+		c.breakerSkipped(probe)
+		<-c.LimitChan
+		return
+	}
+
+	ctx := context.Background()
+	if c.unwrapNotification {
+		var err error
+		if ctx, msg, err = c.unwrap(ctx, msg, requestId); err != nil {
+			c.breakerSkipped(probe)
+			<-c.LimitChan
+			return
+		}
+		defer c.forgetNotification(msg)
+	}
+	headers, body, _ := tracing.Open(msg.MessageBody)
+	msg.MessageBody = body
+	if headers != nil {
+		ctx = context.WithValue(ctx, headersKey{}, headers)
+	}
+	ctx, endSpan := c.tracer.StartSpan(ctx, "mns.consume "+c.queName, headers)
+
+	begin := time.Now()
+	if c.handlerFunc == nil {
+		c.hanlder(c, msg)
+		c.observe(time.Since(begin), nil)
+		endSpan(nil)
+		return
+	}
+
+	err := c.handlerFunc(ctx, msg)
+	c.observe(time.Since(begin), err)
+	c.breakerResult(probe, err)
+	endSpan(err)
+	if err != nil {
+		c.logger.Warn("handle message failed", c.msgFields(msg, requestId, logger.F("dequeue_count", msg.DequeueCount), logger.Err(err))...)
+	} else {
+		c.Delete(ctx, msg)
+	}
+	<-c.LimitChan
+}
+
+// observe 上报 handler 的执行结果.
+func (c *Consumer) observe(d time.Duration, err error) {
+	c.metrics.MessageHandled(c.queName, d, err)
+	if errors.Is(err, ratelimit.ErrThrottled) {
+		c.rateLimiter.Throttled()
 	}
-	log.Println("msg", "worker.done", "method", "startQueueWorker")
+	if c.adaptive != nil {
+		c.adaptive.observe(d, err)
+	}
+}
 
+// moveToDeadLetter 把消息原样发送到死信队列, 成功后从当前队列删除.
+// 发送失败时保留消息, 等待下次投递再尝试.
+func (c *Consumer) moveToDeadLetter(msg mns.Message, requestId string) {
+	// serve 接收消息时没有做 base64 解码, 这里也不编码, 保证消息体和原来完全一致
+	sendRequestId, _, err := c.deadLetter.SendMessage2(&mns.MessageToSend{
+		MessageBody: msg.MessageBody,
+		Priority:    msg.Priority,
+	}, false)
+	if err != nil {
+		c.logger.Error("move message to dead letter queue failed", c.msgFields(msg, errRequestId(err, sendRequestId), logger.F("dequeue_count", msg.DequeueCount), logger.Err(err))...)
+		return
+	}
+	c.logger.Warn("message moved to dead letter queue", c.msgFields(msg, requestId, logger.F("dequeue_count", msg.DequeueCount))...)
+	c.metrics.MessageDeadLettered(c.queName)
+	c.Delete(context.Background(), msg)
 }
 
 func (c *Consumer) Stop() {
 	c.t.Kill(nil)
 	c.t.Wait()
-	log.Println("msg", "consumer.done", "method", "Stop")
+	c.logger.Info("consumer stopped", logger.F("queue", c.queName))
 
 }
 
 func (c *Consumer) Delete(ctx context.Context, msg mns.Message) {
-	log.Println("method", "mns.Delete", "msgID", msg.MessageId)
-
-	var err error
+	var (
+		requestId string
+		err       error
+	)
 
 	for i := 0; i < c.timeoutMaxRetry; i++ {
-		_, err = c.client.DeleteMessage(msg.ReceiptHandle)
+		requestId, err = c.client.DeleteMessage(msg.ReceiptHandle)
 		if err == nil {
 			break
 		}
@@ -187,9 +580,32 @@ func (c *Consumer) Delete(ctx context.Context, msg mns.Message) {
 	}
 
 	if err != nil {
-		b, _ := xml.Marshal(&msg)
-		log.Println("msgstr", string(b))
+		c.logger.Error("delete message failed", c.msgFields(msg, errRequestId(err, requestId),
+			logger.F("receipt_handle", msg.ReceiptHandle),
+			logger.F("dequeue_count", msg.DequeueCount),
+			logger.F("body", c.redactBody(msg.MessageBody)),
+			logger.Err(err))...)
+		return
+	}
+	c.logger.Debug("message deleted", c.msgFields(msg, requestId)...)
+	c.metrics.MessageDeleted(c.queName)
+}
+
+// msgFields 返回每条消息相关的日志都要带上的字段.
+func (c *Consumer) msgFields(msg mns.Message, requestId string, fields ...logger.Field) []logger.Field {
+	return append([]logger.Field{
+		logger.F("queue", c.queName),
+		logger.F("message_id", msg.MessageId),
+		logger.F("request_id", requestId),
+	}, fields...)
+}
+
+// errRequestId 优先使用 ApiError 里的 RequestId.
+func errRequestId(err error, requestId string) string {
+	if apiErr, ok := err.(*mns.ApiError); ok && apiErr.RequestId != "" {
+		return apiErr.RequestId
 	}
+	return requestId
 }
 
 func timeoutErr(err error) bool {
@@ -0,0 +1,45 @@
+package consumer
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/wangping886/mns_consumer/internal/mnsfake"
+	"github.com/wangping886/mns_consumer/mns.aliyun"
+)
+
+// newFakeServer 启动进程内的 MNS 模拟服务, 返回服务和它的 endpoint.
+func newFakeServer(t *testing.T, visibility time.Duration) (*mnsfake.Server, string) {
+	fake := mnsfake.NewServer(visibility)
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	return fake, srv.URL
+}
+
+// newFakeQueue 和 newFakeServer 一样, 返回指向队列 name 的 client.
+func newFakeQueue(t *testing.T, name string, visibility time.Duration) (*mnsfake.Server, *mns.QueueClient) {
+	fake, endpoint := newFakeServer(t, visibility)
+	return fake, &mns.QueueClient{QueueURL: endpoint + "/queues/" + name}
+}
+
+// sendMessages 按顺序发送消息, 消息体不做 base64 编码, 和 consumer 接收时一致.
+func sendMessages(t *testing.T, clt *mns.QueueClient, bodies ...string) {
+	t.Helper()
+	for _, body := range bodies {
+		if _, _, err := clt.SendMessage2(&mns.MessageToSend{MessageBody: []byte(body)}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
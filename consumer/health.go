@@ -0,0 +1,213 @@
+package consumer
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Health 是 consumer 某一时刻的健康状态.
+type Health struct {
+	Queue                    string    `json:"queue"`
+	Running                  bool      `json:"running"`                    // serve 循环是否在运行
+	StartTime                time.Time `json:"start_time"`                 // Start 的时间
+	LastReceiveTime          time.Time `json:"last_receive_time"`          // 最近一次成功的 BatchReceiveMessage, 空轮询也算成功
+	ConsecutiveReceiveErrors int       `json:"consecutive_receive_errors"` // 连续失败的 BatchReceiveMessage 次数
+	Paused                   bool      `json:"paused"`                     // 是否暂停了拉取消息
+	PauseReason              string    `json:"pause_reason,omitempty"`     // 暂停的原因: PauseManual, PauseDownstream 或者 PauseCircuitOpen
+	Saturated                bool      `json:"saturated"`                  // 并发数已满, 在有 handler 结束之前不再拉取消息; 不算暂停
+	InFlight                 int       `json:"in_flight"`                  // 正在执行的 handler 数量
+	OldestInFlight           time.Time `json:"oldest_in_flight,omitempty"` // 正在执行的 handler 中最早开始的时间
+	LastHandledTime          time.Time `json:"last_handled_time"`          // 最近一次 handler 结束的时间
+	Concurrency              int       `json:"concurrency"`                // 并发数上限, 见 WithAdaptiveLimit
+}
+
+type healthState struct {
+	mu            sync.Mutex
+	running       bool
+	startTime     time.Time
+	lastReceive   time.Time
+	receiveErrors int
+	saturated     bool
+	inFlight      int
+	handleSeq     uint64
+	handleStarts  map[uint64]time.Time // 正在执行的 handler 的开始时间
+	lastHandled   time.Time
+}
+
+func (h *healthState) start() {
+	h.mu.Lock()
+	h.running = true
+	h.startTime = time.Now()
+	h.mu.Unlock()
+}
+
+func (h *healthState) stop() {
+	h.mu.Lock()
+	h.running = false
+	h.mu.Unlock()
+}
+
+func (h *healthState) receiveOK() {
+	h.mu.Lock()
+	h.lastReceive = time.Now()
+	h.receiveErrors = 0
+	h.mu.Unlock()
+}
+
+func (h *healthState) receiveFail() {
+	h.mu.Lock()
+	h.receiveErrors++
+	h.mu.Unlock()
+}
+
+func (h *healthState) setSaturated(saturated bool) {
+	h.mu.Lock()
+	h.saturated = saturated
+	h.mu.Unlock()
+}
+
+// handleStart 记录 n 条消息开始处理, 返回的 id 交给 handleDone.
+func (h *healthState) handleStart(n int) (id uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.handleStarts == nil {
+		h.handleStarts = make(map[uint64]time.Time)
+	}
+	h.handleSeq++
+	h.handleStarts[h.handleSeq] = time.Now()
+	h.inFlight += n
+	return h.handleSeq
+}
+
+func (h *healthState) handleDone(id uint64, n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.handleStarts, id)
+	h.inFlight -= n
+	h.lastHandled = time.Now()
+}
+
+// oldestInFlight 需要持有 mu.
+func (h *healthState) oldestInFlight() time.Time {
+	var oldest time.Time
+	for _, start := range h.handleStarts {
+		if oldest.IsZero() || start.Before(oldest) {
+			oldest = start
+		}
+	}
+	return oldest
+}
+
+// Health 返回 consumer 当前的健康状态.
+func (c *Consumer) Health() Health {
+	reason := c.pause.reason()
+	concurrency := c.Concurrency()
+
+	c.health.mu.Lock()
+	defer c.health.mu.Unlock()
+
+	return Health{
+		Queue:                    c.queName,
+		Running:                  c.health.running,
+		StartTime:                c.health.startTime,
+		LastReceiveTime:          c.health.lastReceive,
+		ConsecutiveReceiveErrors: c.health.receiveErrors,
+		Paused:                   reason != "",
+		PauseReason:              reason,
+		Saturated:                c.health.saturated,
+		InFlight:                 c.health.inFlight,
+		OldestInFlight:           c.health.oldestInFlight(),
+		LastHandledTime:          c.health.lastHandled,
+		Concurrency:              concurrency,
+	}
+}
+
+const (
+	defaultMaxReceiveErrors = 10
+	defaultMaxReceiveAge    = 2 * time.Minute
+	defaultMaxHandlerAge    = 10 * time.Minute
+)
+
+// HealthThresholds 是判断 consumer 是否健康的阈值, 零值表示使用默认值.
+type HealthThresholds struct {
+	MaxReceiveErrors int           // 连续接收失败达到这个次数视为不健康, 默认 10
+	MaxReceiveAge    time.Duration // 没有暂停却超过这个时间没有成功接收视为不健康, 默认 2 分钟
+	MaxHandlerAge    time.Duration // handler 执行超过这个时间, 或者并发数已满却这么久没有 handler 结束, 视为卡住, 默认 10 分钟
+}
+
+func (th HealthThresholds) withDefaults() HealthThresholds {
+	if th.MaxReceiveErrors <= 0 {
+		th.MaxReceiveErrors = defaultMaxReceiveErrors
+	}
+	if th.MaxReceiveAge <= 0 {
+		th.MaxReceiveAge = defaultMaxReceiveAge
+	}
+	if th.MaxHandlerAge <= 0 {
+		th.MaxHandlerAge = defaultMaxHandlerAge
+	}
+	return th
+}
+
+// Live 判断 consumer 是否存活, 不存活时应该重启进程.
+// serve 已经退出, 连续接收失败次数过多, handler 卡住(见 MaxHandlerAge),
+// 或者既没有暂停也没有满并发却长时间没有成功接收都视为不存活.
+func (h Health) Live(th HealthThresholds) bool {
+	th = th.withDefaults()
+	if !h.Running {
+		return false
+	}
+	if h.ConsecutiveReceiveErrors >= th.MaxReceiveErrors {
+		return false
+	}
+	if !h.OldestInFlight.IsZero() && time.Since(h.OldestInFlight) >= th.MaxHandlerAge {
+		return false
+	}
+	if h.Saturated {
+		// Handler 自己释放 LimitChan 时 handler 返回之后仍然可能占着并发额度
+		last := h.LastHandledTime
+		if last.IsZero() {
+			last = h.StartTime
+		}
+		return time.Since(last) < th.MaxHandlerAge
+	}
+	last := h.LastReceiveTime
+	if last.IsZero() {
+		last = h.StartTime
+	}
+	return h.Paused || time.Since(last) < th.MaxReceiveAge
+}
+
+// Ready 判断 consumer 是否正在正常拉取消息: 存活, 没有暂停, 最近一次接收没有失败.
+// 并发数已满是正常的负载状态, 不影响 Ready.
+func (h Health) Ready(th HealthThresholds) bool {
+	return h.Live(th) && !h.Paused && h.ConsecutiveReceiveErrors == 0
+}
+
+// HealthHandler 返回提供 /healthz 和 /readyz 的 http.Handler,
+// 检查通过返回 200, 否则返回 503, 响应体都是 JSON 格式的 Health.
+func (c *Consumer) HealthHandler(th HealthThresholds) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		h := c.Health()
+		writeHealth(w, h, h.Live(th))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		h := c.Health()
+		writeHealth(w, h, h.Ready(th))
+	})
+	return mux
+}
+
+func writeHealth(w http.ResponseWriter, v interface{}, ok bool) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,297 @@
+package consumer
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/wangping886/mns_consumer/logger"
+	"github.com/wangping886/mns_consumer/metrics"
+	"github.com/wangping886/mns_consumer/mns.aliyun"
+	"github.com/wangping886/mns_consumer/ratelimit"
+)
+
+const defaultDrainTimeout = 30 * time.Second
+
+// Manager 在一个进程里管理多个队列的 consumer: 共享 endpoint, AccessKey 和 http client,
+// 一起启动, 一起停止, 汇总健康状态, 还可以用 WithGlobalLimit 限制所有队列加起来的并发数.
+//
+//	m := consumer.NewManager(consumer.WithGlobalLimit(64), consumer.WithManagerMetrics(prom.New(nil)))
+//	m.RegisterFunc("queue-a", handleA, consumer.WithLimitSize(20))
+//	m.RegisterFunc("queue-b", handleB, consumer.WithDeadLetterQueue(m.QueueClient("queue-b-dlq"), 5))
+//	m.Start()
+//	defer m.Stop()
+type Manager struct {
+	endpoint        string
+	accessKeyId     string
+	accessKeySecret string
+	httpClient      *http.Client
+	globalLimit     chan bool
+	drainTimeout    time.Duration
+	options         []option
+	metrics         metrics.Metrics
+	apiLimiter      *ratelimit.Limiter
+	logger          logger.Logger
+
+	mu        sync.Mutex
+	consumers []*Consumer
+}
+
+type managerOption func(m *Manager)
+
+func NewManager(options ...managerOption) *Manager {
+	m := &Manager{
+		endpoint:        MNSEndPoint,
+		accessKeyId:     MNSAccessId,
+		accessKeySecret: MNSAccessKey,
+		httpClient:      __aliyunMnsQueueHttpClient,
+		drainTimeout:    defaultDrainTimeout,
+		metrics:         metrics.Nop,
+		logger:          logger.Std,
+	}
+	for _, o := range options {
+		o(m)
+	}
+	return m
+}
+
+// WithCredentials 设置所有队列共享的 endpoint 和 AccessKey, 默认是 MNSEndPoint, MNSAccessId 和 MNSAccessKey.
+func WithCredentials(endpoint, accessKeyId, accessKeySecret string) managerOption {
+	return func(m *Manager) {
+		m.endpoint = endpoint
+		m.accessKeyId = accessKeyId
+		m.accessKeySecret = accessKeySecret
+	}
+}
+
+// WithHttpClient 设置所有队列共享的 http client, 超时时间要大于长轮询的 20 秒.
+func WithHttpClient(clt *http.Client) managerOption {
+	return func(m *Manager) {
+		m.httpClient = clt
+	}
+}
+
+// WithGlobalLimit 设置所有队列同时执行的 handler 总数上限, 每个队列仍然受自己的 WithLimitSize 限制.
+func WithGlobalLimit(size int) managerOption {
+	return func(m *Manager) {
+		m.globalLimit = make(chan bool, size)
+	}
+}
+
+// WithDrainTimeout 设置 Stop 等待正在执行的 handler 结束的最长时间, 默认 30 秒.
+func WithDrainTimeout(d time.Duration) managerOption {
+	return func(m *Manager) {
+		m.drainTimeout = d
+	}
+}
+
+// WithManagerMetrics 设置所有 consumer 和 QueueClient 共享的指标收集器, 指标按 queue 标签区分.
+func WithManagerMetrics(mt metrics.Metrics) managerOption {
+	return func(m *Manager) {
+		m.metrics = mt
+	}
+}
+
+// WithApiRateLimit 设置所有 QueueClient 共享的 api 调用限流, 见 mns.QueueClient.Limiter.
+func WithApiRateLimit(l *ratelimit.Limiter) managerOption {
+	return func(m *Manager) {
+		m.apiLimiter = l
+	}
+}
+
+func WithManagerLogger(l logger.Logger) managerOption {
+	return func(m *Manager) {
+		m.logger = l
+	}
+}
+
+// WithConsumerOptions 设置所有 consumer 共同的 option, Register 时传入的 option 在它们之后生效.
+func WithConsumerOptions(options ...option) managerOption {
+	return func(m *Manager) {
+		m.options = append(m.options, options...)
+	}
+}
+
+// QueueClient 返回使用共享 endpoint, AccessKey 和 http client 的 QueueClient, 比如用作死信队列.
+func (m *Manager) QueueClient(queue string) *mns.QueueClient {
+	clt := &mns.QueueClient{
+		QueueURL:        m.endpoint + "/queues/" + queue,
+		AccessKeyId:     m.accessKeyId,
+		AccessKeySecret: m.accessKeySecret,
+		HttpClient:      m.httpClient,
+		Limiter:         m.apiLimiter,
+	}
+	if m.metrics != metrics.Nop {
+		clt.Observer = m.metrics
+	}
+	return clt
+}
+
+// Register 添加一个队列的 consumer, 必须在 Start 之前调用.
+func (m *Manager) Register(queue string, handler Handler, options ...option) *Consumer {
+	c := NewConsumer(queue, handler, m.consumerOptions(queue, options)...)
+	m.add(c)
+	return c
+}
+
+// RegisterFunc 和 Register 一样, handler 是 HandlerFunc.
+func (m *Manager) RegisterFunc(queue string, handler HandlerFunc, options ...option) *Consumer {
+	c := NewConsumerFunc(queue, handler, m.consumerOptions(queue, options)...)
+	m.add(c)
+	return c
+}
+
+func (m *Manager) consumerOptions(queue string, options []option) []option {
+	all := []option{
+		WithQueueClient(m.QueueClient(queue)),
+		WithMetrics(m.metrics),
+		WithLogger(m.logger),
+	}
+	all = append(all, m.options...)
+	all = append(all, options...)
+	return append(all, func(c *Consumer) {
+		c.globalLimit = m.globalLimit
+	})
+}
+
+func (m *Manager) add(c *Consumer) {
+	m.mu.Lock()
+	m.consumers = append(m.consumers, c)
+	m.mu.Unlock()
+}
+
+func (m *Manager) all() []*Consumer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*Consumer(nil), m.consumers...)
+}
+
+// Start 启动所有 consumer.
+func (m *Manager) Start() {
+	for _, c := range m.all() {
+		c.Start()
+	}
+	m.logger.Info("manager started", logger.F("queues", len(m.all())))
+}
+
+// Pause 暂停所有 consumer 拉取消息, 见 Consumer.Pause.
+func (m *Manager) Pause() {
+	for _, c := range m.all() {
+		c.Pause()
+	}
+}
+
+// Resume 恢复所有 consumer 拉取消息.
+func (m *Manager) Resume() {
+	for _, c := range m.all() {
+		c.Resume()
+	}
+}
+
+// Stop 同时停止所有 consumer 拉取消息, 然后最多等待 WithDrainTimeout 让正在执行的 handler 结束,
+// 超时后返回错误, 没有执行完的消息等可见时间过后由 MNS 重新投递.
+func (m *Manager) Stop() error {
+	consumers := m.all()
+	deadline := time.After(m.drainTimeout)
+
+	stopped := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, c := range consumers {
+			wg.Add(1)
+			go func(c *Consumer) {
+				defer wg.Done()
+				c.Stop()
+			}(c)
+		}
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-deadline:
+		return m.drainTimeoutErr("stop")
+	}
+
+	// consumer 停止之后不会再开始新的 handler goroutine
+	drained := make(chan struct{})
+	go func() {
+		for _, c := range consumers {
+			c.handlers.Wait()
+		}
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-deadline:
+		return m.drainTimeoutErr("drain")
+	}
+	m.logger.Info("manager stopped", logger.F("queues", len(consumers)))
+	return nil
+}
+
+func (m *Manager) drainTimeoutErr(stage string) error {
+	err := fmt.Errorf("%s timeout after %s, %d handlers still running", stage, m.drainTimeout, m.inFlight())
+	m.logger.Error("manager stop failed", logger.Err(err))
+	return err
+}
+
+func (m *Manager) inFlight() int {
+	n := 0
+	for _, c := range m.all() {
+		n += c.Health().InFlight
+	}
+	return n
+}
+
+// ManagerHealth 是所有 consumer 的健康状态.
+type ManagerHealth struct {
+	InFlight  int      `json:"in_flight"` // 所有队列正在执行的 handler 总数
+	Consumers []Health `json:"consumers"`
+}
+
+// Health 返回所有 consumer 的健康状态.
+func (m *Manager) Health() ManagerHealth {
+	var h ManagerHealth
+	for _, c := range m.all() {
+		ch := c.Health()
+		h.InFlight += ch.InFlight
+		h.Consumers = append(h.Consumers, ch)
+	}
+	return h
+}
+
+// Live 所有 consumer 都存活时返回 true.
+func (h ManagerHealth) Live(th HealthThresholds) bool {
+	for _, c := range h.Consumers {
+		if !c.Live(th) {
+			return false
+		}
+	}
+	return true
+}
+
+// Ready 所有 consumer 都就绪时返回 true.
+func (h ManagerHealth) Ready(th HealthThresholds) bool {
+	for _, c := range h.Consumers {
+		if !c.Ready(th) {
+			return false
+		}
+	}
+	return true
+}
+
+// HealthHandler 和 Consumer.HealthHandler 一样提供 /healthz 和 /readyz, 所有 consumer 都通过检查才返回 200.
+func (m *Manager) HealthHandler(th HealthThresholds) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		h := m.Health()
+		writeHealth(w, h, h.Live(th))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		h := m.Health()
+		writeHealth(w, h, h.Ready(th))
+	})
+	return mux
+}
@@ -0,0 +1,120 @@
+package consumer
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wangping886/mns_consumer/logger"
+	"github.com/wangping886/mns_consumer/mns.aliyun"
+)
+
+// concurrency 记录同时执行的 handler 数和出现过的最大值.
+type concurrency struct {
+	mu      sync.Mutex
+	running int
+	max     int
+}
+
+func (cc *concurrency) enter() {
+	cc.mu.Lock()
+	cc.running++
+	if cc.running > cc.max {
+		cc.max = cc.running
+	}
+	cc.mu.Unlock()
+}
+
+func (cc *concurrency) leave() {
+	cc.mu.Lock()
+	cc.running--
+	cc.mu.Unlock()
+}
+
+func (cc *concurrency) get() (running, max int) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.running, cc.max
+}
+
+func TestManagerGlobalLimit(t *testing.T) {
+	fake, endpoint := newFakeServer(t, 30*time.Second)
+	m := NewManager(WithCredentials(endpoint, "id", "secret"), WithGlobalLimit(3), WithManagerLogger(logger.Nop))
+
+	var cc concurrency
+	release := make(chan struct{})
+	handler := func(ctx context.Context, msg mns.Message) error {
+		cc.enter()
+		defer cc.leave()
+		<-release
+		return nil
+	}
+	for _, queue := range []string{"queue-a", "queue-b"} {
+		m.RegisterFunc(queue, handler, WithLimitSize(3))
+		sendMessages(t, m.QueueClient(queue), "1", "2", "3", "4")
+	}
+	m.Start()
+
+	waitFor(t, "global limit reached", func() bool {
+		running, _ := cc.get()
+		return running == 3
+	})
+	time.Sleep(100 * time.Millisecond)
+	if _, max := cc.get(); max != 3 {
+		t.Errorf("max concurrent handlers = %d, want the global limit 3", max)
+	}
+	if h := m.Health(); h.InFlight != 3 {
+		t.Errorf("Health().InFlight = %d, want 3", h.InFlight)
+	}
+
+	close(release)
+	waitFor(t, "all messages deleted", func() bool {
+		return fake.Len("queue-a") == 0 && fake.Len("queue-b") == 0
+	})
+	if err := m.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManagerStopDrain(t *testing.T) {
+	tests := []struct {
+		name    string
+		handle  time.Duration
+		wantErr bool
+	}{
+		{name: "handler finishes", handle: 100 * time.Millisecond},
+		{name: "drain timeout", handle: 2 * time.Second, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, endpoint := newFakeServer(t, 30*time.Second)
+			m := NewManager(WithCredentials(endpoint, "id", "secret"), WithDrainTimeout(500*time.Millisecond), WithManagerLogger(logger.Nop))
+
+			started := make(chan struct{}, 1)
+			m.RegisterFunc("queue", func(ctx context.Context, msg mns.Message) error {
+				started <- struct{}{}
+				time.Sleep(tt.handle)
+				return nil
+			}, WithLimitSize(1))
+			sendMessages(t, m.QueueClient("queue"), "1")
+			m.Start()
+			<-started
+
+			err := m.Stop()
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "1 handlers still running") {
+					t.Fatalf("Stop() = %v, want drain timeout with 1 running handler", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Stop() = %v", err)
+			}
+			if n := fake.Len("queue"); n != 0 {
+				t.Errorf("%d messages left after drain, want the handled message deleted", n)
+			}
+		})
+	}
+}
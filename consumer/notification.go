@@ -0,0 +1,64 @@
+package consumer
+
+import (
+	"context"
+
+	"github.com/wangping886/mns_consumer/logger"
+	"github.com/wangping886/mns_consumer/mns.aliyun"
+)
+
+type notificationKey struct{}
+
+// WithNotification 用于消费主题推送到队列(QueueEndpoint 订阅)的消息.
+// 这种消息的消息体是订阅 NotifyContentFormat 格式的 Notification, consumer 会自动解开,
+// handler 收到的 MessageBody 是发布到主题的原始消息, HandlerFunc 通过 NotificationFromContext,
+// Handler 和 BatchHandler 通过 Consumer.Notification 获取 TopicName, MessageTag, SubscriptionName, PublishTime 等属性.
+// 解析失败的消息不交给 handler 也不删除, 等可见时间过后重新投递, 可以配合 WithDeadLetterQueue 转移到死信队列.
+//  base64Decode: 要和发布者 PublishMessage2 的 base64Encode 保持一致.
+func WithNotification(base64Decode bool) option {
+	return func(c *Consumer) {
+		c.unwrapNotification = true
+		c.notificationBase64Decode = base64Decode
+	}
+}
+
+// NotificationFromContext 返回 WithNotification 解开的 Notification, 只对 HandlerFunc 有效.
+func NotificationFromContext(ctx context.Context) (*mns.Notification, bool) {
+	n, ok := ctx.Value(notificationKey{}).(*mns.Notification)
+	return n, ok
+}
+
+// Notification 返回 WithNotification 从 msg 解开的 Notification, 用于 Handler 和 BatchHandler:
+//
+//	c = consumer.NewConsumer(queName, func(c *consumer.Consumer, msg mns.Message) {
+//		n, _ := c.Notification(msg)
+//		...
+//	}, consumer.WithNotification(true))
+//
+// msg 是 handler 收到的消息, 只在 handler 返回之前有效.
+func (c *Consumer) Notification(msg mns.Message) (*mns.Notification, bool) {
+	n, ok := c.notifications.Load(msg.ReceiptHandle)
+	if !ok {
+		return nil, false
+	}
+	return n.(*mns.Notification), true
+}
+
+// unwrap 解开主题推送的 Notification, 调用方在 handler 返回之后调用 forgetNotification.
+func (c *Consumer) unwrap(ctx context.Context, msg mns.Message, requestId string) (context.Context, mns.Message, error) {
+	n, err := mns.ParseNotification2("", msg.MessageBody, c.notificationBase64Decode)
+	if err != nil {
+		c.logger.Error("parse notification failed, message left for redelivery", c.msgFields(msg, requestId, logger.F("dequeue_count", msg.DequeueCount), logger.Err(err))...)
+		return ctx, msg, err
+	}
+	if n.MessageId == "" {
+		n.MessageId = msg.MessageId
+	}
+	msg.MessageBody = n.Message
+	c.notifications.Store(msg.ReceiptHandle, n)
+	return context.WithValue(ctx, notificationKey{}, n), msg, nil
+}
+
+func (c *Consumer) forgetNotification(msg mns.Message) {
+	c.notifications.Delete(msg.ReceiptHandle)
+}
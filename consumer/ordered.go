@@ -0,0 +1,156 @@
+package consumer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/wangping886/mns_consumer/logger"
+	"github.com/wangping886/mns_consumer/mns.aliyun"
+)
+
+// WithOrderedKey 按 key 顺序处理消息: key 相同的消息按收到的顺序逐条交给 handler, 前一条处理完才开始下一条,
+// key 不同的消息仍然在 WithLimitSize 的并发数内并行处理. key 返回空字符串的消息不排队.
+// 消息开始排队时立即用 ChangeMessageVisibility 把可见时间延长到 visibility 之后, 之后每隔 visibility/2 再延长一次,
+// 避免等待期间被重新投递; visibility 应该不小于一条消息的处理时间, 按秒取整, 最少 1 秒.
+// 排队的消息不占用并发额度, 轮到它处理时再重新占用, 一个热点 key 不会占满额度让其他 key 饿死;
+// 每个 key 最多排队并发数(WithLimitSize)条消息, 超过的消息不处理, 等可见时间过后重新投递.
+// Handler 需要在返回之前处理完消息, 用于 NewConsumerBatch 时 panic.
+func WithOrderedKey(key func(msg mns.Message) string, visibility time.Duration) option {
+	return func(c *Consumer) {
+		c.ordered = &orderedQueue{
+			c:          c,
+			key:        key,
+			visibility: visibility,
+			pending:    make(map[string][]*waitingMsg),
+		}
+	}
+}
+
+// orderedQueue 为每个正在处理的 key 维护一个等待队列, key 在 pending 里表示这个 key 有消息正在处理.
+type orderedQueue struct {
+	c          *Consumer
+	key        func(msg mns.Message) string
+	visibility time.Duration
+
+	mu      sync.Mutex
+	pending map[string][]*waitingMsg
+}
+
+// waitingMsg 是排队等待的消息, 等待期间 ReceiptHandle 会随着延长可见时间变化, 只有 extend 修改 msg.
+type waitingMsg struct {
+	msg     queueMsg
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// dispatch 把消息交给对应 key 的队列, key 没有正在处理的消息时立即开始处理.
+func (o *orderedQueue) dispatch(qm queueMsg) {
+	key := o.key(qm.mnsMsg)
+	if key == "" {
+		o.c.handlers.Wrap(func() { o.c.handle(qm.mnsMsg, qm.requestId, qm.probe) })
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	queue, running := o.pending[key]
+	if !running {
+		o.pending[key] = nil
+		o.c.handlers.Wrap(func() { o.run(key, qm) })
+		return
+	}
+	if len(queue) >= cap(o.c.LimitChan) {
+		o.c.logger.Debug("too many messages waiting for key, message left invisible", o.c.msgFields(qm.mnsMsg, qm.requestId, logger.F("key", key))...)
+		o.c.breakerSkipped(qm.probe)
+		o.c.release(1)
+		return
+	}
+	w := &waitingMsg{
+		msg:     qm,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	o.pending[key] = append(queue, w)
+	go o.extend(w)
+	o.c.release(1) // 排队期间把并发额度让给其他 key, run 轮到它时重新占用
+	o.c.logger.Debug("message waiting for key", o.c.msgFields(qm.mnsMsg, qm.requestId, logger.F("key", key), logger.F("position", len(queue)+1))...)
+}
+
+// run 依次处理 key 的消息, 直到等待队列为空. consumer 停止时还在排队的消息不再处理, 等可见时间过后重新投递.
+func (o *orderedQueue) run(key string, qm queueMsg) {
+	ctx, cancel := o.c.dyingContext()
+	defer cancel()
+
+	for {
+		o.c.handle(qm.mnsMsg, qm.requestId, qm.probe)
+
+		o.mu.Lock()
+		queue := o.pending[key]
+		if len(queue) == 0 {
+			delete(o.pending, key)
+			o.mu.Unlock()
+			return
+		}
+		w := queue[0]
+		o.pending[key] = queue[1:]
+		o.mu.Unlock()
+
+		// 停止延长可见时间并等待正在进行的 ChangeMessageVisibility 返回, 之后 ReceiptHandle 不再变化
+		close(w.done)
+		<-w.stopped
+		qm = w.msg
+		if !o.c.acquire(ctx) {
+			o.abandon(key, qm)
+			return
+		}
+	}
+}
+
+// abandon 在 consumer 停止时放弃 key 还在排队的消息.
+func (o *orderedQueue) abandon(key string, qm queueMsg) {
+	o.mu.Lock()
+	queue := o.pending[key]
+	delete(o.pending, key)
+	o.mu.Unlock()
+
+	o.c.logger.Info("serve canceled", o.c.msgFields(qm.mnsMsg, qm.requestId, logger.F("key", key), logger.F("waiting", len(queue)))...)
+	o.c.breakerSkipped(qm.probe)
+	for _, w := range queue {
+		close(w.done)
+		<-w.stopped
+		o.c.breakerSkipped(w.msg.probe)
+	}
+}
+
+// extend 立即延长排队消息的可见时间, 之后定期延长, 直到轮到它处理.
+// 消息在排队之前可能已经在 queMsgChan 里等了一段时间, 剩余的可见时间不确定, 所以不能等到第一个 tick.
+func (o *orderedQueue) extend(w *waitingMsg) {
+	defer close(w.stopped)
+
+	seconds := int((o.visibility + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	every := time.Duration(seconds) * time.Second / 2
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+
+	for {
+		msg := w.msg.mnsMsg
+		requestId, resp, err := o.c.client.ChangeMessageVisibility(msg.ReceiptHandle, seconds)
+		if err != nil {
+			o.c.logger.Warn("change message visibility failed", o.c.msgFields(msg, errRequestId(err, requestId), logger.Err(err))...)
+		} else {
+			w.msg.mnsMsg.ReceiptHandle = resp.ReceiptHandle
+			w.msg.mnsMsg.NextVisibleTime = resp.NextVisibleTime
+			o.c.logger.Debug("message visibility extended", o.c.msgFields(msg, requestId, logger.F("visibility", seconds))...)
+		}
+
+		select {
+		case <-tick.C:
+		case <-w.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package consumer
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wangping886/mns_consumer/logger"
+	"github.com/wangping886/mns_consumer/mns.aliyun"
+)
+
+func bodyKey(msg mns.Message) string {
+	return strings.SplitN(string(msg.MessageBody), "-", 2)[0]
+}
+
+// TestOrderedHotKeyDoesNotStarve 检查热点 key 排队的消息不占用并发额度, 其他 key 的消息不会被饿死,
+// 排队期间延长可见时间, 轮到处理时使用新的 ReceiptHandle 删除.
+func TestOrderedHotKeyDoesNotStarve(t *testing.T) {
+	fake, clt := newFakeQueue(t, "orders", 30*time.Second)
+	sendMessages(t, clt, "hot-1", "hot-2", "hot-3", "cold-1")
+
+	var (
+		mu         sync.Mutex
+		hotOrder   []string
+		hotRunning int
+		overlap    bool
+	)
+	release := make(chan struct{})
+	coldDone := make(chan struct{})
+	handler := func(ctx context.Context, msg mns.Message) error {
+		if bodyKey(msg) == "cold" {
+			close(coldDone)
+			return nil
+		}
+		mu.Lock()
+		hotOrder = append(hotOrder, string(msg.MessageBody))
+		hotRunning++
+		overlap = overlap || hotRunning > 1
+		mu.Unlock()
+
+		<-release
+		mu.Lock()
+		hotRunning--
+		mu.Unlock()
+		return nil
+	}
+	c := NewConsumerFunc("orders", handler, WithQueueClient(clt), WithLimitSize(2), WithChanSize(4),
+		WithOrderedKey(bodyKey, time.Second), WithLogger(logger.Nop))
+	c.Start()
+	defer c.Stop()
+
+	select {
+	case <-coldDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("cold key starved by the hot key")
+	}
+	if n := fake.Calls("ChangeMessageVisibility"); n < 2 {
+		t.Errorf("ChangeMessageVisibility calls = %d, want the waiting hot messages extended", n)
+	}
+
+	close(release)
+	waitFor(t, "all messages deleted", func() bool { return fake.Len("orders") == 0 })
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(hotOrder, ",") != "hot-1,hot-2,hot-3" {
+		t.Errorf("hot key handled in order %v, want hot-1,hot-2,hot-3", hotOrder)
+	}
+	if overlap {
+		t.Error("messages of the same key handled concurrently")
+	}
+}
+
+// TestOrderedExtendsVisibility 检查排队时间超过队列可见时间的消息不会被重新投递.
+func TestOrderedExtendsVisibility(t *testing.T) {
+	fake, clt := newFakeQueue(t, "orders", time.Second)
+	sendMessages(t, clt, "k-1", "k-2", "k-3", "k-4")
+
+	var (
+		mu      sync.Mutex
+		handled []string
+	)
+	c := NewConsumerFunc("orders", func(ctx context.Context, msg mns.Message) error {
+		time.Sleep(400 * time.Millisecond)
+		mu.Lock()
+		handled = append(handled, string(msg.MessageBody))
+		mu.Unlock()
+		return nil
+	}, WithQueueClient(clt), WithLimitSize(4), WithChanSize(4), WithOrderedKey(bodyKey, 2*time.Second), WithLogger(logger.Nop))
+	c.Start()
+	defer c.Stop()
+
+	waitFor(t, "all messages deleted", func() bool { return fake.Len("orders") == 0 })
+	// 重新投递的消息会在删除之后再被处理一次
+	time.Sleep(300 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(handled, ",") != "k-1,k-2,k-3,k-4" {
+		t.Errorf("handled %v, want each message once in order", handled)
+	}
+	if n := fake.Calls("ChangeMessageVisibility"); n < 3 {
+		t.Errorf("ChangeMessageVisibility called %d times, want the waiting messages extended", n)
+	}
+}
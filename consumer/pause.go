@@ -0,0 +1,159 @@
+package consumer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/wangping886/mns_consumer/logger"
+)
+
+// 暂停拉取消息的原因, 见 Health.PauseReason.
+const (
+	PauseManual      = "manual"       // 调用了 Pause
+	PauseDownstream  = "downstream"   // WithDownstreamCheck 的检查失败
+	PauseCircuitOpen = "circuit_open" // WithCircuitBreaker 的熔断打开
+)
+
+// pauseState 记录手动暂停, 下游检查失败和熔断导致的暂停, 任意一个为 true 时 serve 不再拉取消息.
+type pauseState struct {
+	mu      sync.Mutex
+	manual  bool
+	auto    bool
+	breaker bool
+	changed chan struct{} // 状态变化时关闭并重新创建
+}
+
+// set 修改暂停状态, 返回修改之后是否暂停.
+func (p *pauseState) set(update func(p *pauseState)) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	update(p)
+	if p.changed != nil {
+		close(p.changed)
+		p.changed = nil
+	}
+	return p.manual || p.auto || p.breaker
+}
+
+// state 返回当前是否暂停和等待状态变化的 channel.
+func (p *pauseState) state() (paused bool, changed <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.changed == nil {
+		p.changed = make(chan struct{})
+	}
+	return p.manual || p.auto || p.breaker, p.changed
+}
+
+func (p *pauseState) reason() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch {
+	case p.manual:
+		return PauseManual
+	case p.auto:
+		return PauseDownstream
+	case p.breaker:
+		return PauseCircuitOpen
+	}
+	return ""
+}
+
+// wait 等待恢复, ctx 取消时返回 false.
+func (p *pauseState) wait(ctx context.Context) bool {
+	for {
+		paused, changed := p.state()
+		if !paused {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// receiveContext 返回在暂停时取消的 ctx, 用来打断正在进行的长轮询.
+func (p *pauseState) receiveContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		for {
+			paused, changed := p.state()
+			if paused {
+				cancel()
+				return
+			}
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ctx, cancel
+}
+
+// Pause 暂停拉取消息, 正在进行的长轮询会被取消, 已经收到的消息和正在执行的 handler 不受影响.
+// 用于下游维护期间临时停止消费而不停止进程, Health 的 Paused 为 true, Ready 检查不通过.
+func (c *Consumer) Pause() {
+	c.pause.set(func(p *pauseState) { p.manual = true })
+	c.logger.Info("consumer paused", logger.F("queue", c.queName))
+}
+
+// Resume 恢复 Pause 暂停的拉取; 下游检查仍然失败时要等检查通过才会恢复.
+func (c *Consumer) Resume() {
+	paused := c.pause.set(func(p *pauseState) { p.manual = false })
+	c.logger.Info("consumer resumed", logger.F("queue", c.queName), logger.F("still_paused", paused))
+}
+
+// Paused 返回是否暂停了拉取: 调用了 Pause, 下游检查失败或者熔断打开, 原因见 Health.PauseReason.
+func (c *Consumer) Paused() bool {
+	paused, _ := c.pause.state()
+	return paused
+}
+
+// WithDownstreamCheck 设置下游健康检查, 每隔 interval 调用一次 check, 超时时间也是 interval.
+// 第一次检查在第一次拉取之前完成; check 返回错误时自动暂停拉取消息, 下一次检查通过后自动恢复.
+func WithDownstreamCheck(check func(ctx context.Context) error, interval time.Duration) option {
+	return func(c *Consumer) {
+		c.downstreamCheck = check
+		c.checkInterval = interval
+	}
+}
+
+func (c *Consumer) checkDownstream() {
+	tick := time.NewTicker(c.checkInterval)
+	defer tick.Stop()
+
+	for first := true; ; first = false {
+		ctx, cancel := context.WithTimeout(context.Background(), c.checkInterval)
+		err := c.downstreamCheck(ctx)
+		cancel()
+
+		c.pause.mu.Lock()
+		wasPaused := c.pause.auto
+		c.pause.mu.Unlock()
+		if failed := err != nil; failed != wasPaused {
+			c.pause.set(func(p *pauseState) { p.auto = failed })
+			if failed {
+				c.logger.Warn("downstream check failed, consumer paused", logger.F("queue", c.queName), logger.Err(err))
+			} else {
+				c.logger.Info("downstream recovered, consumer resumed", logger.F("queue", c.queName))
+			}
+		}
+		if first {
+			close(c.firstCheck)
+		}
+
+		select {
+		case <-tick.C:
+		case <-c.t.Dying():
+			return
+		}
+	}
+}
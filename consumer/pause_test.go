@@ -0,0 +1,120 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wangping886/mns_consumer/logger"
+	"github.com/wangping886/mns_consumer/mns.aliyun"
+)
+
+func TestReceiveContextCanceledOnPause(t *testing.T) {
+	var p pauseState
+	ctx, cancel := p.receiveContext(context.Background())
+	defer cancel()
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("receive context canceled while not paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	p.set(func(p *pauseState) { p.breaker = true })
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("receive context not canceled after pause")
+	}
+
+	paused, _ := p.state()
+	if !paused || p.reason() != PauseCircuitOpen {
+		t.Errorf("state = %v, %q, want paused by %q", paused, p.reason(), PauseCircuitOpen)
+	}
+
+	// 已经暂停时创建的 ctx 马上取消
+	ctx, cancel = p.receiveContext(context.Background())
+	defer cancel()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("receive context created while paused not canceled")
+	}
+}
+
+func TestPauseAndResume(t *testing.T) {
+	fake, clt := newFakeQueue(t, "pause", 30*time.Second)
+	handled := make(chan string, 1)
+	c := NewConsumerFunc("pause", func(ctx context.Context, msg mns.Message) error {
+		handled <- string(msg.MessageBody)
+		return nil
+	}, WithQueueClient(clt), WithLimitSize(1), WithLogger(logger.Nop))
+	c.Start()
+	defer c.Stop()
+
+	waitFor(t, "first receive", func() bool { return fake.Calls("BatchReceiveMessage") > 0 })
+	c.Pause()
+	if h := c.Health(); !c.Paused() || h.PauseReason != PauseManual {
+		t.Fatalf("Paused() = %v, PauseReason = %q, want paused by %q", c.Paused(), h.PauseReason, PauseManual)
+	}
+
+	// 暂停之前开始的长轮询已经取消, 暂停期间发送的消息不会被收到
+	time.Sleep(50 * time.Millisecond)
+	sendMessages(t, clt, "after-pause")
+	select {
+	case body := <-handled:
+		t.Fatalf("handled %q while paused", body)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	c.Resume()
+	select {
+	case body := <-handled:
+		if body != "after-pause" {
+			t.Errorf("handled %q, want after-pause", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not handled after Resume")
+	}
+	if c.Paused() {
+		t.Error("still paused after Resume")
+	}
+}
+
+func TestDownstreamCheckBeforeFirstReceive(t *testing.T) {
+	fake, clt := newFakeQueue(t, "downstream", 30*time.Second)
+	sendMessages(t, clt, "1")
+
+	var healthy, checks int32
+	handled := make(chan struct{}, 1)
+	c := NewConsumerFunc("downstream", func(ctx context.Context, msg mns.Message) error {
+		handled <- struct{}{}
+		return nil
+	}, WithQueueClient(clt), WithLimitSize(1), WithLogger(logger.Nop),
+		WithDownstreamCheck(func(ctx context.Context) error {
+			atomic.AddInt32(&checks, 1)
+			if atomic.LoadInt32(&healthy) == 0 {
+				return errors.New("downstream unavailable")
+			}
+			return nil
+		}, 50*time.Millisecond))
+	c.Start()
+	defer c.Stop()
+
+	waitFor(t, "downstream checks", func() bool { return atomic.LoadInt32(&checks) >= 3 })
+	if n := fake.Calls("BatchReceiveMessage"); n != 0 {
+		t.Fatalf("BatchReceiveMessage called %d times while the downstream check fails", n)
+	}
+	if h := c.Health(); h.PauseReason != PauseDownstream {
+		t.Errorf("PauseReason = %q, want %q", h.PauseReason, PauseDownstream)
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not handled after the downstream check passed")
+	}
+}
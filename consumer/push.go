@@ -0,0 +1,153 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/wangping886/mns_consumer/logger"
+	"github.com/wangping886/mns_consumer/mns.aliyun"
+	"github.com/wangping886/mns_consumer/tracing"
+)
+
+const defaultPushMaxBodySize = 1 << 20
+
+// PushHandler 处理一条主题推送过来的消息通知.
+// 返回 nil 时响应 204, MNS 认为推送成功; 返回错误时响应 500, MNS 会按订阅的重试策略重新推送.
+type PushHandler func(ctx context.Context, n *mns.Notification) error
+
+// PushReceiver 是接收 MNS 主题推送(HttpEndpoint 订阅)的 http.Handler,
+// 负责读取请求体, 验证签名, 解析 XML, JSON 或 SIMPLIFIED 格式的通知, 然后交给 PushHandler.
+//
+//	http.Handle("/mns/notify", consumer.NewPushReceiver(handler))
+type PushReceiver struct {
+	handler      PushHandler
+	verify       bool
+	verifier     *mns.NotificationVerifier
+	base64Decode bool
+	maxBodySize  int64
+	logger       logger.Logger
+	tracer       tracing.Tracer
+}
+
+type pushOption func(r *PushReceiver)
+
+func NewPushReceiver(handler PushHandler, options ...pushOption) *PushReceiver {
+	r := &PushReceiver{
+		handler:      handler,
+		verify:       true,
+		base64Decode: true,
+		verifier:     &mns.NotificationVerifier{},
+		maxBodySize:  defaultPushMaxBodySize,
+		logger:       logger.Std,
+		tracer:       tracing.Nop,
+	}
+	for _, o := range options {
+		o(r)
+	}
+	return r
+}
+
+// WithoutPushVerify 不验证通知的签名, 只应该在已经由网关验证过来源的情况下使用.
+func WithoutPushVerify() pushOption {
+	return func(r *PushReceiver) {
+		r.verify = false
+	}
+}
+
+// WithPushVerifier 设置验证签名使用的 NotificationVerifier, 比如允许的证书 host 和防重放时间窗口.
+// 默认的 NotificationVerifier 只允许 mns.DefaultCertHosts.
+func WithPushVerifier(v *mns.NotificationVerifier) pushOption {
+	return func(r *PushReceiver) {
+		r.verifier = v
+	}
+}
+
+// WithPushBase64Decode 设置是否对消息做 base64 解码, 要和发布者 PublishMessage2 的 base64Encode 保持一致,
+// 默认解码, 和 PublishMessage, mns.ParseNotification 一致.
+func WithPushBase64Decode(base64Decode bool) pushOption {
+	return func(r *PushReceiver) {
+		r.base64Decode = base64Decode
+	}
+}
+
+// WithPushMaxBodySize 设置请求体的最大字节数, 默认 1MB.
+func WithPushMaxBodySize(n int64) pushOption {
+	return func(r *PushReceiver) {
+		r.maxBodySize = n
+	}
+}
+
+func WithPushLogger(l logger.Logger) pushOption {
+	return func(r *PushReceiver) {
+		r.logger = l
+	}
+}
+
+// WithPushTracer 和 WithTracer 一样, 以信封里的 trace 上下文为 parent 开始 span 包住 handler.
+func WithPushTracer(t tracing.Tracer) pushOption {
+	return func(r *PushReceiver) {
+		r.tracer = t
+	}
+}
+
+func (r *PushReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	requestId := req.Header.Get("X-Mns-Request-Id")
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, r.maxBodySize))
+	if err != nil {
+		r.logger.Warn("read notification failed", logger.F("request_id", requestId), logger.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if r.verify {
+		ok, err := r.verifier.Verify(req, body)
+		if err != nil || !ok {
+			if err == nil {
+				err = errors.New("signature mismatch")
+			}
+			r.logger.Warn("verify notification failed", logger.F("request_id", requestId), logger.Err(err))
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
+	n, err := mns.ParseNotification2(req.Header.Get("Content-Type"), body, r.base64Decode)
+	if err != nil {
+		r.logger.Warn("parse notification failed", logger.F("request_id", requestId), logger.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if n.Format == mns.NotifyContentFormatSIMPLIFIED {
+		// SIMPLIFIED 格式的 body 只有消息本身, 尽量从请求头补充消息属性
+		n.MessageId = req.Header.Get("X-Mns-Message-Id")
+		n.MessageTag = req.Header.Get("X-Mns-Message-Tag")
+	}
+
+	fields := []logger.Field{
+		logger.F("topic", n.TopicName),
+		logger.F("subscription", n.SubscriptionName),
+		logger.F("message_id", n.MessageId),
+		logger.F("request_id", requestId),
+	}
+
+	headers, message, _ := tracing.Open(n.Message)
+	n.Message = message
+	ctx, endSpan := r.tracer.StartSpan(req.Context(), "mns.push "+n.TopicName, headers)
+	err = r.handler(ctx, n)
+	endSpan(err)
+	if err != nil {
+		r.logger.Warn("handle notification failed", append(fields, logger.Err(err))...)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	r.logger.Debug("notification handled", fields...)
+	w.WriteHeader(http.StatusNoContent)
+}
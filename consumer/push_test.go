@@ -0,0 +1,188 @@
+package consumer
+
+import (
+	"context"
+	"crypto"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wangping886/mns_consumer/logger"
+	"github.com/wangping886/mns_consumer/mns.aliyun"
+)
+
+// pushSigner 用测试私钥模拟 MNS 签名推送请求, 证书由 httptest server 提供.
+type pushSigner struct {
+	key  *rsa.PrivateKey
+	cert *httptest.Server
+}
+
+func newPushSigner(t *testing.T) *pushSigner {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mns test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	cert := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(certPEM)
+	}))
+	t.Cleanup(cert.Close)
+	return &pushSigner{key: key, cert: cert}
+}
+
+func (s *pushSigner) verifier(hosts ...string) *mns.NotificationVerifier {
+	if len(hosts) == 0 {
+		hosts = []string{strings.TrimPrefix(s.cert.URL, "http://")}
+	}
+	return &mns.NotificationVerifier{AllowedHosts: hosts, AllowHTTP: true}
+}
+
+// request 构造 MNS 推送的 XML 通知请求并签名.
+func (s *pushSigner) request(t *testing.T, message string, date time.Time) *http.Request {
+	encoded := base64.StdEncoding.EncodeToString([]byte(message))
+	body := fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>`+
+		`<Notification xmlns="http://mns.aliyuncs.com/doc/v1/">`+
+		`<TopicOwner>1692545896541241</TopicOwner><TopicName>MyTopic</TopicName>`+
+		`<Subscriber>1692545896541241</Subscriber><SubscriptionName>MySubscription</SubscriptionName>`+
+		`<MessageId>C39FB8C345BBFBA8-1-1687F6FAADD-200000015</MessageId>`+
+		`<MessageMD5>%X</MessageMD5><Message>%s</Message><PublishTime>1548319136733</PublishTime>`+
+		`</Notification>`, md5.Sum([]byte(encoded)), encoded)
+
+	req := httptest.NewRequest(http.MethodPost, "/notify", strings.NewReader(body))
+	sum := md5.Sum([]byte(body))
+	req.Header.Set("Content-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+	req.Header.Set("Content-Type", "text/xml;charset=utf-8")
+	req.Header.Set("Date", date.UTC().Format(http.TimeFormat))
+	req.Header.Set("X-Mns-Request-Id", "5C4961A0B5E3F8A0F9D3A7B5")
+	req.Header.Set("X-Mns-Signing-Cert-Url", base64.StdEncoding.EncodeToString([]byte(s.cert.URL+"/x509_public_certificate.pem")))
+
+	// VERB\nCONTENT-MD5\nCONTENT-TYPE\nDATE\nCanonicalizedMNSHeaders + CanonicalizedResource
+	var mnsHeaders []string
+	for k := range req.Header {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-mns-") {
+			mnsHeaders = append(mnsHeaders, k+":"+req.Header.Get(k)+"\n")
+		}
+	}
+	sort.Strings(mnsHeaders)
+	signStr := req.Method + "\n" + req.Header.Get("Content-Md5") + "\n" + req.Header.Get("Content-Type") + "\n" +
+		req.Header.Get("Date") + "\n" + strings.Join(mnsHeaders, "") + req.RequestURI
+	digest := sha1.Sum([]byte(signStr))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA1, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", base64.StdEncoding.EncodeToString(sig))
+	return req
+}
+
+func TestPushReceiver(t *testing.T) {
+	signer := newPushSigner(t)
+
+	tests := []struct {
+		name       string
+		options    []pushOption
+		req        func() *http.Request
+		handlerErr error
+		wantStatus int
+		wantMsg    string
+	}{
+		{
+			name:       "handled",
+			options:    []pushOption{WithPushVerifier(signer.verifier())},
+			req:        func() *http.Request { return signer.request(t, "hello", time.Now()) },
+			wantStatus: http.StatusNoContent,
+			wantMsg:    "hello",
+		},
+		{
+			name:       "handler failure asks for redelivery",
+			options:    []pushOption{WithPushVerifier(signer.verifier())},
+			req:        func() *http.Request { return signer.request(t, "hello", time.Now()) },
+			handlerErr: errors.New("downstream unavailable"),
+			wantStatus: http.StatusInternalServerError,
+			wantMsg:    "hello",
+		},
+		{
+			name:       "cert host not allowed",
+			options:    []pushOption{WithPushVerifier(signer.verifier("mns.example.com"))},
+			req:        func() *http.Request { return signer.request(t, "hello", time.Now()) },
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:    "invalid signature",
+			options: []pushOption{WithPushVerifier(signer.verifier())},
+			req: func() *http.Request {
+				req := signer.request(t, "hello", time.Now())
+				req.Header.Set("Authorization", base64.StdEncoding.EncodeToString([]byte("forged")))
+				return req
+			},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "date outside replay window",
+			options:    []pushOption{WithPushVerifier(signer.verifier())},
+			req:        func() *http.Request { return signer.request(t, "hello", time.Now().Add(-time.Hour)) },
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "verification disabled",
+			options:    []pushOption{WithoutPushVerify()},
+			req:        func() *http.Request { return signer.request(t, "hello", time.Now().Add(-time.Hour)) },
+			wantStatus: http.StatusNoContent,
+			wantMsg:    "hello",
+		},
+		{
+			name:       "not a POST",
+			req:        func() *http.Request { return httptest.NewRequest(http.MethodGet, "/notify", nil) },
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *mns.Notification
+			handler := func(ctx context.Context, n *mns.Notification) error {
+				got = n
+				return tt.handlerErr
+			}
+			r := NewPushReceiver(handler, append(tt.options, WithPushLogger(logger.Nop))...)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, tt.req())
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantMsg == "" {
+				if got != nil {
+					t.Fatalf("handler called with %+v, want not called", got)
+				}
+				return
+			}
+			if got == nil || string(got.Message) != tt.wantMsg || got.TopicName != "MyTopic" {
+				t.Fatalf("handler got %+v, want message %q from MyTopic", got, tt.wantMsg)
+			}
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package consumer
+
+import (
+	"context"
+	"time"
+
+	"github.com/wangping886/mns_consumer/mns.aliyun"
+	"github.com/wangping886/mns_consumer/source"
+)
+
+// SourceHandler 把 source.Handler 转换成 HandlerFunc, 同一个 handler 可以通过 kafka.SourceHandler 消费 kafka topic.
+// source.Message 的 Key 和 Headers 来自消息信封, Raw 返回 mns.Message.
+func SourceHandler(h source.Handler) HandlerFunc {
+	return func(ctx context.Context, msg mns.Message) error {
+		m := source.NewMessage(msg)
+		m.ID = msg.MessageId
+		m.Body = msg.MessageBody
+		m.Headers, _ = HeadersFromContext(ctx)
+		if key, ok := m.Headers[source.HeaderKey]; ok {
+			m.Key = []byte(key)
+		}
+		m.Timestamp = time.Unix(0, msg.EnqueueTime*int64(time.Millisecond))
+		m.Attempt = int(msg.DequeueCount)
+		return h(ctx, m)
+	}
+}
@@ -0,0 +1,358 @@
+// Package mnsfake 是进程内的 MNS 队列模拟服务, 供压测工具和测试使用.
+package mnsfake
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wangping886/mns_consumer/mns.aliyun"
+)
+
+// Server 是一个进程内的 MNS 队列模拟服务, 只实现压测和测试需要的接口:
+// (批量)发送消息, (批量)接收消息, (批量)删除消息和修改消息可见时间.
+// 不校验签名, 每个 /queues/$QueueName 路径对应一个独立的队列.
+//
+//	srv := httptest.NewServer(mnsfake.NewServer(30 * time.Second))
+//	clt := &mns.QueueClient{QueueURL: srv.URL + "/queues/test"}
+type Server struct {
+	visibility time.Duration // 消息被接收后的不可见时间, 超时未删除会被重新投递
+
+	mu     sync.Mutex
+	queues map[string]*queue
+	calls  map[string]int // api 名称 -> 调用次数
+}
+
+func NewServer(visibility time.Duration) *Server {
+	return &Server{
+		visibility: visibility,
+		queues:     make(map[string]*queue),
+		calls:      make(map[string]int),
+	}
+}
+
+// Calls 返回 api 被调用的次数, operation 是 api 名称, 比如 BatchDeleteMessage, ChangeMessageVisibility.
+func (s *Server) Calls(operation string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[operation]
+}
+
+// Len 返回队列里还没有删除的消息数, 包含处于不可见状态的消息.
+func (s *Server) Len(queueName string) int {
+	q := s.queueOf("/queues/" + queueName)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := 0
+	for _, m := range q.pending {
+		if !m.deleted {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Server) count(operation string) {
+	s.mu.Lock()
+	s.calls[operation]++
+	s.mu.Unlock()
+}
+
+type message struct {
+	mns.Message
+	deleted bool
+}
+
+type queue struct {
+	mu      sync.Mutex
+	seq     int64
+	pending []*message          // 按入队顺序排列, 包含处于不可见状态的消息
+	handles map[string]*message // ReceiptHandle -> message
+	notify  chan struct{}       // 有新消息入队时关闭并重建, 用于唤醒长轮询
+}
+
+func (s *Server) queueOf(path string) *queue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := s.queues[path]
+	if q == nil {
+		q = &queue{
+			handles: make(map[string]*message),
+			notify:  make(chan struct{}),
+		}
+		s.queues[path] = q
+	}
+	return q
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasSuffix(r.URL.Path, "/messages") {
+		writeError(w, http.StatusNotFound, "QueueNotExist", "unsupported resource")
+		return
+	}
+	q := s.queueOf(strings.TrimSuffix(r.URL.Path, "/messages"))
+	query := r.URL.Query()
+
+	switch r.Method {
+	case http.MethodPost:
+		s.send(w, r, q)
+	case http.MethodGet:
+		numOfMessages := 1
+		if v := query.Get("numOfMessages"); v != "" {
+			numOfMessages, _ = strconv.Atoi(v)
+		}
+		waitSeconds, _ := strconv.Atoi(query.Get("waitseconds"))
+		s.receive(w, r, q, numOfMessages, time.Duration(waitSeconds)*time.Second, query.Get("numOfMessages") != "")
+	case http.MethodDelete:
+		s.delete(w, r, q, query.Get("ReceiptHandle"))
+	case http.MethodPut:
+		visibilityTimeout, _ := strconv.Atoi(query.Get("visibilityTimeout"))
+		s.changeVisibility(w, q, query.Get("receiptHandle"), time.Duration(visibilityTimeout)*time.Second)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "InvalidArgument", "unsupported method")
+	}
+}
+
+func (s *Server) send(w http.ResponseWriter, r *http.Request, q *queue) {
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(r.Body); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", err.Error())
+		return
+	}
+
+	var msgs []mns.MessageToSend
+	batch := bytes.Contains(buf.Bytes(), []byte("<Messages>"))
+	if batch {
+		var req struct {
+			XMLName  struct{}            `xml:"Messages"`
+			Messages []mns.MessageToSend `xml:"Message"`
+		}
+		if err := xml.Unmarshal(buf.Bytes(), &req); err != nil {
+			writeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+			return
+		}
+		msgs = req.Messages
+		s.count("BatchSendMessage")
+	} else {
+		var req mns.MessageToSend
+		if err := xml.Unmarshal(buf.Bytes(), &req); err != nil {
+			writeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+			return
+		}
+		msgs = []mns.MessageToSend{req}
+		s.count("SendMessage")
+	}
+
+	now := time.Now()
+	resp := make([]mns.BatchSendMessageResponseItem, len(msgs))
+
+	q.mu.Lock()
+	for i := 0; i < len(msgs); i++ {
+		q.seq++
+		m := &message{Message: mns.Message{
+			MessageId:       strconv.FormatInt(q.seq, 16),
+			MessageBody:     msgs[i].MessageBody,
+			MessageBodyMD5:  bodyMD5(msgs[i].MessageBody),
+			EnqueueTime:     now.UnixNano() / int64(time.Millisecond),
+			NextVisibleTime: now.Add(time.Duration(msgs[i].DelaySeconds)*time.Second).UnixNano() / int64(time.Millisecond),
+			Priority:        msgs[i].Priority,
+		}}
+		q.pending = append(q.pending, m)
+		resp[i].MessageId = m.MessageId
+		resp[i].MessageBodyMD5 = m.MessageBodyMD5
+	}
+	close(q.notify)
+	q.notify = make(chan struct{})
+	q.mu.Unlock()
+
+	if batch {
+		writeXML(w, http.StatusCreated, struct {
+			XMLName  struct{}                           `xml:"Messages"`
+			Messages []mns.BatchSendMessageResponseItem `xml:"Message"`
+		}{Messages: resp})
+		return
+	}
+	writeXML(w, http.StatusCreated, resp[0])
+}
+
+func (s *Server) receive(w http.ResponseWriter, r *http.Request, q *queue, numOfMessages int, wait time.Duration, batch bool) {
+	if batch {
+		s.count("BatchReceiveMessage")
+	} else {
+		s.count("ReceiveMessage")
+	}
+	if numOfMessages < 1 || numOfMessages > 16 {
+		numOfMessages = 16
+	}
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+
+	for {
+		msgs, notify := q.take(numOfMessages, s.visibility)
+		if len(msgs) > 0 {
+			if batch {
+				writeXML(w, http.StatusOK, struct {
+					XMLName  struct{}      `xml:"Messages"`
+					Messages []mns.Message `xml:"Message"`
+				}{Messages: msgs})
+				return
+			}
+			writeXML(w, http.StatusOK, msgs[0])
+			return
+		}
+
+		// 没有可见消息, 等待新消息入队或者不可见消息超时
+		select {
+		case <-notify:
+		case <-time.After(100 * time.Millisecond):
+		case <-deadline.C:
+			writeError(w, http.StatusNotFound, "MessageNotExist", "Message not exist.")
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// take 取出最多 n 条当前可见的消息, 并把它们设置为不可见.
+func (q *queue) take(n int, visibility time.Duration) (msgs []mns.Message, notify <-chan struct{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// 清理队头已经删除的消息
+	for len(q.pending) > 0 && q.pending[0].deleted {
+		q.pending[0] = nil
+		q.pending = q.pending[1:]
+	}
+
+	now := time.Now()
+	nowMillis := now.UnixNano() / int64(time.Millisecond)
+	for _, m := range q.pending {
+		if len(msgs) >= n {
+			break
+		}
+		if m.deleted || m.NextVisibleTime > nowMillis {
+			continue
+		}
+		if m.ReceiptHandle != "" {
+			delete(q.handles, m.ReceiptHandle)
+		}
+		q.seq++
+		m.ReceiptHandle = m.MessageId + "-" + strconv.FormatInt(q.seq, 16)
+		m.DequeueCount++
+		if m.FirstDequeueTime == 0 {
+			m.FirstDequeueTime = nowMillis
+		}
+		m.NextVisibleTime = now.Add(visibility).UnixNano() / int64(time.Millisecond)
+		q.handles[m.ReceiptHandle] = m
+		msgs = append(msgs, m.Message)
+	}
+	return msgs, q.notify
+}
+
+func (s *Server) delete(w http.ResponseWriter, r *http.Request, q *queue, receiptHandle string) {
+	receiptHandles := []string{receiptHandle}
+	if receiptHandle == "" {
+		s.count("BatchDeleteMessage")
+		var req struct {
+			XMLName        struct{} `xml:"ReceiptHandles"`
+			ReceiptHandles []string `xml:"ReceiptHandle"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+			return
+		}
+		receiptHandles = req.ReceiptHandles
+	} else {
+		s.count("DeleteMessage")
+	}
+
+	var errs []mns.BatchDeleteMessageErrorItem
+	q.mu.Lock()
+	for _, h := range receiptHandles {
+		m := q.handles[h]
+		if m == nil {
+			errs = append(errs, mns.BatchDeleteMessageErrorItem{
+				ErrorCode:     "ReceiptHandleError",
+				ErrorMessage:  "The receipt handle you provide is not valid.",
+				ReceiptHandle: h,
+			})
+			continue
+		}
+		delete(q.handles, h)
+		m.deleted = true
+	}
+	q.mu.Unlock()
+
+	switch {
+	case len(errs) == 0:
+		w.Header().Set("X-Mns-Request-Id", "fake")
+		w.WriteHeader(http.StatusNoContent)
+	case receiptHandle != "":
+		writeError(w, http.StatusNotFound, errs[0].ErrorCode, errs[0].ErrorMessage)
+	default:
+		writeXML(w, http.StatusNotFound, struct {
+			XMLName struct{}                          `xml:"Errors"`
+			Errors  []mns.BatchDeleteMessageErrorItem `xml:"Error"`
+		}{Errors: errs})
+	}
+}
+
+func (s *Server) changeVisibility(w http.ResponseWriter, q *queue, receiptHandle string, visibilityTimeout time.Duration) {
+	s.count("ChangeMessageVisibility")
+	q.mu.Lock()
+	m := q.handles[receiptHandle]
+	if m == nil {
+		q.mu.Unlock()
+		writeError(w, http.StatusNotFound, "MessageNotExist", "Message not exist.")
+		return
+	}
+	delete(q.handles, receiptHandle)
+	q.seq++
+	m.ReceiptHandle = m.MessageId + "-" + strconv.FormatInt(q.seq, 16)
+	m.NextVisibleTime = time.Now().Add(visibilityTimeout).UnixNano() / int64(time.Millisecond)
+	q.handles[m.ReceiptHandle] = m
+	resp := mns.ChangeMessageVisibilityResponse{
+		ReceiptHandle:   m.ReceiptHandle,
+		NextVisibleTime: m.NextVisibleTime,
+	}
+	q.mu.Unlock()
+
+	writeXML(w, http.StatusOK, resp)
+}
+
+func writeXML(w http.ResponseWriter, statusCode int, v interface{}) {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml;charset=utf-8")
+	w.Header().Set("X-Mns-Request-Id", "fake")
+	w.WriteHeader(statusCode)
+	w.Write(b)
+}
+
+func writeError(w http.ResponseWriter, statusCode int, code, message string) {
+	writeXML(w, statusCode, struct {
+		XMLName   struct{} `xml:"Error"`
+		Code      string   `xml:"Code"`
+		Message   string   `xml:"Message"`
+		RequestId string   `xml:"RequestId"`
+		HostId    string   `xml:"HostId"`
+	}{Code: code, Message: message, RequestId: "fake", HostId: "fake"})
+}
+
+// bodyMD5 和 mns 包里的 messageBodyMD5 一致: 大写的 hex(md5(body)).
+func bodyMD5(b []byte) string {
+	sum := md5.Sum(b)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
@@ -0,0 +1,376 @@
+// Package kafka 提供和 consumer.Consumer 用法一致的 kafka consumer group 消费者,
+// 基于 sarama 由 broker 协调的 consumer group, 不依赖 ZooKeeper.
+package kafka
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"gopkg.in/tomb.v1"
+
+	"github.com/wangping886/mns_consumer/logger"
+	"github.com/wangping886/mns_consumer/metrics"
+	"github.com/wangping886/mns_consumer/tracing"
+	"github.com/wangping886/mns_consumer/util"
+)
+
+const (
+	defaultLimitSize      = 16
+	defaultQueSize        = 256
+	defaultRetryBackoff   = time.Second
+	defaultCommitInterval = time.Second
+)
+
+// errRevoked 表示 partition 在处理过程中被回收(rebalance 或者停止), 消息没有处理完, 不能提交.
+var errRevoked = errors.New("partition revoked")
+
+// headersKey 是 handle 保存消息信封 headers 的 context key, 供 SourceHandler 使用.
+type headersKey struct{}
+
+// Handler 处理一条 kafka 消息. 返回 nil 表示处理成功, consumer 会标记 offset;
+// 返回错误时按 WithMaxRetry 重试, 重试用完后记录错误日志并跳过这条消息,
+// 设置了 WithRetryTopics 时发送到重试 topic 或者死信 topic.
+type Handler func(ctx context.Context, msg *sarama.ConsumerMessage) error
+
+// Consumer 消费 consumer group 分配给自己的 partition.
+// 同一个 partition 内的消息按顺序逐条处理, 不同 partition 并发处理, 并发数由 WithLimitSize 限制.
+// offset 只提交到每个 partition 最小的未完成消息, 按 WithCommitInterval 批量提交;
+// rebalance 时先等正在执行的 handler 结束并提交 offset, 再交出 partition.
+type Consumer struct {
+	group        sarama.ConsumerGroup
+	ownGroup     bool // group 由 NewConsumer 创建, Stop 时负责关闭
+	groupID      string
+	topics       []string
+	handler      Handler
+	limitSize    int
+	limitChan    chan bool // 并发数
+	queSize      int       // 每个 partition 取出还没有处理的消息数
+	maxRetry     int
+	retryBackoff time.Duration
+	commitEvery  time.Duration
+	logger       logger.Logger
+	metrics      metrics.Metrics
+	tracer       tracing.Tracer
+
+	security      *Security // WithSecurity
+	retryProducer *Producer // WithRetryTopics
+	retryDelays   []time.Duration
+
+	t tomb.Tomb
+	w util.WaitGroupWrapper
+}
+
+type option func(c *Consumer)
+
+// NewConsumer 创建加入 groupID 的 consumer, config 为 nil 时使用 NewConfig(),
+// 需要 TLS 或者 SASL 时使用 WithSecurity.
+//
+//	c, err := kafka.NewConsumer(brokers, "my-group", []string{"topic"}, handler, nil, kafka.WithSecurity(sec))
+func NewConsumer(brokers []string, groupID string, topics []string, handler Handler, config *sarama.Config, options ...option) (*Consumer, error) {
+	c := NewConsumerFromGroup(nil, topics, handler, options...)
+	config, err := secureConfig(config, NewConfig, c.security)
+	if err != nil {
+		return nil, err
+	}
+	group, err := sarama.NewConsumerGroup(brokers, groupID, config)
+	if err != nil {
+		return nil, err
+	}
+	c.group = group
+	c.groupID = groupID
+	c.ownGroup = true
+	return c, nil
+}
+
+// NewConsumerFromGroup 使用调用方创建的 sarama.ConsumerGroup, 比如测试中的 mock 实现.
+// group 由调用方负责关闭, 它的 config 需要打开 Consumer.Return.Errors.
+func NewConsumerFromGroup(group sarama.ConsumerGroup, topics []string, handler Handler, options ...option) *Consumer {
+	c := &Consumer{
+		group:        group,
+		topics:       topics,
+		handler:      handler,
+		limitSize:    defaultLimitSize,
+		queSize:      defaultQueSize,
+		retryBackoff: defaultRetryBackoff,
+		commitEvery:  defaultCommitInterval,
+		logger:       logger.Std,
+		metrics:      metrics.Nop,
+		tracer:       tracing.Nop,
+	}
+	for _, o := range options {
+		o(c)
+	}
+	if c.retryProducer != nil {
+		c.topics = retryTopics(topics, len(c.retryDelays))
+	}
+	c.limitChan = make(chan bool, c.limitSize)
+	return c
+}
+
+// NewConfig 返回 consumer 默认使用的 sarama 配置:
+// 返回消费错误, 没有已提交 offset 的 partition 从最早的消息开始消费,
+// 关闭 sarama 的自动提交, 由 consumer 按 WithCommitInterval 提交.
+func NewConfig() *sarama.Config {
+	config := sarama.NewConfig()
+	config.Version = sarama.V0_10_2_0
+	config.Consumer.Return.Errors = true
+	config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	config.Consumer.Offsets.AutoCommit.Enable = false
+	return config
+}
+
+// WithSecurity 设置连接 kafka 的 TLS 和 SASL, NewConsumer 创建 group 时应用到 config 的副本上.
+// NewConsumerFromGroup 使用调用方创建的 group, 这个选项对它无效.
+func WithSecurity(sec *Security) option {
+	return func(c *Consumer) {
+		c.security = sec
+	}
+}
+
+// WithLimitSize 设置同时执行的 handler 数量上限, 默认 16.
+func WithLimitSize(size int) option {
+	return func(c *Consumer) {
+		c.limitSize = size
+	}
+}
+
+// WithChanSize 设置每个 partition 预取的消息数, 默认 256.
+func WithChanSize(size int) option {
+	return func(c *Consumer) {
+		c.queSize = size
+	}
+}
+
+// WithCommitInterval 设置提交 offset 的间隔, 默认 1 秒. rebalance 和停止时总会提交一次.
+func WithCommitInterval(d time.Duration) option {
+	return func(c *Consumer) {
+		c.commitEvery = d
+	}
+}
+
+// WithMaxRetry 设置 handler 返回错误后的重试次数和重试间隔, 默认不重试.
+func WithMaxRetry(retry int, backoff time.Duration) option {
+	return func(c *Consumer) {
+		c.maxRetry = retry
+		c.retryBackoff = backoff
+	}
+}
+
+// WithLogger 设置日志输出, 默认是 logger.Std.
+func WithLogger(l logger.Logger) option {
+	return func(c *Consumer) {
+		c.logger = l
+	}
+}
+
+// WithMetrics 设置指标收集器, 指标的 queue 标签是 topic.
+func WithMetrics(m metrics.Metrics) option {
+	return func(c *Consumer) {
+		c.metrics = m
+	}
+}
+
+// WithTracer 设置 tracer, 和 consumer.WithTracer 一样拆开信封格式的消息, 并以其中的 trace 上下文为 parent 开始 span.
+func WithTracer(t tracing.Tracer) option {
+	return func(c *Consumer) {
+		c.tracer = t
+	}
+}
+
+func (c *Consumer) Start() {
+	c.w.Wrap(c.serve)
+	c.w.Wrap(c.logErrors)
+
+	go func() {
+		c.w.Wait()
+		c.t.Done()
+	}()
+}
+
+// Stop 等待正在执行的 handler 结束并提交 offset 之后返回.
+func (c *Consumer) Stop() {
+	c.t.Kill(nil)
+	c.t.Wait()
+	// Close 会直接关闭 client, 必须等 session 提交完 offset 才能关闭
+	if c.ownGroup {
+		if err := c.group.Close(); err != nil {
+			c.logger.Error("close consumer group failed", logger.F("group", c.groupID), logger.Err(err))
+		}
+	}
+	c.logger.Info("kafka consumer stopped", logger.F("group", c.groupID))
+}
+
+// serve 循环调用 Consume, 每次 rebalance 后 Consume 返回, 需要重新加入 group.
+func (c *Consumer) serve() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-c.t.Dying()
+		cancel()
+	}()
+
+	handler := &groupHandler{c: c, ctx: ctx}
+	for {
+		err := c.group.Consume(ctx, c.topics, handler)
+		if ctx.Err() != nil || errors.Is(err, sarama.ErrClosedConsumerGroup) {
+			break
+		}
+		if err != nil {
+			c.logger.Error("consume failed", logger.F("group", c.groupID), logger.Err(err))
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+			}
+		}
+	}
+	c.logger.Info("serve done", logger.F("group", c.groupID))
+}
+
+// logErrors 读取 group 的错误, 直到 group 被关闭或者 consumer 停止.
+func (c *Consumer) logErrors() {
+	for {
+		select {
+		case err, ok := <-c.group.Errors():
+			if !ok {
+				return
+			}
+			c.logger.Error("consumer group error", logger.F("group", c.groupID), logger.Err(err))
+		case <-c.t.Dying():
+			return
+		}
+	}
+}
+
+// handle 处理一条消息, 返回最后一次处理的错误; 重试等待期间 partition 被回收时返回 errRevoked.
+func (c *Consumer) handle(ctx context.Context, revoked <-chan struct{}, msg *sarama.ConsumerMessage) error {
+	c.limitChan <- true
+	c.metrics.InFlight(msg.Topic, 1)
+	defer func() {
+		c.metrics.InFlight(msg.Topic, -1)
+		<-c.limitChan
+	}()
+
+	if !msg.Timestamp.IsZero() {
+		c.metrics.MessageLag(msg.Topic, time.Since(msg.Timestamp))
+	}
+
+	headers, body, _ := tracing.Open(msg.Value)
+	m := *msg
+	m.Value = body
+
+	var err error
+	for i := 0; i <= c.maxRetry; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(c.retryBackoff):
+			case <-revoked:
+				return errRevoked
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		spanCtx, endSpan := c.tracer.StartSpan(ctx, "kafka.consume "+msg.Topic, headers)
+		if headers != nil {
+			spanCtx = context.WithValue(spanCtx, headersKey{}, headers)
+		}
+		begin := time.Now()
+		err = c.handler(spanCtx, &m)
+		c.metrics.MessageHandled(msg.Topic, time.Since(begin), err)
+		endSpan(err)
+		if err == nil {
+			return nil
+		}
+		c.logger.Warn("handle message failed", msgFields(msg, logger.F("attempt", i+1), logger.Err(err))...)
+	}
+	return err
+}
+
+func msgFields(msg *sarama.ConsumerMessage, fields ...logger.Field) []logger.Field {
+	return append([]logger.Field{
+		logger.F("topic", msg.Topic),
+		logger.F("partition", msg.Partition),
+		logger.F("offset", strconv.FormatInt(msg.Offset, 10)),
+	}, fields...)
+}
+
+// groupHandler 实现 sarama.ConsumerGroupHandler, sarama 为每个分配到的 partition 调用一次 ConsumeClaim.
+// 每次 rebalance 都会开始一个新的 session, committer 只在一个 session 内有效.
+type groupHandler struct {
+	c         *Consumer
+	ctx       context.Context // handler 的 ctx, 只在 consumer 停止时取消, rebalance 不会打断正在执行的 handler
+	committer *offsetCommitter
+}
+
+func (h *groupHandler) Setup(sess sarama.ConsumerGroupSession) error {
+	h.c.logger.Info("partitions assigned", logger.F("member", sess.MemberID()), logger.F("claims", sess.Claims()))
+	h.committer = startOffsetCommitter(sess, h.c.commitEvery)
+	return nil
+}
+
+// Cleanup 在所有 ConsumeClaim 返回之后调用, 此时 handler 都已经结束, 提交最后的 offset.
+func (h *groupHandler) Cleanup(sess sarama.ConsumerGroupSession) error {
+	h.committer.close(sess)
+	h.c.logger.Info("partitions revoked", logger.F("member", sess.MemberID()))
+	return nil
+}
+
+// ConsumeClaim 把 partition 的消息交给这个 partition 自己的 worker 按顺序处理,
+// 返回之前等待 worker 结束, 没有开始处理的消息不提交 offset, 由下一个 owner 重新消费.
+func (h *groupHandler) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	tracker := h.committer.tracker(claim.Topic(), claim.Partition())
+	queue := make(chan *sarama.ConsumerMessage, h.c.queSize)
+	workerDone := make(chan struct{})
+	go func() {
+		defer close(workerDone)
+		h.work(sess, tracker, queue)
+	}()
+	defer func() {
+		close(queue)
+		<-workerDone
+	}()
+
+	for {
+		select {
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			h.c.metrics.MessagesReceived(msg.Topic, 1)
+			tracker.add(msg.Offset)
+			select {
+			case queue <- msg:
+			case <-sess.Context().Done():
+				return nil
+			}
+		case <-sess.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (h *groupHandler) work(sess sarama.ConsumerGroupSession, tracker *offsetTracker, queue <-chan *sarama.ConsumerMessage) {
+	revoked := sess.Context().Done()
+	for msg := range queue {
+		if sess.Context().Err() != nil {
+			continue
+		}
+		if h.c.retryProducer != nil && !h.c.waitRetry(h.ctx, revoked, msg) {
+			continue
+		}
+		err := h.c.handle(h.ctx, revoked, msg)
+		if err == errRevoked || (err != nil && h.ctx.Err() != nil) {
+			continue
+		}
+		if err != nil && h.c.retryProducer != nil {
+			if h.c.republish(h.ctx, revoked, msg, err) != nil {
+				continue
+			}
+		} else if err != nil {
+			h.c.logger.Error("message skipped after retries", msgFields(msg, logger.Err(err))...)
+		}
+		tracker.finish(msg.Offset)
+	}
+}
@@ -0,0 +1,187 @@
+package kafka
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+
+	"github.com/wangping886/mns_consumer/logger"
+)
+
+// testSession 是记录 MarkOffset 和 Commit 的 sarama.ConsumerGroupSession, 取消 ctx 模拟 rebalance.
+type testSession struct {
+	ctx context.Context
+
+	mu      sync.Mutex
+	marked  map[topicPartition]int64
+	commits int
+}
+
+func newTestSession(ctx context.Context) *testSession {
+	return &testSession{ctx: ctx, marked: make(map[topicPartition]int64)}
+}
+
+func (s *testSession) Claims() map[string][]int32 { return nil }
+func (s *testSession) MemberID() string           { return "member" }
+func (s *testSession) GenerationID() int32        { return 1 }
+func (s *testSession) Context() context.Context   { return s.ctx }
+
+func (s *testSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+	s.mu.Lock()
+	s.marked[topicPartition{topic, partition}] = offset
+	s.mu.Unlock()
+}
+
+func (s *testSession) ResetOffset(topic string, partition int32, offset int64, metadata string) {}
+
+func (s *testSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.MarkOffset(msg.Topic, msg.Partition, msg.Offset+1, metadata)
+}
+
+func (s *testSession) Commit() {
+	s.mu.Lock()
+	s.commits++
+	s.mu.Unlock()
+}
+
+func (s *testSession) markedOffset(topic string, partition int32) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	offset, ok := s.marked[topicPartition{topic, partition}]
+	return offset, ok
+}
+
+// testClaim 把 mocks.PartitionConsumer 的消息作为 sarama.ConsumerGroupClaim.
+type testClaim struct {
+	sarama.PartitionConsumer
+	topic     string
+	partition int32
+}
+
+func (c testClaim) Topic() string        { return c.topic }
+func (c testClaim) Partition() int32     { return c.partition }
+func (c testClaim) InitialOffset() int64 { return sarama.OffsetOldest }
+
+func newTestClaim(t *testing.T, topic string, partition int32) (testClaim, *mocks.PartitionConsumer) {
+	mc := mocks.NewConsumer(t, nil)
+	expect := mc.ExpectConsumePartition(topic, partition, sarama.OffsetOldest)
+	pc, err := mc.ConsumePartition(topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testClaim{PartitionConsumer: pc, topic: topic, partition: partition}, expect
+}
+
+// TestConsumeClaimRebalanceDrain 检查 rebalance 时 ConsumeClaim 等正在执行的 handler 结束,
+// 只提交处理完的消息, 没有开始处理的消息留给下一个 owner.
+func TestConsumeClaimRebalanceDrain(t *testing.T) {
+	claim, pc := newTestClaim(t, "orders", 0)
+	defer claim.Close()
+
+	var (
+		started = make(chan int64, 10)
+		release = make(chan struct{})
+	)
+	handler := func(ctx context.Context, msg *sarama.ConsumerMessage) error {
+		started <- msg.Offset
+		<-release
+		return nil
+	}
+	c := NewConsumerFromGroup(nil, []string{"orders"}, handler, WithCommitInterval(time.Hour), WithLogger(logger.Nop))
+	h := &groupHandler{c: c, ctx: context.Background()}
+
+	ctx, rebalance := context.WithCancel(context.Background())
+	sess := newTestSession(ctx)
+	if err := h.Setup(sess); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		pc.YieldMessage(&sarama.ConsumerMessage{Value: []byte("v")})
+	}
+	returned := make(chan error, 1)
+	go func() { returned <- h.ConsumeClaim(sess, claim) }()
+
+	first := <-started
+	rebalance()
+	select {
+	case <-returned:
+		t.Fatal("ConsumeClaim returned before the running handler finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Fatalf("ConsumeClaim: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ConsumeClaim did not return after the handler finished")
+	}
+	if err := h.Cleanup(sess); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case offset := <-started:
+		t.Fatalf("message %d handled after rebalance", offset)
+	default:
+	}
+	offset, ok := sess.markedOffset("orders", 0)
+	if !ok || offset != first+1 {
+		t.Errorf("marked offset = %d, %v, want %d", offset, ok, first+1)
+	}
+	if sess.commits == 0 {
+		t.Error("offsets not committed on Cleanup")
+	}
+}
+
+// TestConsumeClaimCommitsLowestUnfinished 检查同一个 partition 的消息按顺序处理,
+// partition 结束时提交的是最后一条消息的下一个 offset.
+func TestConsumeClaimCommitsLowestUnfinished(t *testing.T) {
+	claim, pc := newTestClaim(t, "orders", 1)
+
+	var handled []int64
+	handler := func(ctx context.Context, msg *sarama.ConsumerMessage) error {
+		handled = append(handled, msg.Offset)
+		return nil
+	}
+	c := NewConsumerFromGroup(nil, []string{"orders"}, handler, WithCommitInterval(time.Hour), WithLogger(logger.Nop))
+	h := &groupHandler{c: c, ctx: context.Background()}
+	sess := newTestSession(context.Background())
+	if err := h.Setup(sess); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		pc.YieldMessage(&sarama.ConsumerMessage{Value: []byte("v")})
+	}
+	returned := make(chan error, 1)
+	go func() { returned <- h.ConsumeClaim(sess, claim) }()
+
+	// 关闭 partition consumer 之后 Messages 被关闭, ConsumeClaim 处理完已经取出的消息后返回
+	time.Sleep(50 * time.Millisecond)
+	claim.Close()
+	if err := <-returned; err != nil {
+		t.Fatalf("ConsumeClaim: %v", err)
+	}
+	h.Cleanup(sess)
+
+	if len(handled) != 5 {
+		t.Fatalf("handled %v, want 5 messages in order", handled)
+	}
+	for i := 1; i < len(handled); i++ {
+		if handled[i] <= handled[i-1] {
+			t.Fatalf("handled %v, want increasing offsets", handled)
+		}
+	}
+	offset, ok := sess.markedOffset("orders", 1)
+	if want := handled[len(handled)-1] + 1; !ok || offset != want {
+		t.Errorf("marked offset = %d, %v, want %d", offset, ok, want)
+	}
+}
@@ -0,0 +1,54 @@
+package kafka
+
+import (
+	"strconv"
+
+	"github.com/Shopify/sarama"
+)
+
+// 死信消息的 headers, 记录消息最初所在的位置和最后一次处理的错误.
+const (
+	HeaderOriginalTopic     = "x-original-topic"
+	HeaderOriginalPartition = "x-original-partition"
+	HeaderOriginalOffset    = "x-original-offset"
+	HeaderError             = "x-error"
+)
+
+// DeadLetterMessage 生成发送到死信 topic 的消息: key, value 和 headers 保持不变,
+// 再加上原始 topic, partition, offset 和错误信息.
+// msg 已经带有原始位置的 headers 时(比如来自重试 topic)保留最初的位置.
+func DeadLetterMessage(topic string, msg *sarama.ConsumerMessage, err error) *sarama.ProducerMessage {
+	pm := &sarama.ProducerMessage{
+		Topic: topic,
+		Value: sarama.ByteEncoder(msg.Value),
+	}
+	if msg.Key != nil {
+		pm.Key = sarama.ByteEncoder(msg.Key)
+	}
+
+	origin := false
+	for _, h := range msg.Headers {
+		switch string(h.Key) {
+		case HeaderError:
+			continue
+		case HeaderOriginalTopic:
+			origin = true
+		}
+		pm.Headers = append(pm.Headers, *h)
+	}
+	if !origin {
+		pm.Headers = append(pm.Headers,
+			header(HeaderOriginalTopic, msg.Topic),
+			header(HeaderOriginalPartition, strconv.Itoa(int(msg.Partition))),
+			header(HeaderOriginalOffset, strconv.FormatInt(msg.Offset, 10)),
+		)
+	}
+	if err != nil {
+		pm.Headers = append(pm.Headers, header(HeaderError, err.Error()))
+	}
+	return pm
+}
+
+func header(key, value string) sarama.RecordHeader {
+	return sarama.RecordHeader{Key: []byte(key), Value: []byte(value)}
+}
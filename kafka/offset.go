@@ -0,0 +1,136 @@
+package kafka
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// offsetTracker 记录一个 partition 已经取出但还没有处理完的消息,
+// 可以提交的 offset 是最小的未完成 offset, 保证提交之前的消息都已经处理过(at-least-once).
+type offsetTracker struct {
+	mu      sync.Mutex
+	pending []int64 // 按取出顺序(offset 递增)排列的未完成消息
+	done    map[int64]bool
+	next    int64 // 最后一条取出的消息的下一个 offset
+	marked  int64 // 最近一次 MarkOffset 的 offset, -1 表示还没有标记过
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{
+		done:   make(map[int64]bool),
+		next:   -1,
+		marked: -1,
+	}
+}
+
+// add 记录取出了一条消息, offset 必须递增.
+func (t *offsetTracker) add(offset int64) {
+	t.mu.Lock()
+	t.pending = append(t.pending, offset)
+	t.next = offset + 1
+	t.mu.Unlock()
+}
+
+// finish 记录一条消息处理完成(成功或者重试用完后跳过).
+func (t *offsetTracker) finish(offset int64) {
+	t.mu.Lock()
+	t.done[offset] = true
+	t.mu.Unlock()
+}
+
+// commitOffset 返回可以提交的 offset, 即最小的未完成 offset;
+// 没有取出过消息或者和上次标记的相同时 ok 为 false.
+func (t *offsetTracker) commitOffset() (offset int64, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for len(t.pending) > 0 && t.done[t.pending[0]] {
+		delete(t.done, t.pending[0])
+		t.pending = t.pending[1:]
+	}
+	if t.next < 0 {
+		return 0, false
+	}
+	offset = t.next
+	if len(t.pending) > 0 {
+		offset = t.pending[0]
+	}
+	if offset == t.marked {
+		return 0, false
+	}
+	t.marked = offset
+	return offset, true
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// offsetCommitter 跟踪一个 session 内每个 partition 的 offset,
+// 按间隔把最小的未完成 offset 标记到 session 并提交.
+type offsetCommitter struct {
+	mu       sync.Mutex
+	trackers map[topicPartition]*offsetTracker
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+func startOffsetCommitter(sess sarama.ConsumerGroupSession, interval time.Duration) *offsetCommitter {
+	oc := &offsetCommitter{
+		trackers: make(map[topicPartition]*offsetTracker),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go func() {
+		defer close(oc.stopped)
+
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				oc.commit(sess)
+			case <-oc.stop:
+				return
+			}
+		}
+	}()
+	return oc
+}
+
+func (oc *offsetCommitter) tracker(topic string, partition int32) *offsetTracker {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+
+	tp := topicPartition{topic, partition}
+	t := oc.trackers[tp]
+	if t == nil {
+		t = newOffsetTracker()
+		oc.trackers[tp] = t
+	}
+	return t
+}
+
+// commit 标记新的 offset 并提交. sarama 的 Commit 不返回错误, 标记过的 offset 在提交成功之前一直是待提交状态,
+// 每次 Commit 只发送待提交的 partition, 所以每次都调用 Commit, 失败的提交会在下一次重试.
+func (oc *offsetCommitter) commit(sess sarama.ConsumerGroupSession) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+
+	for tp, t := range oc.trackers {
+		if offset, ok := t.commitOffset(); ok {
+			sess.MarkOffset(tp.topic, tp.partition, offset, "")
+		}
+	}
+	sess.Commit()
+}
+
+// close 停止定期提交, 再提交一次最后的 offset.
+func (oc *offsetCommitter) close(sess sarama.ConsumerGroupSession) {
+	close(oc.stop)
+	<-oc.stopped
+	oc.commit(sess)
+}
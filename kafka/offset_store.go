@@ -0,0 +1,89 @@
+package kafka
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// OffsetStore 保存不使用 consumer group 直接消费 partition 时的进度, 实现必须是并发安全的.
+// 保存的是下一条要消费的 offset, 即最后一条处理完的消息的 offset + 1.
+type OffsetStore interface {
+	// Load 返回保存的 offset, 没有保存过时 ok 为 false.
+	Load(topic string, partition int32) (offset int64, ok bool, err error)
+	Save(topic string, partition int32, offset int64) error
+}
+
+// FileOffsetStore 把所有 partition 的 offset 以 JSON 格式保存在一个本地文件里:
+//
+//	{"topic":{"0":1234,"1":5678}}
+//
+// 每次 Save 都会重写整个文件(先写临时文件再 rename), 调用方应该按间隔批量保存.
+type FileOffsetStore struct {
+	path string
+
+	mu      sync.Mutex
+	offsets map[string]map[string]int64
+}
+
+// NewFileOffsetStore 读取 path 里已经保存的 offset, 文件不存在时从空开始.
+func NewFileOffsetStore(path string) (*FileOffsetStore, error) {
+	s := &FileOffsetStore{
+		path:    path,
+		offsets: make(map[string]map[string]int64),
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > 0 {
+		if err = json.Unmarshal(b, &s.offsets); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *FileOffsetStore) Load(topic string, partition int32) (offset int64, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	offset, ok = s.offsets[topic][strconv.Itoa(int(partition))]
+	return
+}
+
+func (s *FileOffsetStore) Save(topic string, partition int32, offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.offsets[topic] == nil {
+		s.offsets[topic] = make(map[string]int64)
+	}
+	s.offsets[topic][strconv.Itoa(int(partition))] = offset
+
+	b, err := json.Marshal(s.offsets)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(b); err == nil {
+		err = tmp.Sync()
+	}
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
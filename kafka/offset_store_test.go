@@ -0,0 +1,88 @@
+package kafka
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileOffsetStoreRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offsets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "offsets.json")
+
+	store, err := NewFileOffsetStore(path)
+	if err != nil {
+		t.Fatalf("NewFileOffsetStore() on a missing file: %v", err)
+	}
+	if _, ok, err := store.Load("orders", 0); ok || err != nil {
+		t.Fatalf("Load() on a missing file = ok %v, err %v; want not ok", ok, err)
+	}
+
+	saves := []struct {
+		topic     string
+		partition int32
+		offset    int64
+	}{
+		{"orders", 0, 100},
+		{"orders", 1, 200},
+		{"payments", 0, 7},
+		{"orders", 0, 150}, // 覆盖之前保存的 offset
+	}
+	for _, s := range saves {
+		if err := store.Save(s.topic, s.partition, s.offset); err != nil {
+			t.Fatalf("Save(%s, %d, %d): %v", s.topic, s.partition, s.offset, err)
+		}
+	}
+
+	// 重新打开, 模拟进程重启
+	reopened, err := NewFileOffsetStore(path)
+	if err != nil {
+		t.Fatalf("NewFileOffsetStore() reopen: %v", err)
+	}
+	want := []struct {
+		topic     string
+		partition int32
+		offset    int64
+		ok        bool
+	}{
+		{"orders", 0, 150, true},
+		{"orders", 1, 200, true},
+		{"payments", 0, 7, true},
+		{"payments", 1, 0, false},
+		{"unknown", 0, 0, false},
+	}
+	for _, w := range want {
+		offset, ok, err := reopened.Load(w.topic, w.partition)
+		if err != nil || ok != w.ok || offset != w.offset {
+			t.Errorf("Load(%s, %d) = %d, %v, %v; want %d, %v", w.topic, w.partition, offset, ok, err, w.offset, w.ok)
+		}
+	}
+
+	// 临时文件 rename 之后不应该留下
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("files in dir = %d, want only offsets.json", len(files))
+	}
+}
+
+func TestFileOffsetStoreCorruptFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "offsets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("{not json")
+	f.Close()
+
+	if _, err := NewFileOffsetStore(f.Name()); err == nil {
+		t.Fatal("NewFileOffsetStore() on a corrupt file: want error")
+	}
+}
@@ -0,0 +1,56 @@
+package kafka
+
+import "testing"
+
+func TestOffsetTrackerOutOfOrder(t *testing.T) {
+	tr := newOffsetTracker()
+	if _, ok := tr.commitOffset(); ok {
+		t.Fatal("commitOffset before any message: want ok = false")
+	}
+
+	for _, offset := range []int64{10, 11, 12, 13} {
+		tr.add(offset)
+	}
+
+	steps := []struct {
+		finish int64
+		want   int64
+		wantOk bool
+	}{
+		{finish: 12, want: 10, wantOk: true}, // 10 还没有完成
+		{finish: 11, want: 0, wantOk: false}, // 仍然是 10, 不重复标记
+		{finish: 10, want: 13, wantOk: true}, // 10, 11, 12 都完成了
+		{finish: 13, want: 14, wantOk: true}, // 全部完成, 提交下一条
+		{finish: -1, want: 0, wantOk: false}, // 没有变化
+	}
+	for i, step := range steps {
+		if step.finish >= 0 {
+			tr.finish(step.finish)
+		}
+		got, ok := tr.commitOffset()
+		if ok != step.wantOk || got != step.want {
+			t.Errorf("step %d: commitOffset() = %d, %v, want %d, %v", i, got, ok, step.want, step.wantOk)
+		}
+	}
+}
+
+func TestOffsetTrackerPendingAfterFinish(t *testing.T) {
+	tr := newOffsetTracker()
+	tr.add(0)
+	tr.add(1)
+	tr.finish(0)
+	if got, ok := tr.commitOffset(); !ok || got != 1 {
+		t.Fatalf("commitOffset() = %d, %v, want 1, true", got, ok)
+	}
+
+	// 新取出的消息没有完成之前, 可以提交的 offset 停在最小的未完成消息
+	tr.add(2)
+	tr.finish(2)
+	if got, ok := tr.commitOffset(); ok {
+		t.Fatalf("commitOffset() = %d, true, want no change while 1 is pending", got)
+	}
+	tr.finish(1)
+	if got, ok := tr.commitOffset(); !ok || got != 3 {
+		t.Fatalf("commitOffset() = %d, %v, want 3, true", got, ok)
+	}
+}
@@ -0,0 +1,186 @@
+package kafka
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// Outbox 是 Producer 写入失败的消息的本地备份文件, 每行一条 JSON 格式的 outboxRecord.
+// 恢复之后用 Replay 重新发送, 重新发送的消息可能和已经写入的消息重复, 消费者需要能够处理重复消息.
+type Outbox struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+type outboxRecord struct {
+	Topic   string         `json:"topic"`
+	Key     []byte         `json:"key,omitempty"`
+	Value   []byte         `json:"value,omitempty"`
+	Headers []outboxHeader `json:"headers,omitempty"` // 保持原来的顺序和重复的 key
+	Error   string         `json:"error,omitempty"`
+	Time    time.Time      `json:"time"`
+}
+
+type outboxHeader struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// NewOutbox 打开或者创建 path, 新的消息追加到文件末尾.
+func NewOutbox(path string) (*Outbox, error) {
+	o := &Outbox{path: path}
+	if err := o.open(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *Outbox) open() (err error) {
+	o.f, err = os.OpenFile(o.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	return
+}
+
+// Write 追加一条消息, 写入后 Sync 到磁盘.
+func (o *Outbox) Write(msg *sarama.ProducerMessage, cause error) error {
+	r := outboxRecord{
+		Topic: msg.Topic,
+		Time:  time.Now(),
+	}
+	var err error
+	if msg.Key != nil {
+		if r.Key, err = msg.Key.Encode(); err != nil {
+			return err
+		}
+	}
+	if msg.Value != nil {
+		if r.Value, err = msg.Value.Encode(); err != nil {
+			return err
+		}
+	}
+	for _, h := range msg.Headers {
+		r.Headers = append(r.Headers, outboxHeader{Key: h.Key, Value: h.Value})
+	}
+	if cause != nil {
+		r.Error = cause.Error()
+	}
+	return o.append(r)
+}
+
+func (o *Outbox) append(records ...outboxRecord) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.f == nil {
+		if err := o.open(); err != nil {
+			return err
+		}
+	}
+	w := bufio.NewWriter(o.f)
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return o.f.Sync()
+}
+
+// Replay 把 outbox 里的消息逐条发送到 p, 返回写入 kafka 成功的条数. p 可以是使用这个 outbox 的 Producer,
+// 重新发送失败的消息不会再经过 WithOutbox 追加, 而是作为错误返回.
+// 发送期间新写入失败的消息追加到新的 outbox 文件; 出错时没有发送成功的消息重新追加到 outbox, 下次再试.
+// 上次 Replay 中途退出(比如进程崩溃)留下的 path.replay 文件会先被发送.
+func (o *Outbox) Replay(ctx context.Context, p *Producer) (n int, err error) {
+	replay := o.path + ".replay"
+
+	o.mu.Lock()
+	if _, err = os.Stat(replay); os.IsNotExist(err) {
+		if o.f != nil {
+			o.f.Close()
+			o.f = nil
+		}
+		err = os.Rename(o.path, replay)
+	}
+	o.mu.Unlock()
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	records, err := readOutbox(replay)
+	if err != nil {
+		return 0, err
+	}
+	for i, r := range records {
+		if err = p.sendSync(ctx, r.producerMessage(), true); err != nil {
+			if err2 := o.append(records[i:]...); err2 != nil {
+				// 保留 replay 文件, 下次 Replay 时重新发送
+				return n, err2
+			}
+			break
+		}
+		n++
+	}
+	if err2 := os.Remove(replay); err == nil {
+		err = err2
+	}
+	return n, err
+}
+
+func readOutbox(path string) ([]outboxRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []outboxRecord
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var r outboxRecord
+		if err = dec.Decode(&r); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+func (r *outboxRecord) producerMessage() *sarama.ProducerMessage {
+	pm := &sarama.ProducerMessage{
+		Topic: r.Topic,
+		Value: sarama.ByteEncoder(r.Value),
+	}
+	if r.Key != nil {
+		pm.Key = sarama.ByteEncoder(r.Key)
+	}
+	for _, h := range r.Headers {
+		pm.Headers = append(pm.Headers, sarama.RecordHeader{Key: h.Key, Value: h.Value})
+	}
+	return pm
+}
+
+// Close 关闭 outbox 文件.
+func (o *Outbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.f == nil {
+		return nil
+	}
+	err := o.f.Close()
+	o.f = nil
+	return err
+}
@@ -0,0 +1,253 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+
+	"github.com/wangping886/mns_consumer/logger"
+	"github.com/wangping886/mns_consumer/source"
+)
+
+// ErrProducerClosed 表示 Producer 已经关闭, 消息没有发送.
+var ErrProducerClosed = errors.New("kafka producer closed")
+
+// DeliveryFunc 在消息写入 kafka 成功或者最终失败时调用, 成功时 err 为 nil.
+// 它在 Producer 的结果 goroutine 中执行, 不应该阻塞.
+type DeliveryFunc func(msg *sarama.ProducerMessage, err error)
+
+// KeyFunc 从来源消息中提取 kafka 消息的 key, 返回 nil 表示不设置 key(消息随机分配 partition).
+type KeyFunc func(msg *source.Message) []byte
+
+// Producer 异步批量写入 kafka, 每条消息写入成功或者失败后调用各自的 DeliveryFunc.
+// 设置了 WithOutbox 时, 重试用完仍然写入失败的消息追加到 outbox 文件, 之后用 Outbox.Replay 重新发送.
+type Producer struct {
+	producer  sarama.AsyncProducer
+	keyFunc   KeyFunc
+	outbox    *Outbox
+	security  *Security
+	logger    logger.Logger
+	mu        sync.RWMutex
+	closed    bool
+	drained   sync.WaitGroup
+	closeOnce sync.Once
+}
+
+type producerOption func(p *Producer)
+
+// NewProducer 创建写入 brokers 的 Producer, config 为 nil 时使用 NewProducerConfig(),
+// 需要 TLS 或者 SASL 时使用 WithProducerSecurity.
+func NewProducer(brokers []string, config *sarama.Config, options ...producerOption) (*Producer, error) {
+	p := newProducer(options...)
+	config, err := secureConfig(config, NewProducerConfig, p.security)
+	if err != nil {
+		return nil, err
+	}
+	producer, err := sarama.NewAsyncProducer(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	p.start(producer)
+	return p, nil
+}
+
+// NewProducerFromAsync 使用调用方创建的 sarama.AsyncProducer, 比如测试中的 mocks.NewAsyncProducer,
+// 它的 config 需要打开 Producer.Return.Successes 和 Producer.Return.Errors. producer 由 Close 关闭.
+func NewProducerFromAsync(producer sarama.AsyncProducer, options ...producerOption) *Producer {
+	p := newProducer(options...)
+	p.start(producer)
+	return p
+}
+
+func newProducer(options ...producerOption) *Producer {
+	p := &Producer{
+		keyFunc: defaultKeyFunc,
+		logger:  logger.Std,
+	}
+	for _, o := range options {
+		o(p)
+	}
+	return p
+}
+
+func (p *Producer) start(producer sarama.AsyncProducer) {
+	p.producer = producer
+	p.drained.Add(2)
+	go p.successes()
+	go p.errors()
+}
+
+// NewProducerConfig 返回幂等写入的 producer 配置: 等待所有副本确认, 每个连接只有一个请求在途,
+// broker 根据 producer id 和序号去掉重试造成的重复, 同一个 partition 内的消息保持顺序.
+// 消息每 10ms 或者攒够 100 条发送一批.
+func NewProducerConfig() *sarama.Config {
+	config := sarama.NewConfig()
+	config.Version = sarama.V0_11_0_0
+	config.Producer.Idempotent = true
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Retry.Max = 10
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	config.Producer.Flush.Frequency = 10 * time.Millisecond
+	config.Producer.Flush.Messages = 100
+	config.Net.MaxOpenRequests = 1
+	return config
+}
+
+// WithKeyFunc 设置 Produce 提取 key 的方法, 默认使用 source.Message 的 Key.
+func WithKeyFunc(f KeyFunc) producerOption {
+	return func(p *Producer) {
+		p.keyFunc = f
+	}
+}
+
+// WithOutbox 设置 outbox, 最终写入失败的消息追加到 outbox 中, 追加成功时 DeliveryFunc 的 err 为 nil,
+// 消息的投递由 Outbox.Replay 负责; 追加失败时 DeliveryFunc 收到原来的错误.
+func WithOutbox(o *Outbox) producerOption {
+	return func(p *Producer) {
+		p.outbox = o
+	}
+}
+
+// WithProducerSecurity 设置连接 kafka 的 TLS 和 SASL, NewProducer 创建 producer 时应用到 config 的副本上,
+// 对 NewProducerFromAsync 无效.
+func WithProducerSecurity(sec *Security) producerOption {
+	return func(p *Producer) {
+		p.security = sec
+	}
+}
+
+func WithProducerLogger(l logger.Logger) producerOption {
+	return func(p *Producer) {
+		p.logger = l
+	}
+}
+
+func defaultKeyFunc(msg *source.Message) []byte {
+	return msg.Key
+}
+
+// delivery 保存在 ProducerMessage.Metadata 中, 结果返回时还原调用方的 Metadata.
+// skipOutbox 的消息写入失败时不追加到 outbox, 比如 Outbox.Replay 重新发送的消息.
+type delivery struct {
+	callback   DeliveryFunc
+	metadata   interface{}
+	skipOutbox bool
+}
+
+// Send 异步发送 msg, 结果通过 callback 返回, callback 可以为 nil.
+// Producer 已经关闭时立即以 ErrProducerClosed 调用 callback.
+func (p *Producer) Send(msg *sarama.ProducerMessage, callback DeliveryFunc) {
+	p.send(msg, callback, false)
+}
+
+func (p *Producer) send(msg *sarama.ProducerMessage, callback DeliveryFunc, skipOutbox bool) {
+	// 持有读锁写入 Input, 保证 Close 之后不会再写入已经关闭的 Input
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		if callback != nil {
+			callback(msg, ErrProducerClosed)
+		}
+		return
+	}
+	msg.Metadata = &delivery{callback: callback, metadata: msg.Metadata, skipOutbox: skipOutbox}
+	p.producer.Input() <- msg
+}
+
+// SendSync 发送 msg 并等待结果, ctx 取消时返回 ctx.Err(), 这时消息仍然可能写入成功.
+func (p *Producer) SendSync(ctx context.Context, msg *sarama.ProducerMessage) error {
+	return p.sendSync(ctx, msg, false)
+}
+
+func (p *Producer) sendSync(ctx context.Context, msg *sarama.ProducerMessage, skipOutbox bool) error {
+	done := make(chan error, 1)
+	p.send(msg, func(_ *sarama.ProducerMessage, err error) {
+		done <- err
+	}, skipOutbox)
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Produce 把来源消息异步发送到 topic: key 由 KeyFunc 提取, Headers 写入 kafka headers, Body 作为 value.
+func (p *Producer) Produce(topic string, msg *source.Message, callback DeliveryFunc) {
+	p.Send(p.producerMessage(topic, msg), callback)
+}
+
+// ProduceSync 发送来源消息并等待结果.
+func (p *Producer) ProduceSync(ctx context.Context, topic string, msg *source.Message) error {
+	return p.SendSync(ctx, p.producerMessage(topic, msg))
+}
+
+func (p *Producer) producerMessage(topic string, msg *source.Message) *sarama.ProducerMessage {
+	pm := &sarama.ProducerMessage{
+		Topic: topic,
+		Value: sarama.ByteEncoder(msg.Body),
+	}
+	if key := p.keyFunc(msg); key != nil {
+		pm.Key = sarama.ByteEncoder(key)
+	}
+	for k, v := range msg.Headers {
+		if k == source.HeaderKey {
+			continue
+		}
+		pm.Headers = append(pm.Headers, header(k, v))
+	}
+	return pm
+}
+
+// Close 停止接收新消息, 等待已经发送的消息都返回结果后关闭 producer.
+func (p *Producer) Close() error {
+	p.closeOnce.Do(func() {
+		p.mu.Lock()
+		p.closed = true
+		p.mu.Unlock()
+
+		// 不能用 producer.Close, 它会自己读走 Successes, 没有机会调用 callback
+		p.producer.AsyncClose()
+		p.drained.Wait()
+	})
+	return nil
+}
+
+func (p *Producer) successes() {
+	defer p.drained.Done()
+	for msg := range p.producer.Successes() {
+		p.deliver(msg, nil)
+	}
+}
+
+func (p *Producer) errors() {
+	defer p.drained.Done()
+	for pe := range p.producer.Errors() {
+		err := pe.Err
+		if d, ok := pe.Msg.Metadata.(*delivery); p.outbox != nil && !(ok && d.skipOutbox) {
+			if oerr := p.outbox.Write(pe.Msg, err); oerr != nil {
+				p.logger.Error("write message to outbox failed", logger.F("topic", pe.Msg.Topic), logger.F("error", err.Error()), logger.Err(oerr))
+			} else {
+				p.logger.Warn("message moved to outbox", logger.F("topic", pe.Msg.Topic), logger.Err(err))
+				err = nil
+			}
+		}
+		p.deliver(pe.Msg, err)
+	}
+}
+
+func (p *Producer) deliver(msg *sarama.ProducerMessage, err error) {
+	d, ok := msg.Metadata.(*delivery)
+	if !ok {
+		// 不是通过 Send 发送的消息
+		return
+	}
+	msg.Metadata = d.metadata
+	if d.callback != nil {
+		d.callback(msg, err)
+	}
+}
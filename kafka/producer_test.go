@@ -0,0 +1,147 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+
+	"github.com/wangping886/mns_consumer/logger"
+)
+
+var errBroker = errors.New("broker unavailable")
+
+func newTestProducer(t *testing.T, options ...producerOption) (*Producer, *mocks.AsyncProducer) {
+	config := NewProducerConfig()
+	mp := mocks.NewAsyncProducer(t, config)
+	return NewProducerFromAsync(mp, append([]producerOption{WithProducerLogger(logger.Nop)}, options...)...), mp
+}
+
+func newTestOutbox(t *testing.T) *Outbox {
+	o, err := NewOutbox(filepath.Join(t.TempDir(), "outbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { o.Close() })
+	return o
+}
+
+func testMessage(value string) *sarama.ProducerMessage {
+	return &sarama.ProducerMessage{Topic: "orders", Value: sarama.StringEncoder(value)}
+}
+
+func outboxValues(t *testing.T, o *Outbox) []string {
+	records, err := readOutbox(o.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make([]string, len(records))
+	for i, r := range records {
+		values[i] = string(r.Value)
+	}
+	return values
+}
+
+func TestProducerDelivery(t *testing.T) {
+	p, mp := newTestProducer(t)
+	mp.ExpectInputAndSucceed()
+	mp.ExpectInputAndFail(errBroker)
+
+	if err := p.SendSync(context.Background(), testMessage("ok")); err != nil {
+		t.Errorf("SendSync: %v, want nil", err)
+	}
+
+	msg := testMessage("fail")
+	msg.Metadata = "caller"
+	done := make(chan error, 1)
+	p.Send(msg, func(m *sarama.ProducerMessage, err error) {
+		if m.Metadata != "caller" {
+			t.Errorf("Metadata = %v, want the caller's metadata", m.Metadata)
+		}
+		done <- err
+	})
+	if err := <-done; !errors.Is(err, errBroker) {
+		t.Errorf("callback err = %v, want %v", err, errBroker)
+	}
+
+	p.Close()
+	if err := p.SendSync(context.Background(), testMessage("closed")); err != ErrProducerClosed {
+		t.Errorf("SendSync after Close: %v, want ErrProducerClosed", err)
+	}
+}
+
+func TestProducerOutbox(t *testing.T) {
+	o := newTestOutbox(t)
+	p, mp := newTestProducer(t, WithOutbox(o))
+	mp.ExpectInputAndFail(errBroker)
+
+	// 追加到 outbox 成功时视为交付成功
+	if err := p.SendSync(context.Background(), testMessage("a")); err != nil {
+		t.Fatalf("SendSync: %v, want nil after writing to outbox", err)
+	}
+	p.Close()
+	if got := outboxValues(t, o); len(got) != 1 || got[0] != "a" {
+		t.Fatalf("outbox = %v, want [a]", got)
+	}
+}
+
+func TestOutboxKeepsHeaderOrder(t *testing.T) {
+	o := newTestOutbox(t)
+	msg := testMessage("a")
+	msg.Headers = []sarama.RecordHeader{header("trace", "1"), header("tag", "x"), header("trace", "2")}
+	if err := o.Write(msg, errBroker); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := readOutbox(o.path)
+	if err != nil || len(records) != 1 {
+		t.Fatalf("readOutbox = %d records, %v", len(records), err)
+	}
+	got := records[0].producerMessage().Headers
+	if !reflect.DeepEqual(got, msg.Headers) {
+		t.Fatalf("replayed headers = %q, want %q", got, msg.Headers)
+	}
+}
+
+// TestOutboxReplaySameProducer 检查通过使用同一个 outbox 的 Producer 重新发送时,
+// 失败的消息不会被当作发送成功, 并且只在 outbox 里保留一份.
+func TestOutboxReplaySameProducer(t *testing.T) {
+	o := newTestOutbox(t)
+	for _, v := range []string{"a", "b", "c"} {
+		if err := o.Write(testMessage(v), errBroker); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 多发送的消息没有对应的 expectation, 不会返回结果, 用超时避免测试卡住
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	p, mp := newTestProducer(t, WithOutbox(o))
+	mp.ExpectInputAndSucceed()
+	mp.ExpectInputAndFail(errBroker)
+	n, err := o.Replay(ctx, p)
+	if n != 1 || !errors.Is(err, errBroker) {
+		t.Fatalf("Replay = %d, %v, want 1, %v", n, err, errBroker)
+	}
+	if got := outboxValues(t, o); len(got) != 2 || got[0] != "b" || got[1] != "c" {
+		t.Fatalf("outbox after failed replay = %v, want [b c]", got)
+	}
+
+	mp.ExpectInputAndSucceed()
+	mp.ExpectInputAndSucceed()
+	n, err = o.Replay(ctx, p)
+	if n != 2 || err != nil {
+		t.Fatalf("Replay = %d, %v, want 2, nil", n, err)
+	}
+	p.Close()
+
+	if n, err = o.Replay(context.Background(), p); n != 0 || err != nil {
+		t.Errorf("Replay of empty outbox = %d, %v, want 0, nil", n, err)
+	}
+}
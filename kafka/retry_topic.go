@@ -0,0 +1,140 @@
+package kafka
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/Shopify/sarama"
+
+	"github.com/wangping886/mns_consumer/logger"
+)
+
+// 重试 topic 消息的 headers.
+const (
+	HeaderRetryAttempt = "x-retry-attempt" // 第几次重试, 从 1 开始
+	HeaderRetryDelay   = "x-retry-delay"   // 重试的延迟, 比如 "30s"
+	HeaderRetryAt      = "x-retry-at"      // 可以开始重试的时间, unix 毫秒
+)
+
+// RetryTopic 返回 topic 的第 n 个重试 topic: topic.retry.n.
+func RetryTopic(topic string, n int) string {
+	return topic + ".retry." + strconv.Itoa(n)
+}
+
+// DeadLetterTopic 返回 topic 的死信 topic: topic.dlq.
+func DeadLetterTopic(topic string) string {
+	return topic + ".dlq"
+}
+
+// WithRetryTopics 打开重试 topic: handler(包括 WithMaxRetry 的重试)最终失败的消息由 producer 发送到
+// topic.retry.1, 带上 delays[0] 的延迟; 在 topic.retry.n 中仍然失败的发送到 topic.retry.n+1,
+// 最后一个重试 topic 失败后发送到 topic.dlq. 原始 topic, partition, offset 和错误信息保存在 headers 中,
+// 见 DeadLetterMessage. 和 MNS 队列按 DequeueCount 转移到死信队列的做法一致.
+//
+// consumer 同时订阅所有重试 topic, 重试 topic 的消息到时间之后才交给 handler;
+// 同一个重试 topic 的延迟相同, 等待队首消息不会耽误后面的消息. 重试 topic 和死信 topic 需要事先创建.
+func WithRetryTopics(producer *Producer, delays ...time.Duration) option {
+	return func(c *Consumer) {
+		c.retryProducer = producer
+		c.retryDelays = delays
+	}
+}
+
+// retryTopics 返回 topics 加上它们的所有重试 topic.
+func retryTopics(topics []string, n int) []string {
+	all := append([]string(nil), topics...)
+	for _, topic := range topics {
+		for i := 1; i <= n; i++ {
+			all = append(all, RetryTopic(topic, i))
+		}
+	}
+	return all
+}
+
+// waitRetry 等到重试 topic 的消息可以处理, partition 被回收或者 consumer 停止时返回 false.
+func (c *Consumer) waitRetry(ctx context.Context, revoked <-chan struct{}, msg *sarama.ConsumerMessage) bool {
+	at, _ := strconv.ParseInt(headerValue(msg, HeaderRetryAt), 10, 64)
+	if at == 0 {
+		return true
+	}
+	d := time.Until(time.Unix(0, at*int64(time.Millisecond)))
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-revoked:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+// republish 把处理失败的消息发送到下一个重试 topic 或者死信 topic, 发送失败时一直重试,
+// 直到成功或者 partition 被回收(返回 errRevoked).
+func (c *Consumer) republish(ctx context.Context, revoked <-chan struct{}, msg *sarama.ConsumerMessage, cause error) error {
+	topic := headerValue(msg, HeaderOriginalTopic)
+	if topic == "" {
+		topic = msg.Topic
+	}
+	attempt, _ := strconv.Atoi(headerValue(msg, HeaderRetryAttempt))
+	attempt++
+
+	var pm *sarama.ProducerMessage
+	if attempt <= len(c.retryDelays) {
+		pm = retryMessage(RetryTopic(topic, attempt), msg, cause, attempt, c.retryDelays[attempt-1])
+	} else {
+		pm = retryMessage(DeadLetterTopic(topic), msg, cause, 0, 0)
+	}
+
+	for {
+		err := c.retryProducer.SendSync(ctx, pm)
+		if err == nil {
+			c.logger.Warn("message republished", msgFields(msg, logger.F("to", pm.Topic), logger.Err(cause))...)
+			return nil
+		}
+		c.logger.Error("republish message failed", msgFields(msg, logger.F("to", pm.Topic), logger.Err(err))...)
+		select {
+		case <-time.After(c.retryBackoff):
+		case <-revoked:
+			return errRevoked
+		case <-ctx.Done():
+			return errRevoked
+		}
+	}
+}
+
+// retryMessage 生成发送到重试 topic(attempt > 0)或者死信 topic(attempt == 0)的消息.
+func retryMessage(topic string, msg *sarama.ConsumerMessage, cause error, attempt int, delay time.Duration) *sarama.ProducerMessage {
+	pm := DeadLetterMessage(topic, msg, cause)
+	headers := pm.Headers[:0]
+	for _, h := range pm.Headers {
+		switch string(h.Key) {
+		case HeaderRetryAttempt, HeaderRetryDelay, HeaderRetryAt:
+			continue
+		}
+		headers = append(headers, h)
+	}
+	pm.Headers = headers
+	if attempt > 0 {
+		at := time.Now().Add(delay).UnixNano() / int64(time.Millisecond)
+		pm.Headers = append(pm.Headers,
+			header(HeaderRetryAttempt, strconv.Itoa(attempt)),
+			header(HeaderRetryDelay, delay.String()),
+			header(HeaderRetryAt, strconv.FormatInt(at, 10)),
+		)
+	}
+	return pm
+}
+
+func headerValue(msg *sarama.ConsumerMessage, key string) string {
+	for _, h := range msg.Headers {
+		if string(h.Key) == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
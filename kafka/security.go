@@ -0,0 +1,255 @@
+package kafka
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	"github.com/Shopify/sarama"
+	"github.com/xdg-go/scram"
+)
+
+// SASL 认证机制
+const (
+	SASLPlain       = sarama.SASLTypePlaintext
+	SASLScramSHA256 = sarama.SASLTypeSCRAMSHA256
+	SASLScramSHA512 = sarama.SASLTypeSCRAMSHA512
+)
+
+// Security 是连接 kafka 的 TLS 和 SASL 配置. consumer 和 producer 分别通过 WithSecurity 和 WithProducerSecurity 使用它,
+// bridge 和 NewSource 使用的 consumer group 由 NewConsumerGroup 创建:
+//
+//	c, err := kafka.NewConsumer(brokers, "my-group", topics, handler, nil, kafka.WithSecurity(sec))
+//	p, err := kafka.NewProducer(brokers, nil, kafka.WithProducerSecurity(sec))
+//	group, err := kafka.NewConsumerGroup(brokers, "bridge-group", sec)
+//
+// 证书可以是 PEM 文件路径, 也可以直接是 PEM 内容(比如从环境变量读取), 同时设置时使用 PEM 内容.
+type Security struct {
+	TLS                bool   // 是否使用 TLS, 设置了任意证书时自动打开
+	CAFile             string // 验证 broker 证书的 CA, 为空时使用系统根证书
+	CertFile           string // 客户端证书(mTLS), 必须和 KeyFile 一起设置
+	KeyFile            string
+	CAPEM              []byte
+	CertPEM            []byte
+	KeyPEM             []byte
+	ServerName         string // 验证 broker 证书时使用的域名, 为空时使用连接的地址
+	InsecureSkipVerify bool   // 不验证 broker 证书, 只应该用于测试
+
+	SASLMechanism string // SASLPlain, SASLScramSHA256 或 SASLScramSHA512, 为空表示不使用 SASL
+	Username      string
+	Password      string
+}
+
+// SecurityFromEnv 从环境变量读取 Security, prefix 一般是 "KAFKA_":
+//
+//	KAFKA_TLS=true
+//	KAFKA_CA_FILE, KAFKA_CERT_FILE, KAFKA_KEY_FILE    PEM 文件路径
+//	KAFKA_CA_PEM, KAFKA_CERT_PEM, KAFKA_KEY_PEM       PEM 内容
+//	KAFKA_SERVER_NAME
+//	KAFKA_INSECURE_SKIP_VERIFY=true
+//	KAFKA_SASL_MECHANISM=SCRAM-SHA-512
+//	KAFKA_USERNAME, KAFKA_PASSWORD
+func SecurityFromEnv(prefix string) (*Security, error) {
+	var err error
+	env := func(name string) string {
+		return os.Getenv(prefix + name)
+	}
+	boolEnv := func(name string) bool {
+		v := env(name)
+		if v == "" || err != nil {
+			return false
+		}
+		b, err2 := strconv.ParseBool(v)
+		if err2 != nil {
+			err = fmt.Errorf("invalid %s%s: %s", prefix, name, err2.Error())
+		}
+		return b
+	}
+
+	sec := &Security{
+		TLS:                boolEnv("TLS"),
+		CAFile:             env("CA_FILE"),
+		CertFile:           env("CERT_FILE"),
+		KeyFile:            env("KEY_FILE"),
+		CAPEM:              []byte(env("CA_PEM")),
+		CertPEM:            []byte(env("CERT_PEM")),
+		KeyPEM:             []byte(env("KEY_PEM")),
+		ServerName:         env("SERVER_NAME"),
+		InsecureSkipVerify: boolEnv("INSECURE_SKIP_VERIFY"),
+		SASLMechanism:      env("SASL_MECHANISM"),
+		Username:           env("USERNAME"),
+		Password:           env("PASSWORD"),
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sec, nil
+}
+
+func (sec *Security) tlsEnabled() bool {
+	return sec.TLS || sec.CAFile != "" || sec.CertFile != "" || len(sec.CAPEM) > 0 || len(sec.CertPEM) > 0
+}
+
+// TLSConfig 加载证书并返回 tls.Config, 没有启用 TLS 时返回 nil.
+func (sec *Security) TLSConfig() (*tls.Config, error) {
+	if !sec.tlsEnabled() {
+		return nil, nil
+	}
+	config := &tls.Config{
+		ServerName:         sec.ServerName,
+		InsecureSkipVerify: sec.InsecureSkipVerify,
+	}
+
+	caPEM, err := pemOrFile(sec.CAPEM, sec.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("load CA failed: %s", err.Error())
+	}
+	if caPEM != nil {
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("no valid certificate found in CA")
+		}
+	}
+
+	certPEM, err := pemOrFile(sec.CertPEM, sec.CertFile)
+	if err != nil {
+		return nil, fmt.Errorf("load client certificate failed: %s", err.Error())
+	}
+	keyPEM, err := pemOrFile(sec.KeyPEM, sec.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load client key failed: %s", err.Error())
+	}
+	if (certPEM == nil) != (keyPEM == nil) {
+		return nil, errors.New("client certificate and key must be set together")
+	}
+	if certPEM != nil {
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("load client key pair failed: %s", err.Error())
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func pemOrFile(pem []byte, path string) ([]byte, error) {
+	if len(pem) > 0 {
+		return pem, nil
+	}
+	if path == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	return b, nil
+}
+
+// Apply 把 TLS 和 SASL 配置写入 config.
+func (sec *Security) Apply(config *sarama.Config) error {
+	tlsConfig, err := sec.TLSConfig()
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+
+	switch sec.SASLMechanism {
+	case "":
+		return nil
+	case SASLPlain:
+	case SASLScramSHA256:
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hash: scram.SHA256}
+		}
+	case SASLScramSHA512:
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hash: scram.SHA512}
+		}
+	default:
+		return fmt.Errorf("unsupported SASL mechanism %q", sec.SASLMechanism)
+	}
+	if sec.Username == "" || sec.Password == "" {
+		return errors.New("SASL username and password must not be empty")
+	}
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Mechanism = sarama.SASLMechanism(sec.SASLMechanism)
+	config.Net.SASL.User = sec.Username
+	config.Net.SASL.Password = sec.Password
+	config.Net.SASL.Handshake = true
+	if config.Version.IsAtLeast(sarama.V1_0_0_0) {
+		config.Net.SASL.Version = sarama.SASLHandshakeV1
+	}
+	return nil
+}
+
+// NewSecureConfig 返回应用了 sec 的 NewConfig().
+func NewSecureConfig(sec *Security) (*sarama.Config, error) {
+	config := NewConfig()
+	if sec == nil {
+		return config, nil
+	}
+	if err := sec.Apply(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// NewConsumerGroup 用应用了 sec 的 NewConfig() 创建 consumer group, 供 NewSource 和 bridge 使用, sec 可以为 nil.
+func NewConsumerGroup(brokers []string, groupID string, sec *Security) (sarama.ConsumerGroup, error) {
+	config, err := NewSecureConfig(sec)
+	if err != nil {
+		return nil, err
+	}
+	return sarama.NewConsumerGroup(brokers, groupID, config)
+}
+
+// secureConfig 返回应用了 sec 的 config 副本, config 为 nil 时使用 newConfig(), 不修改调用方的 config.
+func secureConfig(config *sarama.Config, newConfig func() *sarama.Config, sec *Security) (*sarama.Config, error) {
+	if config == nil {
+		config = newConfig()
+	} else if sec != nil {
+		copied := *config
+		config = &copied
+	}
+	if sec == nil {
+		return config, nil
+	}
+	if err := sec.Apply(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// scramClient 用 xdg-go/scram 实现 sarama.SCRAMClient.
+type scramClient struct {
+	hash         scram.HashGeneratorFcn
+	conversation *scram.ClientConversation
+}
+
+func (c *scramClient) Begin(userName, password, authzID string) error {
+	client, err := c.hash.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.conversation = client.NewConversation()
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.conversation.Step(challenge)
+}
+
+func (c *scramClient) Done() bool {
+	return c.conversation.Done()
+}
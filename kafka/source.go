@@ -0,0 +1,287 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+
+	"github.com/wangping886/mns_consumer/logger"
+	"github.com/wangping886/mns_consumer/source"
+	"github.com/wangping886/mns_consumer/tracing"
+)
+
+const defaultDrainTimeout = 30 * time.Second
+
+// Source 是 kafka consumer group 的 source.Source 实现, 分配到的 partition 的消息合并成一个流.
+// 消息可以被乱序确认, offset 只提交到每个 partition 最小的未确认消息;
+// Nack 的消息在 delay 之后重新交给 Fetch, Extend 不需要做任何事情.
+// rebalance 时最多等待 WithDrainTimeout 让已经取出的消息确认完, 然后提交 offset, 交出 partition.
+type Source struct {
+	group        sarama.ConsumerGroup
+	topics       []string
+	name         string
+	msgs         chan *source.Message
+	commitEvery  time.Duration
+	drainTimeout time.Duration
+	logger       logger.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type sourceOption func(s *Source)
+
+// NewSource 开始消费 group 的 topics, group 由调用方创建和关闭, 推荐使用 NewConsumerGroup 创建.
+func NewSource(group sarama.ConsumerGroup, topics []string, options ...sourceOption) (*Source, error) {
+	if len(topics) == 0 {
+		return nil, errors.New("kafka source: no topics")
+	}
+	s := &Source{
+		group:        group,
+		topics:       topics,
+		name:         topics[0],
+		commitEvery:  defaultCommitInterval,
+		drainTimeout: defaultDrainTimeout,
+		logger:       logger.Std,
+		msgs:         make(chan *source.Message, defaultQueSize),
+		done:         make(chan struct{}),
+	}
+	for _, o := range options {
+		o(s)
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	go s.serve()
+	return s, nil
+}
+
+// WithSourceCommitInterval 设置提交 offset 的间隔, 默认 1 秒.
+func WithSourceCommitInterval(d time.Duration) sourceOption {
+	return func(s *Source) {
+		s.commitEvery = d
+	}
+}
+
+// WithDrainTimeout 设置 rebalance 时等待已经取出的消息确认的最长时间, 默认 30 秒,
+// 应该小于 config.Consumer.Group.Rebalance.Timeout.
+func WithDrainTimeout(d time.Duration) sourceOption {
+	return func(s *Source) {
+		s.drainTimeout = d
+	}
+}
+
+func WithSourceLogger(l logger.Logger) sourceOption {
+	return func(s *Source) {
+		s.logger = l
+	}
+}
+
+// sourceMessage 是 Source 的原始消息.
+type sourceMessage struct {
+	msg     *sarama.ConsumerMessage
+	session *sourceSession
+	tracker *offsetTracker
+}
+
+// Message 返回 source.Message 对应的 kafka 消息.
+func Message(m *source.Message) (*sarama.ConsumerMessage, bool) {
+	raw, ok := m.Raw().(*sourceMessage)
+	if !ok {
+		return nil, false
+	}
+	return raw.msg, true
+}
+
+func (s *Source) Name() string {
+	return s.name
+}
+
+func (s *Source) Fetch(ctx context.Context) ([]*source.Message, error) {
+	var result []*source.Message
+	for len(result) < 16 {
+		var m *source.Message
+		if len(result) == 0 {
+			select {
+			case m = <-s.msgs:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-s.done:
+				return nil, errors.New("kafka source closed")
+			}
+		} else {
+			select {
+			case m = <-s.msgs:
+			default:
+				return result, nil
+			}
+		}
+
+		// 已经被回收的 partition 的消息不再处理, 由下一个 owner 重新消费
+		raw := m.Raw().(*sourceMessage)
+		if raw.session.sess.Context().Err() != nil {
+			raw.session.outstanding.Done()
+			continue
+		}
+		result = append(result, m)
+	}
+	return result, nil
+}
+
+func (s *Source) Ack(ctx context.Context, msg *source.Message) error {
+	raw := msg.Raw().(*sourceMessage)
+	raw.tracker.finish(raw.msg.Offset)
+	raw.session.outstanding.Done()
+	return nil
+}
+
+// Nack 在 delay 之后把消息重新交给 Fetch, 期间 partition 被回收时放弃这条消息.
+func (s *Source) Nack(ctx context.Context, msg *source.Message, delay time.Duration) error {
+	raw := msg.Raw().(*sourceMessage)
+	go func() {
+		select {
+		case <-time.After(delay):
+		case <-raw.session.sess.Context().Done():
+			raw.session.outstanding.Done()
+			return
+		}
+		msg.Attempt++
+		select {
+		case s.msgs <- msg:
+		case <-raw.session.sess.Context().Done():
+			raw.session.outstanding.Done()
+		}
+	}()
+	return nil
+}
+
+// Extend 什么也不做, consumer group 的 session 由 sarama 的心跳维持.
+func (s *Source) Extend(ctx context.Context, msg *source.Message, d time.Duration) error {
+	return nil
+}
+
+// Close 停止消费并提交 offset, 调用之前应该已经确认完所有取出的消息.
+func (s *Source) Close() error {
+	s.cancel()
+	<-s.done
+	return nil
+}
+
+func (s *Source) serve() {
+	defer close(s.done)
+
+	handler := &sourceHandler{s: s}
+	for {
+		err := s.group.Consume(s.ctx, s.topics, handler)
+		if s.ctx.Err() != nil || errors.Is(err, sarama.ErrClosedConsumerGroup) {
+			return
+		}
+		if err != nil {
+			s.logger.Error("consume failed", logger.F("topics", s.topics), logger.Err(err))
+			select {
+			case <-time.After(time.Second):
+			case <-s.ctx.Done():
+			}
+		}
+	}
+}
+
+// sourceSession 是一次 rebalance 分配的 session, outstanding 是已经交给 msgs 但还没有确认的消息.
+type sourceSession struct {
+	sess        sarama.ConsumerGroupSession
+	committer   *offsetCommitter
+	outstanding sync.WaitGroup
+}
+
+// sourceHandler 实现 sarama.ConsumerGroupHandler.
+type sourceHandler struct {
+	s       *Source
+	session *sourceSession
+}
+
+func (h *sourceHandler) Setup(sess sarama.ConsumerGroupSession) error {
+	h.s.logger.Info("partitions assigned", logger.F("member", sess.MemberID()), logger.F("claims", sess.Claims()))
+	h.session = &sourceSession{
+		sess:      sess,
+		committer: startOffsetCommitter(sess, h.s.commitEvery),
+	}
+	return nil
+}
+
+// Cleanup 等待已经取出的消息确认完(最多 drainTimeout), 然后提交 offset.
+func (h *sourceHandler) Cleanup(sess sarama.ConsumerGroupSession) error {
+	drained := make(chan struct{})
+	go func() {
+		h.session.outstanding.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(h.s.drainTimeout):
+		h.s.logger.Warn("drain timeout, unfinished messages will be redelivered", logger.F("member", sess.MemberID()))
+	case <-h.s.ctx.Done():
+		// Close 之前调用方已经确认完所有能处理的消息, 剩下的不用再等
+	}
+	h.session.committer.close(sess)
+	h.s.logger.Info("partitions revoked", logger.F("member", sess.MemberID()))
+	return nil
+}
+
+func (h *sourceHandler) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	session := h.session
+	tracker := session.committer.tracker(claim.Topic(), claim.Partition())
+	for {
+		select {
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			tracker.add(msg.Offset)
+			session.outstanding.Add(1)
+			select {
+			case h.s.msgs <- newSourceMessage(msg, session, tracker):
+			case <-sess.Context().Done():
+				session.outstanding.Done()
+				return nil
+			}
+		case <-sess.Context().Done():
+			return nil
+		}
+	}
+}
+
+func newSourceMessage(msg *sarama.ConsumerMessage, session *sourceSession, tracker *offsetTracker) *source.Message {
+	headers, body, _ := tracing.Open(msg.Value)
+	return toSourceMessage(&sourceMessage{msg: msg, session: session, tracker: tracker}, msg, headers, body)
+}
+
+// toSourceMessage 把 kafka 消息转换成 source.Message, headers 和 body 是拆开信封的结果, 合并 kafka 消息的 headers.
+func toSourceMessage(raw interface{}, msg *sarama.ConsumerMessage, headers map[string]string, body []byte) *source.Message {
+	m := source.NewMessage(raw)
+	m.ID = msg.Topic + "/" + strconv.Itoa(int(msg.Partition)) + "/" + strconv.FormatInt(msg.Offset, 10)
+	m.Key = msg.Key
+	m.Timestamp = msg.Timestamp
+	m.Attempt = 1
+
+	if headers == nil && len(msg.Headers) > 0 {
+		headers = make(map[string]string, len(msg.Headers))
+	}
+	for _, rh := range msg.Headers {
+		headers[string(rh.Key)] = string(rh.Value)
+	}
+	m.Headers = headers
+	m.Body = body
+	return m
+}
+
+// SourceHandler 把 source.Handler 转换成 Handler, 同一个 handler 可以通过 consumer.SourceHandler 消费 MNS 队列.
+// source.Message 的 Headers 合并了消息信封和 kafka 消息的 headers, Raw 返回 *sarama.ConsumerMessage.
+func SourceHandler(h source.Handler) Handler {
+	return func(ctx context.Context, msg *sarama.ConsumerMessage) error {
+		headers, _ := ctx.Value(headersKey{}).(map[string]string)
+		return h(ctx, toSourceMessage(msg, msg, headers, msg.Value))
+	}
+}
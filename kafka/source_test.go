@@ -0,0 +1,116 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+
+	"github.com/wangping886/mns_consumer/logger"
+	"github.com/wangping886/mns_consumer/source"
+)
+
+// testGroup 是只分配一个 claim 的 sarama.ConsumerGroup, Consume 在 ctx 取消时结束 session.
+type testGroup struct {
+	claim testClaim
+
+	mu   sync.Mutex
+	sess *testSession
+}
+
+func (g *testGroup) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	sess := newTestSession(ctx)
+	g.mu.Lock()
+	g.sess = sess
+	g.mu.Unlock()
+
+	if err := handler.Setup(sess); err != nil {
+		return err
+	}
+	claimed := make(chan struct{})
+	go func() {
+		defer close(claimed)
+		handler.ConsumeClaim(sess, g.claim)
+	}()
+	<-ctx.Done()
+	<-claimed
+	return handler.Cleanup(sess)
+}
+
+func (g *testGroup) Errors() <-chan error { return nil }
+func (g *testGroup) Close() error         { return nil }
+
+func (g *testGroup) session() *testSession {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.sess
+}
+
+// TestRuntimeOverSource 用 source.Runtime 驱动 kafka Source: 失败的消息 Nack 之后重新投递,
+// 全部确认后 Close 提交最后一条消息的下一个 offset.
+func TestRuntimeOverSource(t *testing.T) {
+	claim, pc := newTestClaim(t, "orders", 0)
+	defer claim.Close()
+	group := &testGroup{claim: claim}
+
+	for i := 0; i < 4; i++ {
+		pc.YieldMessage(&sarama.ConsumerMessage{Value: []byte("v"), Headers: []*sarama.RecordHeader{{Key: []byte("h"), Value: []byte("1")}}})
+	}
+
+	src, err := NewSource(group, []string{"orders"}, WithSourceCommitInterval(time.Hour), WithSourceLogger(logger.Nop))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu      sync.Mutex
+		handled = make(map[int64][]int) // offset -> 每次处理时的 Attempt
+	)
+	allDone := make(chan struct{})
+	handler := func(ctx context.Context, msg *source.Message) error {
+		km, ok := Message(msg)
+		if !ok {
+			t.Error("source message is not from kafka")
+			return nil
+		}
+		if msg.Headers["h"] != "1" || string(msg.Body) != "v" {
+			t.Errorf("message headers %v body %q, want headers and body of the kafka message", msg.Headers, msg.Body)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		handled[km.Offset] = append(handled[km.Offset], msg.Attempt)
+		if km.Offset == 2 && msg.Attempt == 1 {
+			return errors.New("first attempt fails")
+		}
+		if len(handled) == 4 && len(handled[2]) == 2 {
+			close(allDone)
+		}
+		return nil
+	}
+	r := source.NewRuntime(src, handler, source.WithRetry(0, 10*time.Millisecond), source.WithLogger(logger.Nop))
+	r.Start()
+
+	select {
+	case <-allDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("messages not handled")
+	}
+	r.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts := handled[2]; len(attempts) != 2 || attempts[1] != 2 {
+		t.Errorf("attempts of offset 2 = %v, want [1 2]", attempts)
+	}
+	sess := group.session()
+	// mocks.PartitionConsumer 的 offset 从 1 开始
+	if offset, ok := sess.markedOffset("orders", 0); !ok || offset != 5 {
+		t.Errorf("marked offset = %d, %v, want 5", offset, ok)
+	}
+	if sess.commits == 0 {
+		t.Error("offsets not committed on Close")
+	}
+}
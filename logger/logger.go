@@ -0,0 +1,119 @@
+package logger
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// Logger 是分级的结构化日志接口, 实现必须是并发安全的.
+// 可以通过 slogadapter, logrusadapter, zapadapter 接入常用的日志库.
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+}
+
+// Field 是一个 key/value 日志字段.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F 返回一个日志字段.
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Err 返回 key 为 "err" 的日志字段.
+func Err(err error) Field {
+	return Field{Key: "err", Value: err}
+}
+
+// Level 是日志级别.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// Std 把 info 及以上级别的日志以 logfmt 格式写到标准库的 log 包, 是默认的 Logger.
+// 需要 debug 日志(比如每次空轮询和每次删除消息)时使用 NewStd(LevelDebug).
+var Std Logger = NewStd(LevelInfo)
+
+// Nop 丢弃所有日志.
+var Nop Logger = nopLogger{}
+
+// NewStd 返回和 Std 一样写到标准库 log 包的 Logger, 低于 min 的日志被丢弃.
+func NewStd(min Level) Logger {
+	return stdLogger{min: min}
+}
+
+type stdLogger struct {
+	min Level
+}
+
+func (l stdLogger) Debug(msg string, fields ...Field) { l.output(LevelDebug, "debug", msg, fields) }
+func (l stdLogger) Info(msg string, fields ...Field)  { l.output(LevelInfo, "info", msg, fields) }
+func (l stdLogger) Warn(msg string, fields ...Field)  { l.output(LevelWarn, "warn", msg, fields) }
+func (l stdLogger) Error(msg string, fields ...Field) { l.output(LevelError, "error", msg, fields) }
+
+func (l stdLogger) output(level Level, name, msg string, fields []Field) {
+	if level < l.min {
+		return
+	}
+	stdOutput(name, msg, fields)
+}
+
+func stdOutput(level, msg string, fields []Field) {
+	var buf bytes.Buffer
+	buf.WriteString("level=")
+	buf.WriteString(level)
+	buf.WriteString(" msg=")
+	buf.WriteString(strconv.Quote(msg))
+	for _, f := range fields {
+		buf.WriteByte(' ')
+		buf.WriteString(f.Key)
+		buf.WriteByte('=')
+		buf.WriteString(logfmtValue(f.Value))
+	}
+	log.Output(4, buf.String())
+}
+
+// logfmtValue 格式化字段值, 包含空格, 引号或者等号的值会加上引号.
+func logfmtValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case nil:
+		return "<nil>"
+	case string:
+		s = v
+	case error:
+		s = v.Error()
+	case fmt.Stringer:
+		s = v.String()
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" {
+		return `""`
+	}
+	for _, r := range s {
+		if r <= ' ' || r == '"' || r == '=' {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, fields ...Field) {}
+func (nopLogger) Info(msg string, fields ...Field)  {}
+func (nopLogger) Warn(msg string, fields ...Field)  {}
+func (nopLogger) Error(msg string, fields ...Field) {}
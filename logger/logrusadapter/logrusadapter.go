@@ -0,0 +1,33 @@
+// Package logrusadapter 把 logrus 适配为 logger.Logger.
+package logrusadapter
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"github.com/wangping886/mns_consumer/logger"
+)
+
+type adapter struct {
+	l logrus.FieldLogger
+}
+
+// New 返回写到 l 的 logger.Logger, l 为 nil 时使用 logrus.StandardLogger().
+func New(l logrus.FieldLogger) logger.Logger {
+	if l == nil {
+		l = logrus.StandardLogger()
+	}
+	return adapter{l: l}
+}
+
+func (a adapter) Debug(msg string, fields ...logger.Field) { a.entry(fields).Debug(msg) }
+func (a adapter) Info(msg string, fields ...logger.Field)  { a.entry(fields).Info(msg) }
+func (a adapter) Warn(msg string, fields ...logger.Field)  { a.entry(fields).Warn(msg) }
+func (a adapter) Error(msg string, fields ...logger.Field) { a.entry(fields).Error(msg) }
+
+func (a adapter) entry(fields []logger.Field) *logrus.Entry {
+	fs := make(logrus.Fields, len(fields))
+	for _, f := range fields {
+		fs[f.Key] = f.Value
+	}
+	return a.l.WithFields(fs)
+}
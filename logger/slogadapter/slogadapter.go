@@ -0,0 +1,42 @@
+// Package slogadapter 把 *slog.Logger 适配为 logger.Logger.
+package slogadapter
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/wangping886/mns_consumer/logger"
+)
+
+type adapter struct {
+	l *slog.Logger
+}
+
+// New 返回写到 l 的 logger.Logger, l 为 nil 时使用 slog.Default().
+func New(l *slog.Logger) logger.Logger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return adapter{l: l}
+}
+
+func (a adapter) Debug(msg string, fields ...logger.Field) { a.log(slog.LevelDebug, msg, fields) }
+func (a adapter) Info(msg string, fields ...logger.Field)  { a.log(slog.LevelInfo, msg, fields) }
+func (a adapter) Warn(msg string, fields ...logger.Field)  { a.log(slog.LevelWarn, msg, fields) }
+func (a adapter) Error(msg string, fields ...logger.Field) { a.log(slog.LevelError, msg, fields) }
+
+func (a adapter) log(level slog.Level, msg string, fields []logger.Field) {
+	ctx := context.Background()
+	if !a.l.Enabled(ctx, level) {
+		return
+	}
+	attrs := make([]slog.Attr, len(fields))
+	for i, f := range fields {
+		if err, ok := f.Value.(error); ok {
+			attrs[i] = slog.String(f.Key, err.Error())
+			continue
+		}
+		attrs[i] = slog.Any(f.Key, f.Value)
+	}
+	a.l.LogAttrs(ctx, level, msg, attrs...)
+}
@@ -0,0 +1,38 @@
+// Package zapadapter 把 *zap.Logger 适配为 logger.Logger.
+package zapadapter
+
+import (
+	"go.uber.org/zap"
+
+	"github.com/wangping886/mns_consumer/logger"
+)
+
+type adapter struct {
+	l *zap.Logger
+}
+
+// New 返回写到 l 的 logger.Logger, l 为 nil 时使用 zap.L().
+func New(l *zap.Logger) logger.Logger {
+	if l == nil {
+		l = zap.L()
+	}
+	// 跳过 adapter 自己这一层, 让 caller 指向真正打日志的位置
+	return adapter{l: l.WithOptions(zap.AddCallerSkip(1))}
+}
+
+func (a adapter) Debug(msg string, fields ...logger.Field) { a.l.Debug(msg, zapFields(fields)...) }
+func (a adapter) Info(msg string, fields ...logger.Field)  { a.l.Info(msg, zapFields(fields)...) }
+func (a adapter) Warn(msg string, fields ...logger.Field)  { a.l.Warn(msg, zapFields(fields)...) }
+func (a adapter) Error(msg string, fields ...logger.Field) { a.l.Error(msg, zapFields(fields)...) }
+
+func zapFields(fields []logger.Field) []zap.Field {
+	zfs := make([]zap.Field, len(fields))
+	for i, f := range fields {
+		if err, ok := f.Value.(error); ok {
+			zfs[i] = zap.NamedError(f.Key, err)
+			continue
+		}
+		zfs[i] = zap.Any(f.Key, f.Value)
+	}
+	return zfs
+}
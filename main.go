@@ -4,9 +4,9 @@ import (
 	"context"
 	"github.com/wangping886/mns_consumer/consumer"
 	"github.com/wangping886/mns_consumer/mns.aliyun"
-	"signal"
 	"log"
 	"os"
+	"os/signal"
 	"syscall"
 )
 
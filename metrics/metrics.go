@@ -0,0 +1,35 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/wangping886/mns_consumer/mns.aliyun"
+)
+
+// Metrics 收集 consumer.Consumer 和 mns 客户端的运行指标, 实现必须是并发安全的.
+// queue 参数是队列名.
+type Metrics interface {
+	mns.ApiObserver
+
+	MessagesReceived(queue string, n int)                    // 一次 BatchReceiveMessage 收到的消息数
+	EmptyReceive(queue string)                               // 一次长轮询没有收到任何消息
+	MessageHandled(queue string, d time.Duration, err error) // handler 执行完成, err 不为 nil 表示处理失败
+	MessageDeleted(queue string)                             // 消息被成功删除
+	MessageDeadLettered(queue string)                        // 消息超过最大投递次数, 被转移到死信队列
+	InFlight(queue string, delta int)                        // 正在执行的 handler 数量变化
+	MessageLag(queue string, lag time.Duration)              // 从消息入队(EnqueueTime)到开始处理的时间
+}
+
+// Nop 是不做任何事情的 Metrics, 是 consumer 的默认值.
+var Nop Metrics = nop{}
+
+type nop struct{}
+
+func (nop) ObserveApiCall(operation, resource string, duration time.Duration, err error) {}
+func (nop) MessagesReceived(queue string, n int)                                         {}
+func (nop) EmptyReceive(queue string)                                                    {}
+func (nop) MessageHandled(queue string, d time.Duration, err error)                      {}
+func (nop) MessageDeleted(queue string)                                                  {}
+func (nop) MessageDeadLettered(queue string)                                             {}
+func (nop) InFlight(queue string, delta int)                                             {}
+func (nop) MessageLag(queue string, lag time.Duration)                                   {}
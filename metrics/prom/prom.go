@@ -0,0 +1,149 @@
+// Package prom 是 metrics.Metrics 的 prometheus 实现.
+//
+//	m := prom.New(nil)
+//	c := consumer.NewConsumer("queue", handler, consumer.WithMetrics(m))
+//	http.Handle("/metrics", prom.Handler())
+package prom
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/wangping886/mns_consumer/metrics"
+	"github.com/wangping886/mns_consumer/mns.aliyun"
+)
+
+const namespace = "mns"
+
+var _ metrics.Metrics = (*Metrics)(nil)
+
+type Metrics struct {
+	received     *prometheus.CounterVec
+	emptyPolls   *prometheus.CounterVec
+	handled      *prometheus.CounterVec
+	failed       *prometheus.CounterVec
+	deleted      *prometheus.CounterVec
+	deadLettered *prometheus.CounterVec
+	handlerTime  *prometheus.HistogramVec
+	inFlight     *prometheus.GaugeVec
+	lag          *prometheus.HistogramVec
+	apiTime      *prometheus.HistogramVec
+	apiErrors    *prometheus.CounterVec
+}
+
+// New 创建全部指标并注册到 reg, reg 为 nil 时注册到 prometheus.DefaultRegisterer.
+// 同一个 reg 只能调用一次 New, 多个 consumer 应该共享同一个 *Metrics.
+func New(reg prometheus.Registerer) *Metrics {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+
+	queueLabels := []string{"queue"}
+	m := &Metrics{
+		received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "consumer", Name: "messages_received_total",
+			Help: "Number of messages received from the queue.",
+		}, queueLabels),
+		emptyPolls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "consumer", Name: "empty_receives_total",
+			Help: "Number of long polls that returned no message.",
+		}, queueLabels),
+		handled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "consumer", Name: "messages_handled_total",
+			Help: "Number of messages the handler processed successfully.",
+		}, queueLabels),
+		failed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "consumer", Name: "messages_failed_total",
+			Help: "Number of messages the handler failed to process.",
+		}, queueLabels),
+		deleted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "consumer", Name: "messages_deleted_total",
+			Help: "Number of messages deleted from the queue.",
+		}, queueLabels),
+		deadLettered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "consumer", Name: "messages_dead_lettered_total",
+			Help: "Number of messages moved to the dead-letter queue.",
+		}, queueLabels),
+		handlerTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "consumer", Name: "handler_duration_seconds",
+			Help:    "Handler latency.",
+			Buckets: prometheus.DefBuckets,
+		}, queueLabels),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "consumer", Name: "in_flight",
+			Help: "Number of handlers currently running.",
+		}, queueLabels),
+		lag: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "consumer", Name: "message_lag_seconds",
+			Help:    "Time from EnqueueTime to the start of handling.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 16),
+		}, queueLabels),
+		apiTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "api", Name: "call_duration_seconds",
+			Help:    "MNS api call latency.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"operation", "resource"}),
+		apiErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "api", Name: "errors_total",
+			Help: "MNS api call errors by ApiError.Code.",
+		}, []string{"operation", "resource", "code"}),
+	}
+
+	reg.MustRegister(m.received, m.emptyPolls, m.handled, m.failed, m.deleted, m.deadLettered,
+		m.handlerTime, m.inFlight, m.lag, m.apiTime, m.apiErrors)
+	return m
+}
+
+// Handler 返回暴露 prometheus.DefaultGatherer 的 /metrics handler.
+// 使用自定义 Registry 时请用 promhttp.HandlerFor.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+func (m *Metrics) ObserveApiCall(operation, resource string, duration time.Duration, err error) {
+	m.apiTime.WithLabelValues(operation, resource).Observe(duration.Seconds())
+	if err == nil {
+		return
+	}
+	code := "ClientError" // 网络错误, 超时, 响应解析失败等
+	if apiErr, ok := err.(*mns.ApiError); ok && apiErr.Code != "" {
+		code = apiErr.Code
+	}
+	m.apiErrors.WithLabelValues(operation, resource, code).Inc()
+}
+
+func (m *Metrics) MessagesReceived(queue string, n int) {
+	m.received.WithLabelValues(queue).Add(float64(n))
+}
+
+func (m *Metrics) EmptyReceive(queue string) {
+	m.emptyPolls.WithLabelValues(queue).Inc()
+}
+
+func (m *Metrics) MessageHandled(queue string, d time.Duration, err error) {
+	m.handlerTime.WithLabelValues(queue).Observe(d.Seconds())
+	if err != nil {
+		m.failed.WithLabelValues(queue).Inc()
+		return
+	}
+	m.handled.WithLabelValues(queue).Inc()
+}
+
+func (m *Metrics) MessageDeleted(queue string) {
+	m.deleted.WithLabelValues(queue).Inc()
+}
+
+func (m *Metrics) MessageDeadLettered(queue string) {
+	m.deadLettered.WithLabelValues(queue).Inc()
+}
+
+func (m *Metrics) InFlight(queue string, delta int) {
+	m.inFlight.WithLabelValues(queue).Add(float64(delta))
+}
+
+func (m *Metrics) MessageLag(queue string, lag time.Duration) {
+	m.lag.WithLabelValues(queue).Observe(lag.Seconds())
+}
@@ -0,0 +1,68 @@
+package mns
+
+import (
+	"container/list"
+	"crypto/rsa"
+	"sync"
+	"time"
+)
+
+// certCache 是有容量上限和过期时间的 LRU 缓存, 缓存已经下载并解析过的证书公钥.
+type certCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	ll      *list.List // 最近使用的在前面
+	entries map[string]*list.Element
+}
+
+type certCacheEntry struct {
+	url      string
+	key      *rsa.PublicKey
+	expireAt time.Time
+}
+
+func newCertCache(size int, ttl time.Duration) *certCache {
+	return &certCache{
+		size:    size,
+		ttl:     ttl,
+		ll:      list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *certCache) get(url string) (*rsa.PublicKey, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[url]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*certCacheEntry)
+	if time.Now().After(entry.expireAt) {
+		c.ll.Remove(e)
+		delete(c.entries, url)
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return entry.key, true
+}
+
+func (c *certCache) set(url string, key *rsa.PublicKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &certCacheEntry{url: url, key: key, expireAt: time.Now().Add(c.ttl)}
+	if e, ok := c.entries[url]; ok {
+		e.Value = entry
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.entries[url] = c.ll.PushFront(entry)
+	for c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.entries, oldest.Value.(*certCacheEntry).url)
+	}
+}
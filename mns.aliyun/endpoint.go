@@ -10,37 +10,100 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"sort"
 	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCertHosts 是 NotificationVerifier 默认允许的签名证书 host, 可以在使用之前覆盖.
+// 每一项可以是 host, 也可以是带 scheme 的 "https://host", 带 scheme 时实际下载证书的 URL 的 scheme 也要一致.
+// 其他地域的 host 取自所在地域 MNS 推送请求的 x-mns-signing-cert-url 请求头.
+var DefaultCertHosts = []string{"https://mnstest.oss-cn-hangzhou.aliyuncs.com"}
 
-	"github.com/chanxuehong/lrucache"
+const (
+	defaultCertTimeout   = 5 * time.Second
+	defaultCertCacheSize = 100
+	defaultCertCacheTTL  = time.Hour
+	defaultMaxClockSkew  = 15 * time.Minute
+	maxCertificateSize   = 64 << 10
 )
 
-var __certCache = lrucache.New(100) // 缓存已经下载并解析过的 X509 证书
+var __defaultVerifier = &NotificationVerifier{}
+
+// NotificationVerifier 验证消息通知的来源, 零值可以直接使用, 字段的零值表示使用默认值.
+// 设置好字段之后再并发使用, 使用过程中不要修改字段.
+type NotificationVerifier struct {
+	AllowedHosts []string      // 允许的签名证书 host, 格式同 DefaultCertHosts, 默认 DefaultCertHosts
+	AllowHTTP    bool          // 为 false 时无论证书 URL 是 http 还是 https 都通过 https 下载
+	HttpClient   *http.Client  // 下载证书使用的 client, 默认是超时时间为 Timeout 的 client
+	Timeout      time.Duration // 下载证书的超时时间, 默认 5 秒, HttpClient 不为 nil 时无效
+	CacheSize    int           // 最多缓存的证书数, 默认 100
+	CacheTTL     time.Duration // 证书缓存时间, 默认 1 小时
+	MaxClockSkew time.Duration // Date 请求头和本地时间允许的最大偏差, 用来防止重放, 默认 15 分钟, 小于 0 表示不检查
+
+	once       sync.Once
+	httpClient *http.Client
+	cache      *certCache
+}
+
+func (v *NotificationVerifier) init() {
+	v.once.Do(func() {
+		v.httpClient = v.HttpClient
+		if v.httpClient == nil {
+			timeout := v.Timeout
+			if timeout <= 0 {
+				timeout = defaultCertTimeout
+			}
+			v.httpClient = &http.Client{
+				Timeout: timeout,
+				// 不跟随重定向, 避免从白名单以外的 host 下载证书
+				CheckRedirect: func(*http.Request, []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			}
+		}
+		size := v.CacheSize
+		if size <= 0 {
+			size = defaultCertCacheSize
+		}
+		ttl := v.CacheTTL
+		if ttl <= 0 {
+			ttl = defaultCertCacheTTL
+		}
+		v.cache = newCertCache(size, ttl)
+	})
+}
 
-// VerifyNotification 验证消息通知来源
+// VerifyNotification 验证消息通知来源, 使用默认配置的 NotificationVerifier.
 //  req:  消息通知的回调请求的 http.Request 结构
 //  body: 消息通知的回调请求的 http body
 func VerifyNotification(req *http.Request, body []byte) (ok bool, err error) {
-	return verifyNotification(req, body, true)
+	return __defaultVerifier.Verify(req, body)
 }
 
-// verifyNotification 验证消息通知来源
-//  req:              消息通知的回调请求的 http.Request 结构
-//  body:             消息通知的回调请求的 http body
-//  verifyContentMD5: 为 true 时验证 Content-MD5 请求头
-func verifyNotification(req *http.Request, body []byte, verifyContentMD5 bool) (bool, error) {
+// Verify 验证消息通知来源
+//  req:  消息通知的回调请求的 http.Request 结构
+//  body: 消息通知的回调请求的 http body
+func (v *NotificationVerifier) Verify(req *http.Request, body []byte) (bool, error) {
+	v.init()
+
 	// 验证 Content-MD5 header, 如果存在的话
-	if verifyContentMD5 {
-		if haveContentMD5 := req.Header.Get("Content-Md5"); haveContentMD5 != "" {
-			if wantContentMD5 := contentMD5(body); haveContentMD5 != wantContentMD5 {
-				return false, fmt.Errorf("Content-MD5 mismatch, have %s, want %s", haveContentMD5, wantContentMD5)
-			}
+	if haveContentMD5 := req.Header.Get("Content-Md5"); haveContentMD5 != "" {
+		if wantContentMD5 := contentMD5(body); haveContentMD5 != wantContentMD5 {
+			return false, fmt.Errorf("Content-MD5 mismatch, have %s, want %s", haveContentMD5, wantContentMD5)
 		}
 	}
 
+	// 验证 Date header, Date 参与了签名, 超出时间窗口的请求视为重放
+	if err := v.verifyDate(req.Header.Get("Date")); err != nil {
+		return false, err
+	}
+
 	// 获取 Authorization header
 	Authorization := req.Header.Get("Authorization")
 	if Authorization == "" {
@@ -56,13 +119,13 @@ func verifyNotification(req *http.Request, body []byte, verifyContentMD5 bool) (
 	if err != nil {
 		return false, fmt.Errorf("invalid x-mns-signing-cert-url header: %s", base64CertURL)
 	}
-	certURL := string(certURLBytes)
-	if !strings.HasPrefix(certURL, "http://mnstest.oss-cn-hangzhou.aliyuncs.com/") {
-		return false, fmt.Errorf("invalid x-mns-signing-cert-url header: %s", base64CertURL)
+	certURL, err := v.certURL(string(certURLBytes))
+	if err != nil {
+		return false, err
 	}
 
 	// 下载并解析 x-mns-signing-cert-url 证书
-	pubKey, err := getRSAPublicKey(certURL)
+	pubKey, err := v.getRSAPublicKey(certURL)
 	if err != nil {
 		return false, err
 	}
@@ -74,39 +137,89 @@ func verifyNotification(req *http.Request, body []byte, verifyContentMD5 bool) (
 	return rsaVerify(signStr, pubKey, Authorization)
 }
 
-func getRSAPublicKey(certURL string) (key *rsa.PublicKey, err error) {
-	cachedValue, err := __certCache.Get(certURL)
-	switch err {
-	case nil:
-		if key, ok := cachedValue.(*rsa.PublicKey); ok {
-			return key, nil
-		}
-		fallthrough
-	case lrucache.ErrNotFound:
-		certBytes, err := downloadCertificate(certURL)
-		if err != nil {
-			return nil, err
+func (v *NotificationVerifier) verifyDate(date string) error {
+	maxClockSkew := v.MaxClockSkew
+	if maxClockSkew < 0 {
+		return nil
+	}
+	if maxClockSkew == 0 {
+		maxClockSkew = defaultMaxClockSkew
+	}
+	if date == "" {
+		return errors.New("Date header not found")
+	}
+	t, err := http.ParseTime(date)
+	if err != nil {
+		return fmt.Errorf("invalid Date header: %s", date)
+	}
+	if skew := time.Since(t); skew > maxClockSkew || skew < -maxClockSkew {
+		return fmt.Errorf("Date header %s is out of the %s window", date, maxClockSkew)
+	}
+	return nil
+}
+
+// certURL 检查证书 URL 的 host 是否在白名单内, 并返回实际下载使用的 URL.
+func (v *NotificationVerifier) certURL(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User != nil {
+		return "", fmt.Errorf("invalid x-mns-signing-cert-url: %s", rawurl)
+	}
+
+	allowedHosts := v.AllowedHosts
+	if len(allowedHosts) == 0 {
+		allowedHosts = DefaultCertHosts
+	}
+	if len(allowedHosts) == 0 {
+		return "", errors.New("no signing cert host is allowed, set NotificationVerifier.AllowedHosts or DefaultCertHosts")
+	}
+	if !v.AllowHTTP {
+		u.Scheme = "https"
+	}
+	allowed := false
+	for _, h := range allowedHosts {
+		if strings.Contains(h, "://") {
+			allowed = strings.EqualFold(u.Scheme+"://"+u.Host, strings.TrimSuffix(h, "/"))
+		} else {
+			allowed = strings.EqualFold(u.Host, h)
 		}
-		pubKey, err := parseRSAPublicKey(certBytes)
-		if err != nil {
-			return nil, err
+		if allowed {
+			break
 		}
-		__certCache.Set(certURL, pubKey)
-		return pubKey, nil
-	default:
+	}
+	if !allowed {
+		return "", fmt.Errorf("x-mns-signing-cert-url host %s is not allowed", u.Host)
+	}
+	return u.String(), nil
+}
+
+func (v *NotificationVerifier) getRSAPublicKey(certURL string) (*rsa.PublicKey, error) {
+	if key, ok := v.cache.get(certURL); ok {
+		return key, nil
+	}
+	certBytes, err := v.downloadCertificate(certURL)
+	if err != nil {
 		return nil, err
 	}
+	pubKey, err := parseRSAPublicKey(certBytes)
+	if err != nil {
+		return nil, err
+	}
+	v.cache.set(certURL, pubKey)
+	return pubKey, nil
 }
 
 // downloadCertificate 下载 X509 证书
-func downloadCertificate(url string) (data []byte, err error) {
-	resp, err := http.DefaultClient.Get(url)
+func (v *NotificationVerifier) downloadCertificate(url string) (data []byte, err error) {
+	resp, err := v.httpClient.Get(url)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	return ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download certificate %s failed, status code %d", url, resp.StatusCode)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxCertificateSize))
 }
 
 // parseRSAPublicKey 从证书里解析出公钥
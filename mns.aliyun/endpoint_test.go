@@ -0,0 +1,200 @@
+package mns
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// certServer 提供一个测试用的签名证书, 记录证书被下载的次数.
+type certServer struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	downloads int32
+}
+
+func newCertServer(t *testing.T) *certServer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mns test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	s := &certServer{key: key}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.downloads, 1)
+		w.Write(certPEM)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *certServer) host() string {
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+// signedRequest 按 MNS 推送的格式构造请求, 并用测试私钥签名.
+func (s *certServer) signedRequest(t *testing.T, body string, date time.Time) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/notify", strings.NewReader(body))
+	req.Header.Set("Content-Type", "text/xml;charset=utf-8")
+	req.Header.Set("Content-Md5", contentMD5([]byte(body)))
+	req.Header.Set("Date", formatDate(date))
+	req.Header.Set("X-Mns-Request-Id", "req-1")
+	req.Header.Set("X-Mns-Signing-Cert-Url", base64.StdEncoding.EncodeToString([]byte(s.URL+"/cert.pem")))
+
+	digest := sha1.Sum(getSignStr(req))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA1, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", base64.StdEncoding.EncodeToString(sig))
+	return req
+}
+
+func TestNotificationVerifier(t *testing.T) {
+	const body = "<Notification></Notification>"
+	srv := newCertServer(t)
+
+	tests := []struct {
+		name     string
+		verifier *NotificationVerifier
+		req      func() *http.Request
+		body     string // 传给 Verify 的 body, 为空时和签名的 body 一致
+		wantOK   bool
+		wantErr  string
+	}{
+		{
+			name:     "valid signature",
+			verifier: &NotificationVerifier{AllowedHosts: []string{srv.host()}, AllowHTTP: true},
+			req:      func() *http.Request { return srv.signedRequest(t, body, time.Now()) },
+			wantOK:   true,
+		},
+		{
+			name:     "host not allowed",
+			verifier: &NotificationVerifier{AllowedHosts: []string{"mns.example.com"}, AllowHTTP: true},
+			req:      func() *http.Request { return srv.signedRequest(t, body, time.Now()) },
+			wantErr:  "is not allowed",
+		},
+		{
+			name:     "scheme of allowed host must match",
+			verifier: &NotificationVerifier{AllowedHosts: []string{"https://" + srv.host()}, AllowHTTP: true},
+			req:      func() *http.Request { return srv.signedRequest(t, body, time.Now()) },
+			wantErr:  "is not allowed",
+		},
+		{
+			name:     "date outside replay window",
+			verifier: &NotificationVerifier{AllowedHosts: []string{srv.host()}, AllowHTTP: true, MaxClockSkew: time.Minute},
+			req:      func() *http.Request { return srv.signedRequest(t, body, time.Now().Add(-2*time.Minute)) },
+			wantErr:  "out of the",
+		},
+		{
+			name:     "replay window disabled",
+			verifier: &NotificationVerifier{AllowedHosts: []string{srv.host()}, AllowHTTP: true, MaxClockSkew: -1},
+			req:      func() *http.Request { return srv.signedRequest(t, body, time.Now().Add(-time.Hour)) },
+			wantOK:   true,
+		},
+		{
+			name:     "invalid signature",
+			verifier: &NotificationVerifier{AllowedHosts: []string{srv.host()}, AllowHTTP: true},
+			req: func() *http.Request {
+				req := srv.signedRequest(t, body, time.Now())
+				req.Header.Set("X-Mns-Request-Id", "req-2") // 签名之后修改参与签名的请求头
+				return req
+			},
+			wantOK: false,
+		},
+		{
+			name:     "body tampered",
+			verifier: &NotificationVerifier{AllowedHosts: []string{srv.host()}, AllowHTTP: true},
+			req:      func() *http.Request { return srv.signedRequest(t, body, time.Now()) },
+			body:     "<Notification>x</Notification>",
+			wantErr:  "Content-MD5 mismatch",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifyBody := body
+			if tt.body != "" {
+				verifyBody = tt.body
+			}
+			ok, err := tt.verifier.Verify(tt.req(), []byte(verifyBody))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Verify() error = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if ok != tt.wantOK {
+				t.Fatalf("Verify() = %v, want %v", ok, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestNotificationVerifierCertCacheTTL(t *testing.T) {
+	srv := newCertServer(t)
+	v := &NotificationVerifier{AllowedHosts: []string{srv.host()}, AllowHTTP: true, CacheTTL: 100 * time.Millisecond}
+
+	verify := func() {
+		t.Helper()
+		if ok, err := v.Verify(srv.signedRequest(t, "body", time.Now()), []byte("body")); !ok || err != nil {
+			t.Fatalf("Verify() = %v, %v", ok, err)
+		}
+	}
+	verify()
+	verify()
+	if n := atomic.LoadInt32(&srv.downloads); n != 1 {
+		t.Fatalf("downloads within TTL = %d, want 1", n)
+	}
+	time.Sleep(150 * time.Millisecond)
+	verify()
+	if n := atomic.LoadInt32(&srv.downloads); n != 2 {
+		t.Fatalf("downloads after TTL = %d, want 2", n)
+	}
+}
+
+func TestNotificationVerifierDefaultCertHosts(t *testing.T) {
+	v := &NotificationVerifier{}
+	tests := []struct {
+		certURL string
+		want    string
+		wantErr bool
+	}{
+		{certURL: "http://mnstest.oss-cn-hangzhou.aliyuncs.com/x509_public_certificate.pem", want: "https://mnstest.oss-cn-hangzhou.aliyuncs.com/x509_public_certificate.pem"},
+		{certURL: "https://MNSTEST.oss-cn-hangzhou.aliyuncs.com/x509_public_certificate.pem", want: "https://MNSTEST.oss-cn-hangzhou.aliyuncs.com/x509_public_certificate.pem"},
+		{certURL: "https://mnstest.oss-cn-hangzhou.aliyuncs.com.evil.com/cert.pem", wantErr: true},
+		{certURL: "https://user@mnstest.oss-cn-hangzhou.aliyuncs.com/cert.pem", wantErr: true},
+		{certURL: "ftp://mnstest.oss-cn-hangzhou.aliyuncs.com/cert.pem", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := v.certURL(tt.certURL)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("certURL(%q) = %q, %v; want %q, error %v", tt.certURL, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
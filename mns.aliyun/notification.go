@@ -1,15 +1,171 @@
 package mns
 
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// 订阅的 NotifyContentFormat
+const (
+	NotifyContentFormatXML        = "XML"
+	NotifyContentFormatJSON       = "JSON"
+	NotifyContentFormatSIMPLIFIED = "SIMPLIFIED"
+)
+
 // Notification XML 完整格式
 type Notification struct {
-	XMLName          struct{} `xml:"Notification"`
-	TopicOwner       string   `xml:"TopicOwner"`
-	TopicName        string   `xml:"TopicName"`
-	Subscriber       string   `xml:"Subscriber"`
-	SubscriptionName string   `xml:"SubscriptionName"`
-	MessageId        string   `xml:"MessageId"`
-	Message          []byte   `xml:"Message"`
-	MessageMD5       string   `xml:"MessageMD5"`
-	MessageTag       string   `xml:"MessageTag"`
-	PublishTime      int64    `xml:"PublishTime"`
+	XMLName           struct{}          `xml:"Notification" json:"-"`
+	TopicOwner        string            `xml:"TopicOwner" json:"TopicOwner"`
+	TopicName         string            `xml:"TopicName" json:"TopicName"`
+	Subscriber        string            `xml:"Subscriber" json:"Subscriber"`
+	SubscriptionName  string            `xml:"SubscriptionName" json:"SubscriptionName"`
+	MessageId         string            `xml:"MessageId" json:"MessageId"`
+	Message           []byte            `xml:"Message" json:"Message"`
+	MessageMD5        string            `xml:"MessageMD5" json:"MessageMD5"`
+	MessageTag        string            `xml:"MessageTag" json:"MessageTag"`
+	PublishTime       int64             `xml:"PublishTime" json:"PublishTime"`
+	MessageAttributes MessageAttributes `xml:"MessageAttributes" json:"MessageAttributes"`
+
+	Format string `xml:"-" json:"-"` // 解析出来的 NotifyContentFormat
+}
+
+// MessageAttributes 是随消息一起推送的属性, 比如 DirectMail, DirectSMS;
+// value 是发布时设置的原始字符串, 一般是 JSON.
+type MessageAttributes map[string]string
+
+// UnmarshalXML 把 <MessageAttributes> 下的每个子元素解析为一个属性.
+func (attrs *MessageAttributes) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var result struct {
+		Items []struct {
+			XMLName xml.Name
+			Value   string `xml:",chardata"`
+		} `xml:",any"`
+	}
+	if err := d.DecodeElement(&result, &start); err != nil {
+		return err
+	}
+	if len(result.Items) == 0 {
+		return nil
+	}
+	if *attrs == nil {
+		*attrs = make(MessageAttributes, len(result.Items))
+	}
+	for _, item := range result.Items {
+		(*attrs)[item.XMLName.Local] = item.Value
+	}
+	return nil
+}
+
+// UnmarshalJSON 兼容属性值是 JSON 对象而不是字符串的情况, 此时保留对象的原始 JSON.
+func (attrs *MessageAttributes) UnmarshalJSON(b []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if len(raw) == 0 {
+		return nil
+	}
+	if *attrs == nil {
+		*attrs = make(MessageAttributes, len(raw))
+	}
+	for k, v := range raw {
+		var s string
+		if err := json.Unmarshal(v, &s); err == nil {
+			(*attrs)[k] = s
+			continue
+		}
+		(*attrs)[k] = string(v)
+	}
+	return nil
+}
+
+// ParseNotification 解析推送到 HttpEndpoint 的消息通知
+//
+//  ParseNotification(contentType, body) == ParseNotification2(contentType, body, true)
+func ParseNotification(contentType string, body []byte) (*Notification, error) {
+	return ParseNotification2(contentType, body, true)
+}
+
+// ParseNotification2 解析推送到 HttpEndpoint 的消息通知, 支持订阅的三种 NotifyContentFormat:
+// XML 和 JSON 格式包含完整的通知属性, SIMPLIFIED 格式的 body 就是消息本身.
+// 格式根据 contentType 判断, contentType 为空时根据 body 的内容判断.
+//  contentType:  通知请求的 Content-Type 请求头
+//  body:         通知请求的 http body
+//  base64Decode: 为 true 时会对消息做 base64 解码; 注意要和 PublishMessage2 的 base64Encode 保持一致.
+func ParseNotification2(contentType string, body []byte, base64Decode bool) (n *Notification, err error) {
+	switch notificationFormat(contentType, body) {
+	case NotifyContentFormatXML:
+		var result Notification
+		if err = xml.Unmarshal(body, &result); err != nil {
+			return
+		}
+		result.Format = NotifyContentFormatXML
+		n = &result
+	case NotifyContentFormatJSON:
+		var result struct {
+			Notification
+			Message     string      `json:"Message"`
+			PublishTime json.Number `json:"PublishTime"`
+		}
+		if err = json.Unmarshal(body, &result); err != nil {
+			return
+		}
+		result.Notification.Message = []byte(result.Message)
+		if result.PublishTime != "" {
+			if result.Notification.PublishTime, err = strconv.ParseInt(result.PublishTime.String(), 10, 64); err != nil {
+				return
+			}
+		}
+		result.Notification.Format = NotifyContentFormatJSON
+		n = &result.Notification
+	default:
+		n = &Notification{
+			Message: body,
+			Format:  NotifyContentFormatSIMPLIFIED,
+		}
+	}
+
+	// MessageMD5 是推送的消息(base64 解码之前)的 md5, SIMPLIFIED 格式没有这个字段
+	if n.MessageMD5 != "" {
+		if wantMessageMD5 := messageBodyMD5(n.Message); strings.ToUpper(n.MessageMD5) != wantMessageMD5 {
+			err = fmt.Errorf("MessageMD5 mismatch, have %s, want %s", n.MessageMD5, wantMessageMD5)
+			return nil, err
+		}
+	}
+
+	if base64Decode && len(n.Message) > 0 {
+		Message := make([]byte, base64.StdEncoding.DecodedLen(len(n.Message)))
+		m, err2 := base64.StdEncoding.Decode(Message, n.Message)
+		if err2 != nil {
+			err = fmt.Errorf("base64 decode Message failed: %s", err2.Error())
+			return nil, err
+		}
+		n.Message = Message[:m]
+	}
+	return
+}
+
+func notificationFormat(contentType string, body []byte) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/xml", "application/xml":
+		return NotifyContentFormatXML
+	case "application/json":
+		return NotifyContentFormatJSON
+	case "":
+		trimmed := bytes.TrimSpace(body)
+		switch {
+		case bytes.HasPrefix(trimmed, []byte("<?xml")) || bytes.HasPrefix(trimmed, []byte("<Notification")):
+			return NotifyContentFormatXML
+		case bytes.HasPrefix(trimmed, []byte("{")) && bytes.Contains(trimmed, []byte(`"TopicOwner"`)):
+			return NotifyContentFormatJSON
+		}
+	}
+	return NotifyContentFormatSIMPLIFIED
 }
@@ -0,0 +1,166 @@
+package mns
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 以下样例按阿里云 MNS 文档中 HttpEndpoint 推送请求体的样例构造, 消息是发布时 base64 编码过的 "hello mns".
+const (
+	sampleXMLNotification = `<?xml version="1.0" encoding="utf-8"?>
+<Notification xmlns="http://mns.aliyuncs.com/doc/v1/">
+  <TopicOwner>1692545896541241</TopicOwner>
+  <TopicName>MyTopic</TopicName>
+  <Subscriber>1692545896541241</Subscriber>
+  <SubscriptionName>bing-test3</SubscriptionName>
+  <MessageId>C39FB8C345BBFBA8-1-1687F6FAADD-200000015</MessageId>
+  <MessageMD5>EBBEC0919BC91E033E46295ED9BAE435</MessageMD5>
+  <MessageTag>important</MessageTag>
+  <Message>aGVsbG8gbW5z</Message>
+  <PublishTime>1548319136733</PublishTime>
+  <MessageAttributes>
+    <DirectMail>{"Subject":"hi","AccountName":"no-reply@example.com"}</DirectMail>
+  </MessageAttributes>
+</Notification>`
+
+	sampleJSONNotification = `{
+  "TopicOwner": "1692545896541241",
+  "Message": "aGVsbG8gbW5z",
+  "Subscriber": "1692545896541241",
+  "PublishTime": 1548319136733,
+  "SubscriptionName": "bing-test3",
+  "MessageMD5": "EBBEC0919BC91E033E46295ED9BAE435",
+  "TopicName": "MyTopic",
+  "MessageId": "C39FB8C345BBFBA8-1-1687F6FAADD-200000015",
+  "MessageTag": "important",
+  "MessageAttributes": {"DirectMail": {"Subject": "hi", "AccountName": "no-reply@example.com"}}
+}`
+
+	sampleSimplifiedNotification = `aGVsbG8gbW5z`
+)
+
+func TestParseNotification2(t *testing.T) {
+	full := func(format string, directMail string) *Notification {
+		return &Notification{
+			TopicOwner:        "1692545896541241",
+			TopicName:         "MyTopic",
+			Subscriber:        "1692545896541241",
+			SubscriptionName:  "bing-test3",
+			MessageId:         "C39FB8C345BBFBA8-1-1687F6FAADD-200000015",
+			Message:           []byte("hello mns"),
+			MessageMD5:        "EBBEC0919BC91E033E46295ED9BAE435",
+			MessageTag:        "important",
+			PublishTime:       1548319136733,
+			MessageAttributes: MessageAttributes{"DirectMail": directMail},
+			Format:            format,
+		}
+	}
+	xmlDirectMail := `{"Subject":"hi","AccountName":"no-reply@example.com"}`
+	jsonDirectMail := `{"Subject": "hi", "AccountName": "no-reply@example.com"}`
+	withRawMessage := func(n *Notification) *Notification {
+		n.Message = []byte("aGVsbG8gbW5z")
+		return n
+	}
+
+	tests := []struct {
+		name         string
+		contentType  string
+		body         string
+		base64Decode bool
+		want         *Notification
+		wantErr      string
+	}{
+		{
+			name:         "XML",
+			contentType:  "text/xml;charset=utf-8",
+			body:         sampleXMLNotification,
+			base64Decode: true,
+			want:         full(NotifyContentFormatXML, xmlDirectMail),
+		},
+		{
+			name:         "XML without base64 decode",
+			contentType:  "text/xml;charset=utf-8",
+			body:         sampleXMLNotification,
+			base64Decode: false,
+			want:         withRawMessage(full(NotifyContentFormatXML, xmlDirectMail)),
+		},
+		{
+			name:         "XML detected from empty content type",
+			body:         sampleXMLNotification,
+			base64Decode: true,
+			want:         full(NotifyContentFormatXML, xmlDirectMail),
+		},
+		{
+			name:         "JSON",
+			contentType:  "application/json;charset=utf-8",
+			body:         sampleJSONNotification,
+			base64Decode: true,
+			want:         full(NotifyContentFormatJSON, jsonDirectMail),
+		},
+		{
+			name:         "JSON without base64 decode",
+			contentType:  "application/json",
+			body:         sampleJSONNotification,
+			base64Decode: false,
+			want:         withRawMessage(full(NotifyContentFormatJSON, jsonDirectMail)),
+		},
+		{
+			name:         "JSON detected from empty content type",
+			body:         sampleJSONNotification,
+			base64Decode: true,
+			want:         full(NotifyContentFormatJSON, jsonDirectMail),
+		},
+		{
+			name:         "SIMPLIFIED",
+			contentType:  "text/plain;charset=utf-8",
+			body:         sampleSimplifiedNotification,
+			base64Decode: true,
+			want:         &Notification{Message: []byte("hello mns"), Format: NotifyContentFormatSIMPLIFIED},
+		},
+		{
+			name:         "SIMPLIFIED without base64 decode",
+			contentType:  "text/plain;charset=utf-8",
+			body:         sampleSimplifiedNotification,
+			base64Decode: false,
+			want:         &Notification{Message: []byte("aGVsbG8gbW5z"), Format: NotifyContentFormatSIMPLIFIED},
+		},
+		{
+			name:         "SIMPLIFIED detected from empty content type",
+			body:         `{"orderId": 1}`,
+			base64Decode: false,
+			want:         &Notification{Message: []byte(`{"orderId": 1}`), Format: NotifyContentFormatSIMPLIFIED},
+		},
+		{
+			name:         "MessageMD5 mismatch",
+			contentType:  "text/xml",
+			body:         strings.Replace(sampleXMLNotification, "EBBEC0919BC91E033E46295ED9BAE435", "0C91FF67AF5B07A61C82F0DD90CAEFC3", 1),
+			base64Decode: true,
+			wantErr:      "MessageMD5 mismatch",
+		},
+		{
+			name:         "invalid base64",
+			contentType:  "text/plain",
+			body:         "hello mns",
+			base64Decode: true,
+			wantErr:      "base64 decode Message failed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseNotification2(tt.contentType, []byte(tt.body), tt.base64Decode)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseNotification2() error = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseNotification2() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ParseNotification2() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
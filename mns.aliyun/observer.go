@@ -0,0 +1,53 @@
+package mns
+
+import (
+	"strings"
+	"time"
+
+	"github.com/wangping886/mns_consumer/ratelimit"
+)
+
+// ApiObserver 用于观察每一次 api 调用, 可以用来统计耗时和错误.
+//  operation: api 名称, 比如 SendMessage, BatchReceiveMessage
+//  resource:  队列名或者主题名
+//  err:       api 调用返回的错误, 可以断言为 *ApiError 获取错误码; 长轮询没有收到消息(MessageNotExist)不算错误, err 为 nil
+type ApiObserver interface {
+	ObserveApiCall(operation, resource string, duration time.Duration, err error)
+}
+
+// observeApiCall 在请求真正发出之前通过 defer 调用, err 指向 api 方法的命名返回值;
+// 参数校验等客户端错误发生在请求之前, 不会被统计.
+// 通知 observer, 并把限流错误反馈给 limiter.
+func observeApiCall(observer ApiObserver, limiter *ratelimit.Limiter, operation, resourceURL string, begin time.Time, err *error) {
+	if IsThrottled(*err) {
+		limiter.Throttled()
+	}
+	if observer == nil {
+		return
+	}
+	observed := *err
+	if emptyReceive(operation, observed) {
+		observed = nil
+	}
+	observer.ObserveApiCall(operation, resourceName(resourceURL), time.Since(begin), observed)
+}
+
+// emptyReceive 判断是不是 ReceiveMessage/BatchReceiveMessage 因为队列里没有消息返回的 404 MessageNotExist.
+func emptyReceive(operation string, err error) bool {
+	if operation != "ReceiveMessage" && operation != "BatchReceiveMessage" {
+		return false
+	}
+	apiErr, ok := err.(*ApiError)
+	return ok && apiErr.HttpStatusCode == 404 && apiErr.Code == "MessageNotExist"
+}
+
+// IsThrottled 判断 err 是不是 MNS 的限流错误 QPSLimitExceeded.
+func IsThrottled(err error) bool {
+	apiErr, ok := err.(*ApiError)
+	return ok && apiErr.Code == "QPSLimitExceeded"
+}
+
+// resourceName 从 QueueURL/TopicURL 里取出队列名或者主题名.
+func resourceName(resourceURL string) string {
+	return resourceURL[strings.LastIndexByte(resourceURL, '/')+1:]
+}
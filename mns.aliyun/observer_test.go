@@ -0,0 +1,45 @@
+package mns
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type recordObserver struct {
+	calls []error
+}
+
+func (o *recordObserver) ObserveApiCall(operation, resource string, duration time.Duration, err error) {
+	o.calls = append(o.calls, err)
+}
+
+func TestObserveApiCallOnlyAfterRequestSent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Mns-Request-Id", "req-1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Message><MessageId>id-1</MessageId><MessageBodyMD5>0733351879B2FA9BD05C7CA3061529C0</MessageBodyMD5></Message>`))
+	}))
+	defer srv.Close()
+
+	observer := &recordObserver{}
+	clt := &QueueClient{QueueURL: srv.URL + "/queues/q", AccessKeyId: "id", AccessKeySecret: "secret", Observer: observer}
+
+	if _, _, err := clt.SendMessage(&MessageToSend{}); err == nil {
+		t.Fatal("SendMessage with an empty body: want error")
+	}
+	if _, _, err := clt.BatchSendMessage(nil); err == nil {
+		t.Fatal("BatchSendMessage without messages: want error")
+	}
+	if len(observer.calls) != 0 {
+		t.Fatalf("client-side errors observed as api calls: %v", observer.calls)
+	}
+
+	if _, _, err := clt.SendMessage(&MessageToSend{MessageBody: []byte("hello")}); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	if len(observer.calls) != 1 || observer.calls[0] != nil {
+		t.Fatalf("observed calls = %v, want one successful call", observer.calls)
+	}
+}
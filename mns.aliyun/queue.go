@@ -13,6 +13,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/wangping886/mns_consumer/ratelimit"
 )
 
 type QueueClient struct {
@@ -22,6 +24,11 @@ type QueueClient struct {
 	AccessKeySecret string
 
 	HttpClient *http.Client // 默认为 http.DefaultClient
+	Observer   ApiObserver  // 不为 nil 时每次 api 调用结束后都会通知 Observer
+
+	// Limiter 不为 nil 时每次 api 调用之前先等待令牌, 收到 QPSLimitExceeded 时降低速率.
+	// 同一个 Limiter 可以设置给多个 client, 共享同一个速率.
+	Limiter *ratelimit.Limiter
 }
 
 func (clt *QueueClient) getHttpClient() *http.Client {
@@ -49,6 +56,10 @@ func (clt *QueueClient) SendMessage(msg *MessageToSend) (requestId string, messa
 //  msg:          待发送的消息
 //  base64Encode: 为 true 时会对 msg.MessageBody 做 base64 编码, 然后再发送; 建议 msg.MessageBody 为可打印字符串时设置为 false.
 func (clt *QueueClient) SendMessage2(msg *MessageToSend, base64Encode bool) (requestId string, messageId string, err error) {
+	if err = clt.Limiter.Wait(context.Background()); err != nil {
+		return
+	}
+
 	if msg == nil || len(msg.MessageBody) == 0 {
 		err = errors.New("MessageBody must not be empty")
 		return
@@ -87,6 +98,7 @@ func (clt *QueueClient) SendMessage2(msg *MessageToSend, base64Encode bool) (req
 		ContentLength: int64(len(body)),
 		Host:          _url.Host,
 	}
+	defer observeApiCall(clt.Observer, clt.Limiter, "SendMessage", clt.QueueURL, time.Now(), &err)
 	httpResp, err := clt.getHttpClient().Do(httpReq)
 	if err != nil {
 		return
@@ -155,6 +167,10 @@ func (clt *QueueClient) BatchSendMessage(msgs []MessageToSend) (requestId string
 //  msgs:         待发送的消息列表
 //  base64Encode: 为 true 时会对 msg.MessageBody 做 base64 编码, 然后再发送; 建议 msg.MessageBody 为可打印字符串时设置为 false.
 func (clt *QueueClient) BatchSendMessage2(msgs []MessageToSend, base64Encode bool) (requestId string, resp []BatchSendMessageResponseItem, err error) {
+	if err = clt.Limiter.Wait(context.Background()); err != nil {
+		return
+	}
+
 	if len(msgs) < 1 || len(msgs) > 16 {
 		err = errors.New("The length of msgs is invalid")
 		return
@@ -209,6 +225,7 @@ func (clt *QueueClient) BatchSendMessage2(msgs []MessageToSend, base64Encode boo
 		ContentLength: int64(len(body)),
 		Host:          _url.Host,
 	}
+	defer observeApiCall(clt.Observer, clt.Limiter, "BatchSendMessage", clt.QueueURL, time.Now(), &err)
 	httpResp, err := clt.getHttpClient().Do(httpReq)
 	if err != nil {
 		return
@@ -290,6 +307,10 @@ func (clt *QueueClient) ReceiveMessage2(waitSeconds int, base64Decode bool) (req
 //  waitSeconds:  本次 ReceiveMessage2 请求最长的 Polling 等待时间，单位为秒, waitSeconds > 0 有效, 否则用队列默认值
 //  base64Encode: 为 true 时会对接收到的 MessageBody 做 base64 解码; 注意要和 SendMessage2 的 base64Encode 保持一致.
 func (clt *QueueClient) ReceiveMessage2Context(ctx context.Context, waitSeconds int, base64Decode bool) (requestId string, msg *Message, err error) {
+	if err = clt.Limiter.Wait(ctx); err != nil {
+		return
+	}
+
 	if waitSeconds < 0 || waitSeconds > 30 {
 		waitSeconds = 30
 	}
@@ -316,6 +337,7 @@ func (clt *QueueClient) ReceiveMessage2Context(ctx context.Context, waitSeconds
 		Host:   _url.Host,
 	}
 	httpReq = httpReq.WithContext(ctx)
+	defer observeApiCall(clt.Observer, clt.Limiter, "ReceiveMessage", clt.QueueURL, time.Now(), &err)
 	httpResp, err := clt.getHttpClient().Do(httpReq)
 	if err != nil {
 		return
@@ -380,6 +402,10 @@ func (clt *QueueClient) BatchReceiveMessage2(numOfMessages, waitSeconds int, bas
 //  waitSeconds:   本次 ReceiveMessage 请求最长的 Polling 等待时间，单位为秒, waitSeconds > 0 有效, 否则用队列默认值
 //  base64Encode:  为 true 时会对接收到的 MessageBody 做 base64 解码; 注意要和 SendMessage2 的 base64Encode 保持一致.
 func (clt *QueueClient) BatchReceiveMessage2Context(ctx context.Context, numOfMessages, waitSeconds int, base64Decode bool) (requestId string, msgs []Message, err error) {
+	if err = clt.Limiter.Wait(ctx); err != nil {
+		return
+	}
+
 	if numOfMessages < 1 || numOfMessages > 16 {
 		numOfMessages = 16
 	}
@@ -409,6 +435,7 @@ func (clt *QueueClient) BatchReceiveMessage2Context(ctx context.Context, numOfMe
 		Host:   _url.Host,
 	}
 	httpReq = httpReq.WithContext(ctx)
+	defer observeApiCall(clt.Observer, clt.Limiter, "BatchReceiveMessage", clt.QueueURL, time.Now(), &err)
 	httpResp, err := clt.getHttpClient().Do(httpReq)
 	if err != nil {
 		return
@@ -493,6 +520,10 @@ func (clt *QueueClient) PeekMessage2(base64Decode bool) (requestId string, msg *
 // PeekMessage2 用于消费者查看消息
 //  base64Encode:  为 true 时会对接收到的 MessageBody 做 base64 解码; 注意要和 SendMessage2 的 base64Encode 保持一致.
 func (clt *QueueClient) PeekMessage2Context(ctx context.Context, base64Decode bool) (requestId string, msg *MessageFromPeek, err error) {
+	if err = clt.Limiter.Wait(ctx); err != nil {
+		return
+	}
+
 	_url, err := url.ParseRequestURI(clt.QueueURL + "/messages?peekonly=true")
 	if err != nil {
 		return
@@ -511,6 +542,7 @@ func (clt *QueueClient) PeekMessage2Context(ctx context.Context, base64Decode bo
 		Host:   _url.Host,
 	}
 	httpReq = httpReq.WithContext(ctx)
+	defer observeApiCall(clt.Observer, clt.Limiter, "PeekMessage", clt.QueueURL, time.Now(), &err)
 	httpResp, err := clt.getHttpClient().Do(httpReq)
 	if err != nil {
 		return
@@ -574,6 +606,10 @@ func (clt *QueueClient) BatchPeekMessage2(numOfMessages int, base64Decode bool)
 //  numOfMessages: 本次 BatchPeekMessage 最多查看消息条数, 最多 16 条
 //  base64Encode:  为 true 时会对接收到的 MessageBody 做 base64 解码; 注意要和 SendMessage2 的 base64Encode 保持一致.
 func (clt *QueueClient) BatchPeekMessage2Context(ctx context.Context, numOfMessages int, base64Decode bool) (requestId string, msgs []MessageFromPeek, err error) {
+	if err = clt.Limiter.Wait(ctx); err != nil {
+		return
+	}
+
 	if numOfMessages < 1 || numOfMessages > 16 {
 		numOfMessages = 16
 	}
@@ -596,6 +632,7 @@ func (clt *QueueClient) BatchPeekMessage2Context(ctx context.Context, numOfMessa
 		Host:   _url.Host,
 	}
 	httpReq = httpReq.WithContext(ctx)
+	defer observeApiCall(clt.Observer, clt.Limiter, "BatchPeekMessage", clt.QueueURL, time.Now(), &err)
 	httpResp, err := clt.getHttpClient().Do(httpReq)
 	if err != nil {
 		return
@@ -657,6 +694,10 @@ func (clt *QueueClient) BatchPeekMessage2Context(ctx context.Context, numOfMessa
 
 // DeleteMessage 用于删除已经被消费过的消息
 func (clt *QueueClient) DeleteMessage(receiptHandle string) (requestId string, err error) {
+	if err = clt.Limiter.Wait(context.Background()); err != nil {
+		return
+	}
+
 	_url, err := url.ParseRequestURI(clt.QueueURL + "/messages?ReceiptHandle=" + url.QueryEscape(receiptHandle))
 	if err != nil {
 		return
@@ -674,6 +715,7 @@ func (clt *QueueClient) DeleteMessage(receiptHandle string) (requestId string, e
 		Header: header,
 		Host:   _url.Host,
 	}
+	defer observeApiCall(clt.Observer, clt.Limiter, "DeleteMessage", clt.QueueURL, time.Now(), &err)
 	httpResp, err := clt.getHttpClient().Do(httpReq)
 	if err != nil {
 		return
@@ -717,6 +759,10 @@ type BatchDeleteMessageErrorItem struct {
 //  Errors:         删除出错(失败)的消息和错误信息
 //  err:            api 请求错误信息
 func (clt *QueueClient) BatchDeleteMessage(receiptHandles []string) (requestId string, Errors []BatchDeleteMessageErrorItem, err error) {
+	if err = clt.Limiter.Wait(context.Background()); err != nil {
+		return
+	}
+
 	if len(receiptHandles) < 1 || len(receiptHandles) > 16 {
 		err = errors.New("the length of receiptHandles is invalid")
 		return
@@ -756,6 +802,7 @@ func (clt *QueueClient) BatchDeleteMessage(receiptHandles []string) (requestId s
 		ContentLength: int64(len(body)),
 		Host:          _url.Host,
 	}
+	defer observeApiCall(clt.Observer, clt.Limiter, "BatchDeleteMessage", clt.QueueURL, time.Now(), &err)
 	httpResp, err := clt.getHttpClient().Do(httpReq)
 	if err != nil {
 		return
@@ -823,6 +870,10 @@ type ChangeMessageVisibilityResponse struct {
 // ChangeMessageVisibility 用于修改被消费过并且还处于的 Inactive 的消息到下次可被消费的时间，
 // 成功修改消息的 VisibilityTimeout 后，返回新的 ReceiptHandle
 func (clt *QueueClient) ChangeMessageVisibility(receiptHandle string, visibilityTimeout int) (requestId string, resp *ChangeMessageVisibilityResponse, err error) {
+	if err = clt.Limiter.Wait(context.Background()); err != nil {
+		return
+	}
+
 	rawurl := clt.QueueURL + "/messages?receiptHandle=" + url.QueryEscape(receiptHandle) + "&visibilityTimeout=" + strconv.Itoa(visibilityTimeout)
 	_url, err := url.ParseRequestURI(rawurl)
 	if err != nil {
@@ -841,6 +892,7 @@ func (clt *QueueClient) ChangeMessageVisibility(receiptHandle string, visibility
 		Header: header,
 		Host:   _url.Host,
 	}
+	defer observeApiCall(clt.Observer, clt.Limiter, "ChangeMessageVisibility", clt.QueueURL, time.Now(), &err)
 	httpResp, err := clt.getHttpClient().Do(httpReq)
 	if err != nil {
 		return
@@ -2,6 +2,7 @@ package mns
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/xml"
 	"errors"
@@ -12,6 +13,9 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
+
+	"github.com/wangping886/mns_consumer/ratelimit"
 )
 
 type TopicClient struct {
@@ -21,6 +25,11 @@ type TopicClient struct {
 	AccessKeySecret string
 
 	HttpClient *http.Client // 默认为 http.DefaultClient
+	Observer   ApiObserver  // 不为 nil 时每次 api 调用结束后都会通知 Observer
+
+	// Limiter 不为 nil 时每次 api 调用之前先等待令牌, 收到 QPSLimitExceeded 时降低速率.
+	// 同一个 Limiter 可以设置给多个 client, 共享同一个速率.
+	Limiter *ratelimit.Limiter
 }
 
 func (clt *TopicClient) getHttpClient() *http.Client {
@@ -33,12 +42,16 @@ func (clt *TopicClient) getHttpClient() *http.Client {
 type MessageToPublish struct {
 	XMLName           struct{}                    `xml:"Message"`
 	MessageBody       []byte                      `xml:"MessageBody"`
-	MessageTag        string                      `xml:"MessageTag,omitempty"`
+	MessageTag        string                      `xml:"MessageTag,omitempty"` // 消息标签, 用于订阅的 FilterTag 过滤, 不超过 16 个字符, 见 MatchFilterTag
 	MessageAttributes *MessageToPublishAttributes `xml:"MessageAttributes,omitempty"`
 }
 
+// MessageToPublishAttributes 是推送到邮件, 短信, 移动推送等 Endpoint 时需要的消息属性,
+// 每个属性的值都是 JSON, 建议通过 SetDirectMail, SetDirectSMS, SetPush 设置.
 type MessageToPublishAttributes struct {
 	DirectMail []byte `xml:"DirectMail,omitempty"`
+	DirectSMS  []byte `xml:"DirectSMS,omitempty"`
+	Push       []byte `xml:"Push,omitempty"`
 }
 
 // PublishMessage 用于发布者向指定的主题发布消息, 消息发布到主题后随即会被推送给 Endpoint 消费.
@@ -52,10 +65,18 @@ func (clt *TopicClient) PublishMessage(msg *MessageToPublish) (requestId string,
 //  msg:          待发送的消息
 //  base64Encode: 为 true 时会对 msg.MessageBody 做 base64 编码, 然后再发送; 建议 msg.MessageBody 为可打印字符串时设置为 false.
 func (clt *TopicClient) PublishMessage2(msg *MessageToPublish, base64Encode bool) (requestId string, messageId string, err error) {
+	if err = clt.Limiter.Wait(context.Background()); err != nil {
+		return
+	}
+
 	if msg == nil || len(msg.MessageBody) == 0 {
 		err = errors.New("MessageBody must not be empty")
 		return
 	}
+	if utf8.RuneCountInString(msg.MessageTag) > MaxMessageTagLength {
+		err = fmt.Errorf("MessageTag must not be longer than %d characters", MaxMessageTagLength)
+		return
+	}
 
 	_url, err := url.ParseRequestURI(clt.TopicURL + "/messages")
 	if err != nil {
@@ -90,6 +111,7 @@ func (clt *TopicClient) PublishMessage2(msg *MessageToPublish, base64Encode bool
 		ContentLength: int64(len(body)),
 		Host:          _url.Host,
 	}
+	defer observeApiCall(clt.Observer, clt.Limiter, "PublishMessage", clt.TopicURL, time.Now(), &err)
 	httpResp, err := clt.getHttpClient().Do(httpReq)
 	if err != nil {
 		return
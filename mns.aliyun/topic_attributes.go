@@ -0,0 +1,123 @@
+package mns
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// MaxMessageTagLength 是 MessageTag 的最大字符数.
+const MaxMessageTagLength = 16
+
+// MatchFilterTag 判断 MessageTag 为 messageTag 的消息是否会推送给 FilterTag 为 filterTag 的订阅:
+// 没有设置 FilterTag 的订阅接收所有消息, 设置了 FilterTag 的订阅只接收 MessageTag 与之完全相同的消息.
+// 发布者和订阅者可以用它在本地确认双方对标签的约定一致.
+func MatchFilterTag(filterTag, messageTag string) bool {
+	return filterTag == "" || filterTag == messageTag
+}
+
+// DirectMail 是推送到邮件 Endpoint(mail:directmail:xxx) 的消息属性, 消息体是邮件正文.
+type DirectMail struct {
+	Subject        string // 邮件主题
+	AccountName    string // 发信地址
+	AddressType    int    // 0 为随机账号, 1 为发信地址
+	IsHtml         bool   // 邮件正文是否是 HTML
+	ReplyToAddress bool   // 是否使用管理控制台中配置的回信地址
+}
+
+// MarshalJSON 按照 MNS 要求的格式序列化, bool 属性序列化为 0/1.
+func (m DirectMail) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Subject        string `json:"Subject"`
+		AccountName    string `json:"AccountName"`
+		AddressType    int    `json:"AddressType"`
+		IsHtml         int    `json:"IsHtml"`
+		ReplyToAddress int    `json:"ReplyToAddress"`
+	}{
+		Subject:        m.Subject,
+		AccountName:    m.AccountName,
+		AddressType:    m.AddressType,
+		IsHtml:         boolToInt(m.IsHtml),
+		ReplyToAddress: boolToInt(m.ReplyToAddress),
+	})
+}
+
+// DirectSMS 是推送到短信 Endpoint(sms:directsms:anonymous) 的消息属性.
+//
+// 所有接收者使用相同模板参数时设置 Receivers 和 Params (singleContent);
+// 每个接收者使用不同模板参数时设置 ReceiverParams (multiContent), key 为手机号.
+type DirectSMS struct {
+	FreeSignName   string                       // 短信签名
+	TemplateCode   string                       // 短信模板 code
+	Receivers      []string                     // 接收者手机号
+	Params         map[string]string            // 模板参数
+	ReceiverParams map[string]map[string]string // 每个接收者的模板参数
+}
+
+// MarshalJSON 按照 MNS 要求的格式序列化, SmsParams 是 JSON 字符串.
+func (s DirectSMS) MarshalJSON() ([]byte, error) {
+	if s.FreeSignName == "" || s.TemplateCode == "" {
+		return nil, errors.New("FreeSignName and TemplateCode must not be empty")
+	}
+
+	var result = struct {
+		FreeSignName string `json:"FreeSignName"`
+		TemplateCode string `json:"TemplateCode"`
+		Type         string `json:"Type"`
+		Receiver     string `json:"Receiver,omitempty"`
+		SmsParams    string `json:"SmsParams"`
+	}{
+		FreeSignName: s.FreeSignName,
+		TemplateCode: s.TemplateCode,
+	}
+
+	var (
+		params []byte
+		err    error
+	)
+	if len(s.ReceiverParams) > 0 {
+		result.Type = "multiContent"
+		params, err = json.Marshal(s.ReceiverParams)
+	} else {
+		if len(s.Receivers) == 0 {
+			return nil, errors.New("Receivers must not be empty")
+		}
+		result.Type = "singleContent"
+		result.Receiver = strings.Join(s.Receivers, ",")
+		if s.Params == nil {
+			params = []byte("{}")
+		} else {
+			params, err = json.Marshal(s.Params)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.SmsParams = string(params)
+	return json.Marshal(result)
+}
+
+// SetDirectMail 设置邮件推送属性.
+func (attrs *MessageToPublishAttributes) SetDirectMail(m DirectMail) (err error) {
+	attrs.DirectMail, err = json.Marshal(m)
+	return
+}
+
+// SetDirectSMS 设置短信推送属性.
+func (attrs *MessageToPublishAttributes) SetDirectSMS(s DirectSMS) (err error) {
+	attrs.DirectSMS, err = json.Marshal(s)
+	return
+}
+
+// SetPush 设置其它推送属性, v 会被序列化为 JSON, 比如移动推送的 Target, TargetValue 等.
+func (attrs *MessageToPublishAttributes) SetPush(v interface{}) (err error) {
+	attrs.Push, err = json.Marshal(v)
+	return
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,185 @@
+package mns
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDirectMailJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		mail DirectMail
+		want string
+	}{
+		{
+			name: "defaults",
+			mail: DirectMail{Subject: "hi", AccountName: "no-reply@example.com"},
+			want: `{"Subject":"hi","AccountName":"no-reply@example.com","AddressType":0,"IsHtml":0,"ReplyToAddress":0}`,
+		},
+		{
+			name: "bool flags as 0/1",
+			mail: DirectMail{Subject: "hi", AccountName: "a@example.com", AddressType: 1, IsHtml: true, ReplyToAddress: true},
+			want: `{"Subject":"hi","AccountName":"a@example.com","AddressType":1,"IsHtml":1,"ReplyToAddress":1}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attrs MessageToPublishAttributes
+			if err := attrs.SetDirectMail(tt.mail); err != nil {
+				t.Fatalf("SetDirectMail: %v", err)
+			}
+			if got := string(attrs.DirectMail); got != tt.want {
+				t.Errorf("DirectMail = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDirectSMSJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		sms     DirectSMS
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "single content",
+			sms: DirectSMS{
+				FreeSignName: "sign",
+				TemplateCode: "SMS_1",
+				Receivers:    []string{"13800000000", "13900000000"},
+				Params:       map[string]string{"code": "1234"},
+			},
+			want: map[string]string{
+				"FreeSignName": "sign",
+				"TemplateCode": "SMS_1",
+				"Type":         "singleContent",
+				"Receiver":     "13800000000,13900000000",
+				"SmsParams":    `{"code":"1234"}`,
+			},
+		},
+		{
+			name: "single content without params",
+			sms:  DirectSMS{FreeSignName: "sign", TemplateCode: "SMS_1", Receivers: []string{"13800000000"}},
+			want: map[string]string{
+				"FreeSignName": "sign",
+				"TemplateCode": "SMS_1",
+				"Type":         "singleContent",
+				"Receiver":     "13800000000",
+				"SmsParams":    `{}`,
+			},
+		},
+		{
+			name: "multi content",
+			sms: DirectSMS{
+				FreeSignName:   "sign",
+				TemplateCode:   "SMS_1",
+				ReceiverParams: map[string]map[string]string{"13800000000": {"code": "1"}},
+			},
+			want: map[string]string{
+				"FreeSignName": "sign",
+				"TemplateCode": "SMS_1",
+				"Type":         "multiContent",
+				"SmsParams":    `{"13800000000":{"code":"1"}}`,
+			},
+		},
+		{
+			name:    "missing template",
+			sms:     DirectSMS{FreeSignName: "sign", Receivers: []string{"13800000000"}},
+			wantErr: true,
+		},
+		{
+			name:    "missing receivers",
+			sms:     DirectSMS{FreeSignName: "sign", TemplateCode: "SMS_1"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attrs MessageToPublishAttributes
+			err := attrs.SetDirectSMS(tt.sms)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("SetDirectSMS: want error, got %s", attrs.DirectSMS)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SetDirectSMS: %v", err)
+			}
+			var got map[string]string
+			if err := json.Unmarshal(attrs.DirectSMS, &got); err != nil {
+				t.Fatalf("unmarshal %s: %v", attrs.DirectSMS, err)
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("DirectSMS = %v, want %v", got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("DirectSMS[%s] = %q, want %q", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestMatchFilterTag(t *testing.T) {
+	tests := []struct {
+		filterTag, messageTag string
+		want                  bool
+	}{
+		{"", "", true},
+		{"", "order", true},
+		{"order", "order", true},
+		{"order", "", false},
+		{"order", "Order", false},
+		{"order", "orders", false},
+	}
+	for _, tt := range tests {
+		if got := MatchFilterTag(tt.filterTag, tt.messageTag); got != tt.want {
+			t.Errorf("MatchFilterTag(%q, %q) = %v, want %v", tt.filterTag, tt.messageTag, got, tt.want)
+		}
+	}
+}
+
+func TestPublishMessageTagLength(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	clt := &TopicClient{TopicURL: srv.URL + "/topics/t", AccessKeyId: "id", AccessKeySecret: "secret"}
+
+	tests := []struct {
+		name    string
+		tag     string
+		wantErr bool // 是否在发送请求之前就因为 MessageTag 过长返回错误
+	}{
+		{"empty", "", false},
+		{"16 ascii", strings.Repeat("a", 16), false},
+		{"16 chinese", strings.Repeat("标", 16), false},
+		{"17 ascii", strings.Repeat("a", 17), true},
+		{"17 chinese", strings.Repeat("标", 17), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := atomic.LoadInt32(&requests)
+			_, _, err := clt.PublishMessage2(&MessageToPublish{MessageBody: []byte("body"), MessageTag: tt.tag}, false)
+			sent := atomic.LoadInt32(&requests) != before
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "MessageTag") || sent {
+					t.Errorf("err = %v, sent = %v, want MessageTag error without request", err, sent)
+				}
+				return
+			}
+			if !sent {
+				t.Errorf("request not sent, err = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+// Package ratelimit 提供令牌桶限流器, 用来限制 consumer 每秒开始执行的 handler 数和 mns 客户端每秒的 api 调用数.
+//
+// 同一个 Limiter 可以同时设置给多个 consumer 或者客户端, 它们共享同一个速率:
+//
+//	l := ratelimit.New(100, 10)
+//	queueA.Limiter, queueB.Limiter = l, l
+//
+// 服务端返回限流错误(比如 MNS 的 QPSLimitExceeded)时调用 Throttled, 速率会立即减半, 之后逐渐恢复到设置的速率.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrThrottled 表示下游限流, handler 返回包装了它的错误时 consumer 会调用 Limiter.Throttled:
+//
+//	return fmt.Errorf("call api: %w", ratelimit.ErrThrottled)
+var ErrThrottled = errors.New("throttled")
+
+const (
+	minRateFraction = 0.1  // Throttled 最多把速率降到设置值的 1/10
+	recoverPerSec   = 0.05 // 每秒恢复设置速率的 5%
+)
+
+// Limiter 是并发安全的令牌桶. nil 的 *Limiter 不做任何限制.
+type Limiter struct {
+	mu     sync.Mutex
+	limit  float64 // 设置的速率, 每秒令牌数
+	rate   float64 // 当前速率, Throttled 之后小于 limit
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// New 返回每秒产生 rate 个令牌, 最多积累 burst 个令牌的 Limiter, burst 小于 1 时为 1.
+// rate 必须大于 0, 否则 panic; 不需要限流时使用 nil 的 *Limiter.
+func New(rate float64, burst int) *Limiter {
+	if !(rate > 0) {
+		panic(fmt.Sprintf("ratelimit: rate must be positive, got %v", rate))
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		limit:  rate,
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// advance 补充令牌并恢复速率, 需要持有 mu.
+func (l *Limiter) advance(now time.Time) {
+	elapsed := now.Sub(l.last).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	l.last = now
+	l.tokens += elapsed * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	if l.rate < l.limit {
+		l.rate += elapsed * l.limit * recoverPerSec
+		if l.rate > l.limit {
+			l.rate = l.limit
+		}
+	}
+}
+
+// reserve 取走一个令牌, 返回需要等待的时间.
+func (l *Limiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.advance(time.Now())
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// cancel 归还 reserve 取走的令牌.
+func (l *Limiter) cancel() {
+	l.mu.Lock()
+	l.tokens++
+	l.mu.Unlock()
+}
+
+// Wait 等待一个令牌, ctx 取消时返回 ctx.Err().
+func (l *Limiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	d := l.reserve()
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.cancel()
+		return ctx.Err()
+	}
+}
+
+// Allow 有令牌时取走一个并返回 true, 否则返回 false, 不等待.
+func (l *Limiter) Allow() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.advance(time.Now())
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// Throttled 报告一次服务端限流: 速率减半(不低于设置值的 1/10), 已经积累的令牌作废.
+func (l *Limiter) Throttled() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.advance(time.Now())
+	l.rate /= 2
+	if min := l.limit * minRateFraction; l.rate < min {
+		l.rate = min
+	}
+	if l.tokens > 0 {
+		l.tokens = 0
+	}
+}
+
+// Rate 返回当前速率.
+func (l *Limiter) Rate() float64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.advance(time.Now())
+	return l.rate
+}
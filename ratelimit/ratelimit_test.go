@@ -0,0 +1,109 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestAllowBurst(t *testing.T) {
+	l := New(10, 3)
+	for i := 0; i < 3; i++ {
+		if !l.Allow() {
+			t.Fatalf("Allow() #%d = false, want burst of 3", i+1)
+		}
+	}
+	if l.Allow() {
+		t.Error("Allow() = true after the burst is used up")
+	}
+}
+
+func TestWaitPaces(t *testing.T) {
+	l := New(100, 1)
+	begin := time.Now()
+	for i := 0; i < 6; i++ {
+		if err := l.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 第一个令牌是积累的, 后面 5 个每 10ms 一个
+	if elapsed := time.Since(begin); elapsed < 40*time.Millisecond || elapsed > time.Second {
+		t.Errorf("6 waits took %s, want about 50ms at 100/s", elapsed)
+	}
+}
+
+func TestWaitCanceledReturnsToken(t *testing.T) {
+	l := New(1, 1)
+	if !l.Allow() {
+		t.Fatal("Allow() = false on a new limiter")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Wait() = %v, want context.DeadlineExceeded", err)
+	}
+	l.mu.Lock()
+	tokens := l.tokens
+	l.mu.Unlock()
+	if tokens < -0.5 {
+		t.Errorf("tokens = %.2f after a canceled Wait, want the reserved token returned", tokens)
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.Wait(canceled); err != context.Canceled {
+		t.Errorf("Wait() with a canceled ctx = %v, want context.Canceled", err)
+	}
+}
+
+func TestThrottledFloorAndRecovery(t *testing.T) {
+	l := New(100, 10)
+	l.Throttled()
+	if r := l.Rate(); r > 50.5 {
+		t.Errorf("Rate() = %.2f after Throttled, want halved to 50", r)
+	}
+	if l.Allow() {
+		t.Error("Allow() = true right after Throttled, want accumulated tokens dropped")
+	}
+
+	for i := 0; i < 10; i++ {
+		l.Throttled()
+	}
+	if r := l.Rate(); math.Abs(r-10) > 0.5 {
+		t.Errorf("Rate() = %.2f, want the floor of 1/10 of the limit", r)
+	}
+
+	// 每秒恢复设置速率的 5%
+	l.mu.Lock()
+	l.last = l.last.Add(-2 * time.Second)
+	l.mu.Unlock()
+	if r := l.Rate(); math.Abs(r-20) > 0.5 {
+		t.Errorf("Rate() = %.2f 2s after throttling at the floor, want 20", r)
+	}
+
+	l.mu.Lock()
+	l.last = l.last.Add(-time.Minute)
+	l.mu.Unlock()
+	if r := l.Rate(); r != 100 {
+		t.Errorf("Rate() = %.2f, want recovered to the limit 100", r)
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	if err := l.Wait(context.Background()); err != nil || !l.Allow() || l.Rate() != 0 {
+		t.Error("nil Limiter must not limit")
+	}
+	l.Throttled()
+}
+
+func TestNewPanicsOnNonPositiveRate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("New(0, 1) did not panic")
+		}
+	}()
+	New(0, 1)
+}
@@ -0,0 +1,104 @@
+package source
+
+import (
+	"context"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/wangping886/mns_consumer/mns.aliyun"
+	"github.com/wangping886/mns_consumer/tracing"
+)
+
+const queueWaitSeconds = 20
+
+// Queue 是 MNS 队列的 Source: Ack 删除消息, Nack 和 Extend 修改消息的可见时间.
+type Queue struct {
+	client *mns.QueueClient
+	name   string
+}
+
+// NewQueue 返回从 clt 长轮询接收消息的 Source, 消息体不做 base64 解码.
+func NewQueue(clt *mns.QueueClient) *Queue {
+	return &Queue{
+		client: clt,
+		name:   path.Base(clt.QueueURL),
+	}
+}
+
+// queueMessage 是 Queue 的原始消息, 修改可见时间后 ReceiptHandle 会变化.
+type queueMessage struct {
+	mu  sync.Mutex
+	msg mns.Message
+}
+
+func (q *Queue) Name() string {
+	return q.name
+}
+
+func (q *Queue) Fetch(ctx context.Context) ([]*Message, error) {
+	_, msgs, err := q.client.BatchReceiveMessage2Context(ctx, 16, queueWaitSeconds, false)
+	if err != nil {
+		if apiErr, ok := err.(*mns.ApiError); ok && apiErr.Code == "MessageNotExist" {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	result := make([]*Message, len(msgs))
+	for i, msg := range msgs {
+		headers, body, _ := tracing.Open(msg.MessageBody)
+		m := NewMessage(&queueMessage{msg: msg})
+		m.ID = msg.MessageId
+		m.Body = body
+		m.Headers = headers
+		if key, ok := headers[HeaderKey]; ok {
+			m.Key = []byte(key)
+		}
+		m.Timestamp = time.Unix(0, msg.EnqueueTime*int64(time.Millisecond))
+		m.Attempt = int(msg.DequeueCount)
+		result[i] = m
+	}
+	return result, nil
+}
+
+func (q *Queue) Ack(ctx context.Context, msg *Message) error {
+	raw := msg.raw.(*queueMessage)
+	raw.mu.Lock()
+	defer raw.mu.Unlock()
+
+	_, err := q.client.DeleteMessage(raw.msg.ReceiptHandle)
+	return err
+}
+
+func (q *Queue) Nack(ctx context.Context, msg *Message, delay time.Duration) error {
+	return q.changeVisibility(msg, delay)
+}
+
+func (q *Queue) Extend(ctx context.Context, msg *Message, d time.Duration) error {
+	return q.changeVisibility(msg, d)
+}
+
+// changeVisibility 让消息 d 之后重新可见, MNS 的可见时间以秒为单位, 最少 1 秒.
+func (q *Queue) changeVisibility(msg *Message, d time.Duration) error {
+	raw := msg.raw.(*queueMessage)
+	raw.mu.Lock()
+	defer raw.mu.Unlock()
+
+	seconds := int((d + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	_, resp, err := q.client.ChangeMessageVisibility(raw.msg.ReceiptHandle, seconds)
+	if err != nil {
+		return err
+	}
+	raw.msg.ReceiptHandle = resp.ReceiptHandle
+	raw.msg.NextVisibleTime = resp.NextVisibleTime
+	return nil
+}
+
+// Close 什么也不做, QueueClient 由调用方管理.
+func (q *Queue) Close() error {
+	return nil
+}
@@ -0,0 +1,71 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wangping886/mns_consumer/internal/mnsfake"
+	"github.com/wangping886/mns_consumer/logger"
+	"github.com/wangping886/mns_consumer/mns.aliyun"
+	"github.com/wangping886/mns_consumer/tracing"
+)
+
+func TestRuntimeOverQueue(t *testing.T) {
+	fake := mnsfake.NewServer(30 * time.Second)
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	clt := &mns.QueueClient{QueueURL: srv.URL + "/queues/orders"}
+	body := tracing.Seal(map[string]string{HeaderKey: "user-1"}, []byte("hello"))
+	if _, _, err := clt.SendMessage2(&mns.MessageToSend{MessageBody: body}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu       sync.Mutex
+		attempts []int
+	)
+	handler := func(ctx context.Context, msg *Message) error {
+		mu.Lock()
+		attempts = append(attempts, msg.Attempt)
+		n := len(attempts)
+		mu.Unlock()
+		if string(msg.Body) != "hello" || string(msg.Key) != "user-1" {
+			t.Errorf("message body %q key %q, want hello from user-1", msg.Body, msg.Key)
+		}
+		// 处理时间超过 Extend 的间隔, Extend 之后 ReceiptHandle 变化, Ack 要用新的 ReceiptHandle
+		time.Sleep(150 * time.Millisecond)
+		if n == 1 {
+			return errors.New("first attempt fails")
+		}
+		return nil
+	}
+	src := NewQueue(clt)
+	r := NewRuntime(src, handler, WithRetry(0, time.Second), WithExtend(50*time.Millisecond, 30*time.Second), WithLogger(logger.Nop))
+	r.Start()
+	defer r.Stop()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for fake.Len("orders") != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("message not acked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(attempts) != 2 || attempts[0] != 1 || attempts[1] != 2 {
+		t.Errorf("attempts = %v, want [1 2]", attempts)
+	}
+	// 两次处理期间的 Extend, 加上一次 Nack
+	if n := fake.Calls("ChangeMessageVisibility"); n < 3 {
+		t.Errorf("ChangeMessageVisibility calls = %d, want Extend and Nack", n)
+	}
+	if n := fake.Calls("DeleteMessage"); n != 1 {
+		t.Errorf("DeleteMessage calls = %d, want 1", n)
+	}
+}
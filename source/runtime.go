@@ -0,0 +1,260 @@
+package source
+
+import (
+	"context"
+	"time"
+
+	"gopkg.in/tomb.v1"
+
+	"github.com/wangping886/mns_consumer/logger"
+	"github.com/wangping886/mns_consumer/metrics"
+	"github.com/wangping886/mns_consumer/tracing"
+	"github.com/wangping886/mns_consumer/util"
+)
+
+const (
+	defaultLimitSize    = 16
+	defaultRetryBackoff = 10 * time.Second
+)
+
+// DeadLetterFunc 接收重试次数用完的消息, 返回 nil 后 Runtime 确认消息.
+type DeadLetterFunc func(ctx context.Context, msg *Message, err error) error
+
+// Runtime 从 Source 拉取消息并发执行 Handler, MNS 队列和 kafka 使用同一套并发, 重试, 指标和停止逻辑:
+// handler 返回 nil 时 Ack, 返回错误时 Nack, 稍后重新投递.
+type Runtime struct {
+	src          Source
+	handler      Handler
+	limitSize    int
+	limitChan    chan bool // 并发数
+	maxRetry     int
+	retryBackoff time.Duration
+	deadLetter   DeadLetterFunc
+	extendEvery  time.Duration
+	extendBy     time.Duration
+	metrics      metrics.Metrics
+	logger       logger.Logger
+	tracer       tracing.Tracer
+	t            tomb.Tomb
+	w            util.WaitGroupWrapper
+	handlers     util.WaitGroupWrapper
+}
+
+type option func(r *Runtime)
+
+func NewRuntime(src Source, handler Handler, options ...option) *Runtime {
+	r := &Runtime{
+		src:          src,
+		handler:      handler,
+		limitSize:    defaultLimitSize,
+		retryBackoff: defaultRetryBackoff,
+		metrics:      metrics.Nop,
+		logger:       logger.Std,
+		tracer:       tracing.Nop,
+	}
+	for _, o := range options {
+		o(r)
+	}
+	if r.limitSize < 1 {
+		r.limitSize = defaultLimitSize
+	}
+	r.limitChan = make(chan bool, r.limitSize)
+	return r
+}
+
+// WithLimitSize 设置同时执行的 handler 数量上限, 默认 16.
+func WithLimitSize(size int) option {
+	return func(r *Runtime) {
+		r.limitSize = size
+	}
+}
+
+// WithRetry 设置处理失败的消息最多投递几次, 以及每次重新投递前的等待时间, 默认 10 秒.
+// maxAttempts 为 0 表示不限次数; 超过次数的消息交给 WithDeadLetter, 没有设置时继续重试.
+func WithRetry(maxAttempts int, backoff time.Duration) option {
+	return func(r *Runtime) {
+		r.maxRetry = maxAttempts
+		r.retryBackoff = backoff
+	}
+}
+
+// WithDeadLetter 设置重试次数用完的消息的去处, 比如发送到死信队列或者死信 topic.
+func WithDeadLetter(f DeadLetterFunc) option {
+	return func(r *Runtime) {
+		r.deadLetter = f
+	}
+}
+
+// WithExtend 在 handler 执行期间每隔 every 调用一次 Source.Extend, 把处理期限延长 by,
+// 用于执行时间可能超过 MNS 队列可见时间的 handler.
+func WithExtend(every, by time.Duration) option {
+	return func(r *Runtime) {
+		r.extendEvery = every
+		r.extendBy = by
+	}
+}
+
+// WithMetrics 设置指标收集器, 指标的 queue 标签是 Source.Name().
+func WithMetrics(m metrics.Metrics) option {
+	return func(r *Runtime) {
+		r.metrics = m
+	}
+}
+
+func WithLogger(l logger.Logger) option {
+	return func(r *Runtime) {
+		r.logger = l
+	}
+}
+
+// WithTracer 设置 tracer, 以消息 headers 里的 trace 上下文为 parent 开始 span 包住 handler.
+func WithTracer(t tracing.Tracer) option {
+	return func(r *Runtime) {
+		r.tracer = t
+	}
+}
+
+func (r *Runtime) Start() {
+	r.w.Wrap(r.serve)
+
+	go func() {
+		r.w.Wait()
+		r.t.Done()
+	}()
+}
+
+// Stop 停止拉取消息, 等待正在执行的 handler 结束之后关闭 Source.
+func (r *Runtime) Stop() {
+	r.t.Kill(nil)
+	r.t.Wait()
+	if err := r.src.Close(); err != nil {
+		r.logger.Error("close source failed", logger.F("source", r.src.Name()), logger.Err(err))
+	}
+	r.logger.Info("runtime stopped", logger.F("source", r.src.Name()))
+}
+
+func (r *Runtime) serve() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-r.t.Dying()
+		cancel()
+	}()
+
+	name := r.src.Name()
+	for {
+		msgs, err := r.src.Fetch(ctx)
+		if ctx.Err() != nil {
+			// 已经取出但来不及处理的消息不确认, 由 Source 重新投递
+			break
+		}
+		if err != nil {
+			r.logger.Error("fetch message failed", logger.F("source", name), logger.Err(err))
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		if len(msgs) == 0 {
+			r.metrics.EmptyReceive(name)
+			continue
+		}
+		r.metrics.MessagesReceived(name, len(msgs))
+
+		for _, msg := range msgs {
+			select {
+			case r.limitChan <- true:
+			case <-ctx.Done():
+				continue
+			}
+			msg := msg
+			r.handlers.Wrap(func() {
+				defer func() { <-r.limitChan }()
+				r.handle(msg)
+			})
+		}
+	}
+
+	r.handlers.Wait()
+	r.logger.Info("serve done", logger.F("source", name))
+}
+
+// handle 执行 handler 并根据结果确认消息, handler 不受 Stop 打断.
+func (r *Runtime) handle(msg *Message) {
+	name := r.src.Name()
+	r.metrics.InFlight(name, 1)
+	defer r.metrics.InFlight(name, -1)
+	if !msg.Timestamp.IsZero() {
+		r.metrics.MessageLag(name, time.Since(msg.Timestamp))
+	}
+
+	ctx := context.Background()
+	var stopExtend func()
+	if r.extendEvery > 0 {
+		stopExtend = r.extend(ctx, msg)
+	}
+
+	spanCtx, endSpan := r.tracer.StartSpan(ctx, "consume "+name, msg.Headers)
+	begin := time.Now()
+	err := r.handler(spanCtx, msg)
+	r.metrics.MessageHandled(name, time.Since(begin), err)
+	endSpan(err)
+	if stopExtend != nil {
+		stopExtend()
+	}
+
+	fields := []logger.Field{logger.F("source", name), logger.F("message_id", msg.ID), logger.F("attempt", msg.Attempt)}
+	if err == nil {
+		r.ack(ctx, msg, fields)
+		return
+	}
+	r.logger.Warn("handle message failed", append(fields, logger.Err(err))...)
+
+	if r.maxRetry > 0 && msg.Attempt >= r.maxRetry && r.deadLetter != nil {
+		if dlErr := r.deadLetter(ctx, msg, err); dlErr != nil {
+			r.logger.Error("move message to dead letter failed", append(fields, logger.Err(dlErr))...)
+		} else {
+			r.logger.Warn("message moved to dead letter", fields...)
+			r.metrics.MessageDeadLettered(name)
+			r.ack(ctx, msg, fields)
+			return
+		}
+	}
+	if nackErr := r.src.Nack(ctx, msg, r.retryBackoff); nackErr != nil {
+		r.logger.Error("nack message failed", append(fields, logger.Err(nackErr))...)
+	}
+}
+
+func (r *Runtime) ack(ctx context.Context, msg *Message, fields []logger.Field) {
+	if err := r.src.Ack(ctx, msg); err != nil {
+		r.logger.Error("ack message failed", append(fields, logger.Err(err))...)
+		return
+	}
+	r.metrics.MessageDeleted(r.src.Name())
+}
+
+// extend 定期延长消息的处理期限, 返回的 stop 结束延长并等待正在进行的 Extend 返回.
+func (r *Runtime) extend(ctx context.Context, msg *Message) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		tick := time.NewTicker(r.extendEvery)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				if err := r.src.Extend(ctx, msg, r.extendBy); err != nil {
+					r.logger.Warn("extend message failed", logger.F("source", r.src.Name()), logger.F("message_id", msg.ID), logger.Err(err))
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,217 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wangping886/mns_consumer/logger"
+)
+
+// memSource 是内存里的 Source, Nack 的消息 delay 之后重新交给 Fetch, Attempt 加 1.
+type memSource struct {
+	msgs chan *Message
+
+	mu       sync.Mutex
+	acked    []string
+	nacked   []string
+	extended int
+	closed   bool
+}
+
+func newMemSource(ids ...string) *memSource {
+	s := &memSource{msgs: make(chan *Message, 100)}
+	for _, id := range ids {
+		m := NewMessage(nil)
+		m.ID = id
+		m.Attempt = 1
+		s.msgs <- m
+	}
+	return s
+}
+
+func (s *memSource) Name() string { return "mem" }
+
+func (s *memSource) Fetch(ctx context.Context) ([]*Message, error) {
+	select {
+	case m := <-s.msgs:
+		return []*Message{m}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *memSource) Ack(ctx context.Context, msg *Message) error {
+	s.mu.Lock()
+	s.acked = append(s.acked, msg.ID)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memSource) Nack(ctx context.Context, msg *Message, delay time.Duration) error {
+	s.mu.Lock()
+	s.nacked = append(s.nacked, msg.ID)
+	s.mu.Unlock()
+	time.AfterFunc(delay, func() {
+		msg.Attempt++
+		s.msgs <- msg
+	})
+	return nil
+}
+
+func (s *memSource) Extend(ctx context.Context, msg *Message, d time.Duration) error {
+	s.mu.Lock()
+	s.extended++
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memSource) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memSource) state() (acked, nacked []string, extended int, closed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.acked...), append([]string(nil), s.nacked...), s.extended, s.closed
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in 5s")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRuntimeRetryAndDeadLetter(t *testing.T) {
+	src := newMemSource("ok", "bad")
+	var (
+		mu       sync.Mutex
+		attempts []int
+		dead     []string
+	)
+	handler := func(ctx context.Context, msg *Message) error {
+		if msg.ID == "ok" {
+			return nil
+		}
+		mu.Lock()
+		attempts = append(attempts, msg.Attempt)
+		mu.Unlock()
+		return errors.New("always fails")
+	}
+	deadLetter := func(ctx context.Context, msg *Message, err error) error {
+		mu.Lock()
+		dead = append(dead, msg.ID)
+		mu.Unlock()
+		return nil
+	}
+	r := NewRuntime(src, handler, WithRetry(3, 10*time.Millisecond), WithDeadLetter(deadLetter), WithLogger(logger.Nop))
+	r.Start()
+	defer r.Stop()
+
+	waitFor(t, func() bool {
+		acked, _, _, _ := src.state()
+		return len(acked) == 2
+	})
+	acked, nacked, _, _ := src.state()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(attempts) != 3 || attempts[0] != 1 || attempts[2] != 3 {
+		t.Errorf("attempts = %v, want [1 2 3]", attempts)
+	}
+	if len(nacked) != 2 {
+		t.Errorf("nacked = %v, want bad nacked twice before dead lettering", nacked)
+	}
+	if len(dead) != 1 || dead[0] != "bad" {
+		t.Errorf("dead lettered = %v, want [bad]", dead)
+	}
+	if acked[0] != "ok" && acked[1] != "ok" {
+		t.Errorf("acked = %v, want ok acked", acked)
+	}
+}
+
+func TestRuntimeExtendWhileHandling(t *testing.T) {
+	src := newMemSource("slow")
+	done := make(chan struct{})
+	handler := func(ctx context.Context, msg *Message) error {
+		time.Sleep(150 * time.Millisecond)
+		close(done)
+		return nil
+	}
+	r := NewRuntime(src, handler, WithExtend(20*time.Millisecond, time.Minute), WithLogger(logger.Nop))
+	r.Start()
+	defer r.Stop()
+
+	<-done
+	waitFor(t, func() bool {
+		acked, _, _, _ := src.state()
+		return len(acked) == 1
+	})
+	_, _, extended, _ := src.state()
+	if extended < 3 {
+		t.Fatalf("extended %d times during a 150ms handler, want at least 3", extended)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, _, after, _ := src.state(); after != extended {
+		t.Fatalf("extended %d more times after the handler returned", after-extended)
+	}
+}
+
+func TestRuntimeLimitAndStop(t *testing.T) {
+	src := newMemSource("1", "2", "3", "4", "5")
+	var running, maxRunning int32
+	release := make(chan struct{})
+	handler := func(ctx context.Context, msg *Message) error {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt32(&running, -1)
+		return nil
+	}
+	r := NewRuntime(src, handler, WithLimitSize(2), WithLogger(logger.Nop))
+	r.Start()
+
+	waitFor(t, func() bool { return atomic.LoadInt32(&running) == 2 })
+	stopped := make(chan struct{})
+	go func() {
+		r.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Stop returned before running handlers finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not return after handlers finished")
+	}
+
+	acked, _, _, closed := src.state()
+	if max := atomic.LoadInt32(&maxRunning); max != 2 {
+		t.Errorf("max concurrent handlers = %d, want 2", max)
+	}
+	if len(acked) != 2 {
+		t.Errorf("acked = %v, want only the 2 handled messages", acked)
+	}
+	if !closed {
+		t.Error("source not closed by Stop")
+	}
+}
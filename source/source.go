@@ -0,0 +1,65 @@
+// Package source 把 MNS 队列和 kafka topic 抽象成同一种消息来源和消息类型, Handler 只需要写一次.
+//
+// Runtime 驱动任意 Source(NewQueue 或者 kafka.NewSource), 负责并发, 重试, 死信, 延长处理期限, 指标和停止:
+//
+//	r := source.NewRuntime(source.NewQueue(clt), handler, source.WithLimitSize(20), source.WithRetry(5, 10*time.Second))
+//	r.Start()
+//	defer r.Stop()
+//
+// 需要 consumer.Consumer 或者 kafka.Consumer 特有的功能(比如熔断, 批量, 按 key 顺序处理)时,
+// 同一个 handler 可以通过 consumer.SourceHandler 和 kafka.SourceHandler 交给这两个 consumer.
+package source
+
+import (
+	"context"
+	"time"
+)
+
+// HeaderKey 是消息信封里保存 kafka 消息 key 的 header, 和 bridge.HeaderKey 相同.
+const HeaderKey = "kafka-key"
+
+// Message 是和具体消息队列无关的消息.
+type Message struct {
+	ID        string            // MNS 的 MessageId, kafka 的 topic/partition/offset
+	Key       []byte            // kafka 的 key; MNS 消息从信封的 HeaderKey 还原, 没有时为 nil
+	Body      []byte            // 已经拆开信封的原始消息体
+	Headers   map[string]string // kafka 的 headers 或者 MNS 消息信封里的 headers, 包含 trace 上下文
+	Timestamp time.Time         // 消息写入队列的时间
+	Attempt   int               // 第几次投递, 从 1 开始
+
+	raw interface{} // 由 Source 实现保存的原始消息, 用于 Ack, Nack, Extend
+}
+
+// Raw 返回 Source 实现保存的原始消息, 具体类型由实现决定.
+func (m *Message) Raw() interface{} {
+	return m.raw
+}
+
+// Handler 处理一条和消息队列无关的消息, 返回 nil 表示处理成功, Runtime 确认(Ack)消息; 返回错误时 Nack.
+type Handler func(ctx context.Context, msg *Message) error
+
+// NewMessage 供 Source 实现使用, raw 是实现自己的原始消息.
+func NewMessage(raw interface{}) *Message {
+	return &Message{raw: raw}
+}
+
+// Source 是一个消息来源, 实现必须是并发安全的.
+type Source interface {
+	// Name 是指标和日志里使用的名字, 比如队列名或者 topic 名.
+	Name() string
+
+	// Fetch 阻塞直到取到至少一条消息, ctx 取消或者出错; 长轮询超时时可以返回空列表.
+	Fetch(ctx context.Context) ([]*Message, error)
+
+	// Ack 确认消息处理完成, 消息不会再被投递.
+	Ack(ctx context.Context, msg *Message) error
+
+	// Nack 表示消息处理失败, delay 之后重新投递.
+	Nack(ctx context.Context, msg *Message, delay time.Duration) error
+
+	// Extend 把消息的处理期限延长到 d 之后, 避免处理时间较长的消息被重复投递.
+	Extend(ctx context.Context, msg *Message, d time.Duration) error
+
+	// Close 停止拉取消息, 释放资源.
+	Close() error
+}
@@ -0,0 +1,60 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"unicode/utf8"
+)
+
+const envelopeVersion = "v1"
+
+// envelopePrefix 是信封序列化后固定的开头, 用来区分信封和普通消息体.
+var envelopePrefix = []byte(`{"_envelope":"` + envelopeVersion + `"`)
+
+// envelope 是把 trace 上下文(W3C traceparent, tracestate, baggage)和原始消息体打包在一起的 JSON 格式,
+// MNS 和 Kafka 使用同一种格式, 因此消息在两者之间转发时 trace 上下文不会丢失.
+//
+//	{"_envelope":"v1","headers":{"traceparent":"00-..."},"body":"原始消息体"}
+//
+// 原始消息体不是合法的 UTF-8 时使用 body_base64 字段.
+type envelope struct {
+	Version    string            `json:"_envelope"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Body       string            `json:"body,omitempty"`
+	BodyBase64 []byte            `json:"body_base64,omitempty"`
+}
+
+// Seal 把 headers 和 body 打包成信封.
+func Seal(headers map[string]string, body []byte) []byte {
+	env := envelope{
+		Version: envelopeVersion,
+		Headers: headers,
+	}
+	if utf8.Valid(body) {
+		env.Body = string(body)
+	} else {
+		env.BodyBase64 = body
+	}
+	b, _ := json.Marshal(&env) // 只包含 string 和 []byte, 不会失败
+	return b
+}
+
+// IsEnvelope 判断 b 是不是 Seal 生成的信封.
+func IsEnvelope(b []byte) bool {
+	return bytes.HasPrefix(b, envelopePrefix)
+}
+
+// Open 拆开信封, 返回 headers 和原始消息体; b 不是信封时 ok 为 false, body 原样返回.
+func Open(b []byte) (headers map[string]string, body []byte, ok bool) {
+	if !IsEnvelope(b) {
+		return nil, b, false
+	}
+	var env envelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		return nil, b, false
+	}
+	if env.BodyBase64 != nil {
+		return env.Headers, env.BodyBase64, true
+	}
+	return env.Headers, []byte(env.Body), true
+}
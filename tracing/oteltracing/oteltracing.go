@@ -0,0 +1,52 @@
+// Package oteltracing 是基于 OpenTelemetry 的 tracing.Tracer 实现,
+// 使用 W3C traceparent/tracestate 和 baggage 格式传递上下文.
+package oteltracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/wangping886/mns_consumer/tracing"
+)
+
+const instrumentationName = "github.com/wangping886/mns_consumer/tracing/oteltracing"
+
+var _ tracing.Tracer = (*Tracer)(nil)
+
+type Tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// New 返回使用 tp 创建 span 的 Tracer, tp 为 nil 时使用 otel.GetTracerProvider().
+func New(tp trace.TracerProvider) *Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return &Tracer{
+		tracer:     tp.Tracer(instrumentationName),
+		propagator: propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}),
+	}
+}
+
+func (t *Tracer) Inject(ctx context.Context, headers map[string]string) {
+	t.propagator.Inject(ctx, propagation.MapCarrier(headers))
+}
+
+func (t *Tracer) StartSpan(ctx context.Context, name string, headers map[string]string) (context.Context, func(err error)) {
+	if len(headers) > 0 {
+		ctx = t.propagator.Extract(ctx, propagation.MapCarrier(headers))
+	}
+	ctx, span := t.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindConsumer))
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
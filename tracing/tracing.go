@@ -0,0 +1,60 @@
+// Package tracing 在消息队列边界上传递分布式 trace 上下文.
+//
+// 发送端用 SendMessage/PublishMessage (或者 Seal) 把当前 ctx 的 trace 上下文和消息体一起打包成信封,
+// 接收端(consumer.Consumer, kafka.Consumer)识别信封, 拆出原始消息体交给 handler,
+// 并以上游 span 为 parent 开始一个子 span 包住 handler.
+//
+// 默认的 Tracer 是 Nop, 接入 OpenTelemetry 请使用 oteltracing.New().
+package tracing
+
+import (
+	"context"
+
+	"github.com/wangping886/mns_consumer/mns.aliyun"
+)
+
+// Tracer 负责把 trace 上下文写入信封的 headers, 以及从 headers 恢复上下文并开始 span.
+type Tracer interface {
+	// Inject 把 ctx 中的 trace 上下文写入 headers.
+	Inject(ctx context.Context, headers map[string]string)
+
+	// StartSpan 以 headers 里的 trace 上下文为 parent 开始一个 span,
+	// 返回带有新 span 的 ctx, 处理结束后必须调用 end, err 为处理结果.
+	StartSpan(ctx context.Context, name string, headers map[string]string) (spanCtx context.Context, end func(err error))
+}
+
+// Nop 不传递任何 trace 上下文.
+var Nop Tracer = nop{}
+
+type nop struct{}
+
+func (nop) Inject(ctx context.Context, headers map[string]string) {}
+
+func (nop) StartSpan(ctx context.Context, name string, headers map[string]string) (context.Context, func(err error)) {
+	return ctx, func(error) {}
+}
+
+// Wrap 把 ctx 的 trace 上下文和 body 打包成信封.
+func Wrap(ctx context.Context, t Tracer, body []byte) []byte {
+	headers := make(map[string]string)
+	t.Inject(ctx, headers)
+	return Seal(headers, body)
+}
+
+// SendMessage 把 msg.MessageBody 打包成带 trace 上下文的信封, 然后调用 clt.SendMessage2.
+// msg.MessageBody 会被替换为信封.
+func SendMessage(ctx context.Context, t Tracer, clt *mns.QueueClient, msg *mns.MessageToSend, base64Encode bool) (requestId string, messageId string, err error) {
+	if msg != nil && len(msg.MessageBody) > 0 {
+		msg.MessageBody = Wrap(ctx, t, msg.MessageBody)
+	}
+	return clt.SendMessage2(msg, base64Encode)
+}
+
+// PublishMessage 把 msg.MessageBody 打包成带 trace 上下文的信封, 然后调用 clt.PublishMessage2.
+// msg.MessageBody 会被替换为信封.
+func PublishMessage(ctx context.Context, t Tracer, clt *mns.TopicClient, msg *mns.MessageToPublish, base64Encode bool) (requestId string, messageId string, err error) {
+	if msg != nil && len(msg.MessageBody) > 0 {
+		msg.MessageBody = Wrap(ctx, t, msg.MessageBody)
+	}
+	return clt.PublishMessage2(msg, base64Encode)
+}